@@ -3,92 +3,78 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"strings"
-
-	"github.com/conneroisu/groq-go"
 )
 
 //go:embed prompt.md
-var AI_INSTRUCTIONS string
+var promptTemplate string
 
-type GroqClient struct {
-	client *groq.Client
-}
+// AI_INSTRUCTIONS is prompt.md with the API documented in the template header.
+var AI_INSTRUCTIONS = strings.Replace(promptTemplate, apiPlaceholder, apiDocumentation(templateHeader), 1)
 
 type CodeConversation struct {
-	messages []groq.ChatCompletionMessage
+	messages []ChatMessage
 }
 
-func NewGroqClient(apiKey string) *GroqClient {
-	client, err := groq.NewClient(apiKey)
-	if err != nil {
-		panic(fmt.Sprintf("failed to create Groq client: %v", err))
+// NewCodeConversation starts a conversation for a prompt. If there is existing
+// code, the model is asked to revise it, and history holds the earlier turns
+// of the conversation that led to it. Images, such as sketches of the layout,
+// are attached to the prompt for models with vision.
+func NewCodeConversation(query, existingCode string, images []string, history []ChatMessage) *CodeConversation {
+	input := query
+	if existingCode != "" {
+		input = fmt.Sprintf("This is the current program:\n```cpp\n%s\n```\n\nRevise it according to the request below, keeping everything the request doesn't ask to change. Reply with the complete revised program in the format described in the instructions.\n\nRequest: %s", existingCode, query)
 	}
-	return &GroqClient{client: client}
-}
 
-func NewCodeConversation(query, existingCode string) *CodeConversation {
-	input := query
-	/*if existingCode != "" {
-		input = fmt.Sprintf("Rewrite the following Rust code according to the request:\n```rust\n%s\n```\n\nQuery: %s", existingCode, query)
-	}*/
+	if len(images) > 0 {
+		input += "\n\nThe attached images are references from the user, such as sketches of the layout. Follow them where the request doesn't say otherwise."
+	}
 
-	return &CodeConversation{
-		messages: []groq.ChatCompletionMessage{
-			{
-				Role:    groq.RoleSystem,
-				Content: AI_INSTRUCTIONS,
-			},
-			{
-				Role:    groq.RoleUser,
-				Content: input,
-			},
+	messages := []ChatMessage{
+		{
+			Role:    ChatRoleSystem,
+			Content: AI_INSTRUCTIONS,
 		},
 	}
-}
+	messages = append(messages, history...)
 
-func (c *CodeConversation) Generate(groqClient *GroqClient) (string, error) {
-	req := groq.ChatCompletionRequest{
-		Model:       groq.ChatModel("openai/gpt-oss-120b"),
-		Messages:    c.messages,
-		Temperature: 0.2,
+	return &CodeConversation{
+		messages: append(messages, ChatMessage{
+			Role:    ChatRoleUser,
+			Content: input,
+			Images:  images,
+		}),
 	}
+}
 
-	chatCompletion, err := groqClient.client.ChatCompletion(context.Background(), req)
+func (c *CodeConversation) Generate(ctx context.Context, llm *LLM) (string, error) {
+	text, err := llm.Complete(ctx, c.messages)
 	if err != nil {
-		return "", fmt.Errorf("failed to create chat completion: %w", err)
-	}
-
-	if len(chatCompletion.Choices) == 0 {
-		return "", fmt.Errorf("no choices returned from Groq")
+		return "", err
 	}
 
-	message := chatCompletion.Choices[0].Message
-	text := message.Content
-
-	c.messages = append(c.messages, groq.ChatCompletionMessage{
-		Role:    groq.RoleAssistant,
+	c.messages = append(c.messages, ChatMessage{
+		Role:    ChatRoleAssistant,
 		Content: text,
 	})
 
-	codeStart := strings.Index(text, "```cpp")
-	if codeStart == -1 {
-		return "", fmt.Errorf("no cpp code block found")
-	}
-	codeStart += len("```cpp")
-
-	codeEnd := strings.Index(text[codeStart:], "```")
-	if codeEnd == -1 {
-		return "", fmt.Errorf("incomplete cpp code block")
+	code, err := parseResponse(text)
+	var formatErr *formatError
+	if errors.As(err, &formatErr) {
+		c.messages = append(c.messages, ChatMessage{
+			Role:    ChatRoleUser,
+			Content: formatErr.complaint,
+		})
 	}
 
-	return text[codeStart : codeStart+codeEnd], nil
+	return code, err
 }
 
 func (c *CodeConversation) ReportError(error string) {
-	c.messages = append(c.messages, groq.ChatCompletionMessage{
-		Role:    groq.RoleUser,
+	c.messages = append(c.messages, ChatMessage{
+		Role:    ChatRoleUser,
 		Content: fmt.Sprintf("An error occurred. Produce a new code block in the same format as described in the instructions based on this error: %s", error),
 	})
 }
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// allowedHeaders are the standard library headers programs may include, in
+// addition to glm's.
+var allowedHeaders = map[string]bool{}
+
+func init() {
+	headers := []string{
+		"algorithm", "any", "array", "atomic", "bit", "bitset", "cassert", "cctype",
+		"cerrno", "cfloat", "charconv", "chrono", "cinttypes", "climits", "cmath",
+		"compare", "complex", "concepts", "cstddef", "cstdint", "cstdio", "cstdlib",
+		"cstring", "ctime", "deque", "exception", "forward_list", "functional",
+		"initializer_list", "iterator", "limits", "list", "map", "memory", "new",
+		"numbers", "numeric", "optional", "queue", "random", "ranges", "ratio", "set",
+		"span", "sstream", "stack", "stdexcept", "string", "string_view", "tuple",
+		"type_traits", "typeindex", "typeinfo", "unordered_map", "unordered_set",
+		"utility", "variant", "vector",
+		"assert.h", "float.h", "limits.h", "math.h", "stddef.h", "stdint.h", "stdio.h",
+		"stdlib.h", "string.h",
+	}
+
+	for _, header := range headers {
+		allowedHeaders[header] = true
+	}
+}
+
+// simuloClasses are the template's classes whose constructors call into the
+// runtime, which only works once it has started the program.
+var simuloClasses = []string{"Material", "Object", "RenderedObject"}
+
+var (
+	directivePattern       = regexp.MustCompile(`(?m)^[ \t\f\v]*(?:#|%:)[ \t\f\v]*(\w*)(.*)$`)
+	headerNamePattern      = regexp.MustCompile(`^[ \t\f\v]*([<"])([^>"]*)[>"]$`)
+	rawStringPrefixPattern = regexp.MustCompile(`(?:^|[^\w])(?:u8|u|U|L)?R$`)
+	fileAccessPattern      = regexp.MustCompile(`\b(?:__has_include|__has_include_next|__has_embed|asm|__asm|__asm__)\b|##|%:%:`)
+	createPattern          = regexp.MustCompile(`\bstatic\s+(?:std::)?unique_ptr\s*<\s*Game\s*>\s+create\s*\(\s*(?:void\s*)?\)`)
+	onPosePattern          = regexp.MustCompile(`\bvoid\s+on_pose\s*\(\s*int\b[^,)]*,\s*(?:const\s+)?(?:std::)?optional\s*<\s*Pose\s*>`)
+	subclassPattern        = regexp.MustCompile(`\b(?:class|struct)\s+(\w+)\s*(?:final\s*)?:\s*(?:public|protected|private)?\s*(\w+)`)
+	globalFuncAPIPattern   = regexp.MustCompile(`\b(?:random_float|window_size)\s*\(`)
+)
+
+// sourceProblem is a rule from the instructions that a program breaks.
+type sourceProblem struct {
+	line    int
+	column  int
+	message string
+}
+
+// checkSource looks for mistakes that would otherwise only be found by
+// compiling or running the program: a missing Game::create or Game::on_pose,
+// and Simulo APIs used at global scope.
+func checkSource(code string) []sourceProblem {
+	stripped := stripCommentsAndStrings(code)
+	problems := []sourceProblem{}
+
+	gameStart := gameClassPattern.FindStringIndex(stripped)
+	if gameStart == nil {
+		problems = append(problems, sourceProblem{1, 1, "the root class Game is not defined"})
+	} else {
+		body := stripped[gameStart[1]:blockEnd(stripped, gameStart[1])]
+		line, column := position(code, gameStart[0])
+
+		if !createPattern.MatchString(body) {
+			problems = append(problems, sourceProblem{line, column, "Game must have a public `static std::unique_ptr<Game> create()` function"})
+		}
+
+		if !onPosePattern.MatchString(body) {
+			problems = append(problems, sourceProblem{line, column, "Game must have a `void on_pose(int id, std::optional<Pose> pose)` method, even if it's unused"})
+		}
+	}
+
+	globalAPIPattern := objectConstructionPattern(stripped)
+	for _, statement := range globalStatements(stripped, 0) {
+		text := stripped[statement[0]:statement[1]]
+		match := globalAPIPattern.FindStringIndex(text)
+		if match == nil {
+			match = globalFuncAPIPattern.FindStringIndex(text)
+		}
+
+		if match == nil {
+			continue
+		}
+
+		line, column := position(code, statement[0]+match[0])
+		problems = append(problems, sourceProblem{line, column, "Simulo APIs can't be used at global scope, since the runtime hasn't started yet. Create objects and materials in Game's constructor or methods instead"})
+	}
+
+	return problems
+}
+
+// checkDirectives looks for preprocessor directives and other constructs that
+// could make the compiler read files other than the standard library's and
+// glm's headers. Unlike checkSource's problems, these must stop the program
+// from being compiled, since compiler output is shown to users.
+//
+// Includes must name an allowed header directly, so they can't be built by
+// macros, and the names can't be absolute or contain "..". Token pasting and
+// inline assembly are rejected since they could spell out the same things.
+func checkDirectives(code string) []sourceProblem {
+	spliced, offsets := spliceLines(code)
+	stripped := stripCommentsAndStrings(spliced)
+	problems := []sourceProblem{}
+	report := func(offset int, message string) {
+		line, column := position(code, offsets[offset])
+		problems = append(problems, sourceProblem{line, column, message})
+	}
+
+	for _, match := range directivePattern.FindAllStringSubmatchIndex(stripped, -1) {
+		switch name := stripped[match[2]:match[3]]; name {
+		case "include":
+			// Comments after the header name have been blanked out
+			end := match[4] + len(strings.TrimRight(stripped[match[4]:match[5]], " \t\f\v"))
+			header := headerNamePattern.FindStringSubmatchIndex(spliced[match[4]:end])
+			if header == nil {
+				report(match[4], "includes must name a header in quotes or angle brackets")
+				continue
+			}
+
+			quote := spliced[match[4]+header[2]]
+			name := spliced[match[4]+header[4] : match[4]+header[5]]
+			if !isAllowedHeader(name, quote) {
+				report(match[4]+header[4], fmt.Sprintf("%q can't be included, only the C++ standard library and glm are available", name))
+			}
+
+		case "include_next", "import", "embed":
+			report(match[2], fmt.Sprintf("#%s isn't allowed, use #include instead", name))
+		}
+	}
+
+	for _, match := range fileAccessPattern.FindAllStringIndex(stripped, -1) {
+		report(match[0], fmt.Sprintf("%s isn't allowed", strings.TrimSpace(stripped[match[0]:match[1]])))
+	}
+
+	return problems
+}
+
+// isAllowedHeader reports whether a header may be included. Standard headers
+// must be included with angle brackets, glm's either way.
+func isAllowedHeader(name string, quote byte) bool {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || path.Clean(name) != name {
+		return false
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+
+	return strings.HasPrefix(name, "glm/") || (quote == '<' && allowedHeaders[name])
+}
+
+// spliceLines removes backslash-newline sequences like the preprocessor does
+// before anything else, returning the spliced code and the offset in code of
+// each of its bytes.
+func spliceLines(code string) (string, []int) {
+	var out strings.Builder
+	offsets := make([]int, 0, len(code)+1)
+	for i := 0; i < len(code); i++ {
+		if code[i] == '\\' {
+			if i+1 < len(code) && code[i+1] == '\n' {
+				i++
+				continue
+			}
+			if i+2 < len(code) && code[i+1] == '\r' && code[i+2] == '\n' {
+				i += 2
+				continue
+			}
+		}
+		out.WriteByte(code[i])
+		offsets = append(offsets, i)
+	}
+
+	return out.String(), append(offsets, len(code))
+}
+
+// formatSourceProblems formats problems like compiler diagnostics for
+// main.cpp, so they are reported the same way as compile errors.
+func formatSourceProblems(problems []sourceProblem) string {
+	var out strings.Builder
+	for _, problem := range problems {
+		fmt.Fprintf(&out, "main.cpp:%d:%d: error: %s\n", problem.line+sourceLineOffset, problem.column, problem.message)
+	}
+	return out.String()
+}
+
+// objectConstructionPattern matches variables and make_unique calls that
+// construct the template's classes or classes derived from them.
+func objectConstructionPattern(code string) *regexp.Regexp {
+	classes := map[string]bool{}
+	for _, name := range simuloClasses {
+		classes[name] = true
+	}
+
+	matches := subclassPattern.FindAllStringSubmatch(code, -1)
+	for changed := true; changed; {
+		changed = false
+		for _, match := range matches {
+			if classes[match[2]] && !classes[match[1]] {
+				classes[match[1]] = true
+				changed = true
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range classes {
+		names = append(names, name)
+	}
+	alternatives := strings.Join(names, "|")
+
+	return regexp.MustCompile(`\b(?:(?:` + alternatives + `)\s+\w+\s*(?:[({=]|$)|make_unique\s*<\s*(?:` + alternatives + `)\b)`)
+}
+
+// stripCommentsAndStrings blanks out comments and the contents of string and
+// character literals, keeping line breaks so that offsets are unchanged.
+func stripCommentsAndStrings(code string) string {
+	out := []byte(code)
+	for i := 0; i < len(out); i++ {
+		switch {
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := strings.Index(code[i+2:], "*/")
+			if end == -1 {
+				end = len(out)
+			} else {
+				end += i + 4
+			}
+			for ; i < end; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+
+		case out[i] == '"' && rawStringEnd(code, i) != -1:
+			// Raw strings may span lines
+			for end := rawStringEnd(code, i); i < end; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+
+		case out[i] == '"' || out[i] == '\'':
+			quote := out[i]
+			for i++; i < len(out) && out[i] != quote && out[i] != '\n'; i++ {
+				if out[i] == '\\' && i+1 < len(out) {
+					out[i] = ' '
+					i++
+				}
+				out[i] = ' '
+			}
+		}
+	}
+
+	return string(out)
+}
+
+// rawStringEnd returns the offset after the raw string literal whose opening
+// quote is at start, or -1 if the quote doesn't start one.
+func rawStringEnd(code string, start int) int {
+	if !rawStringPrefixPattern.MatchString(code[max(0, start-4):start]) {
+		return -1
+	}
+
+	open := strings.IndexByte(code[start:], '(')
+	if open == -1 || strings.ContainsAny(code[start:start+open], " ()\\\t\n") {
+		return -1
+	}
+
+	closing := ")" + code[start+1:start+open] + "\""
+	end := strings.Index(code[start+open:], closing)
+	if end == -1 {
+		return len(code)
+	}
+	return start + open + end + len(closing)
+}
+
+// blockEnd returns the offset of the brace closing the block that starts at
+// start, or the end of the code if it isn't closed.
+func blockEnd(code string, start int) int {
+	depth := 1
+	for i := start; i < len(code); i++ {
+		switch code[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(code)
+}
+
+// globalStatements returns the ranges of statements at global scope, leaving
+// out preprocessor directives and the bodies of classes and functions.
+// Offsets are relative to base, where code starts.
+func globalStatements(code string, base int) [][2]int {
+	statements := [][2]int{}
+	start := 0
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case '#':
+			if strings.TrimSpace(code[start:i]) == "" {
+				for i < len(code) && code[i] != '\n' {
+					i++
+				}
+				start = i + 1
+			}
+
+		case '{':
+			// Braced initializers belong to the statement, while bodies end it
+			header := code[start:i]
+			end := blockEnd(code, i+1)
+			if isDefinitionHeader(header) {
+				if strings.HasPrefix(strings.TrimSpace(header), "namespace") {
+					statements = append(statements, globalStatements(code[i+1:end], base+i+1)...)
+				}
+				i = end
+				start = i + 1
+				continue
+			}
+			i = end
+
+		case ';':
+			if strings.TrimSpace(code[start:i]) != "" {
+				statements = append(statements, [2]int{base + start, base + i})
+			}
+			start = i + 1
+		}
+	}
+
+	return statements
+}
+
+var (
+	definitionHeaderPattern = regexp.MustCompile(`(?s)^\s*(?:template\s*<.*>\s*)?(?:namespace\b|class\b|struct\b|union\b|enum\b|extern\s+"C"|.*\)\s*(?:const\s*)?(?:noexcept\s*)?(?:->\s*[\w:<>]+\s*)?$)`)
+	operatorNamePattern     = regexp.MustCompile(`\boperator\s*[^\s\w(]*`)
+)
+
+// isDefinitionHeader reports whether the code before a brace starts a body,
+// rather than a braced initializer. An = makes it an initializer, unless it's
+// in parentheses, such as a default argument, in template parameters or in
+// the name of an operator.
+func isDefinitionHeader(header string) bool {
+	if !definitionHeaderPattern.MatchString(header) {
+		return false
+	}
+
+	header = operatorNamePattern.ReplaceAllString(header, "operator")
+	if trimmed := strings.TrimSpace(header); strings.HasPrefix(trimmed, "template") {
+		header = trimmed[templateParametersEnd(trimmed):]
+	}
+
+	depth := 0
+	for _, c := range header {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '=':
+			if depth == 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// templateParametersEnd returns the offset after the angle bracket closing the
+// first template parameter list in code.
+func templateParametersEnd(code string) int {
+	depth := 0
+	for i, c := range code {
+		switch c {
+		case '<':
+			depth++
+		case '>':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+func position(code string, offset int) (int, int) {
+	line := strings.Count(code[:offset], "\n") + 1
+	column := offset - strings.LastIndex(code[:offset], "\n")
+	return line, column
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckDirectives(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   string
+		wantOK bool
+	}{
+		{"standard headers", "#include <vector>\n#include <cmath> // for sqrt\n", true},
+		{"glm", "#include <glm/glm.hpp>\n#include \"glm/gtc/quaternion.hpp\"\n", true},
+		{"indented with comments", "  # /* why */ include <memory>\n", true},
+		{"include in a comment", "// #include \"/etc/passwd\"\n/*\n#include \"../../.env\"\n*/\n", true},
+		{"include in a raw string", "const char* s = R\"x(\n#include \"/etc/passwd\"\n)x\";\n", true},
+		{"multiline macro", "#define SQUARE(x) \\\n    ((x) * (x))\n", true},
+		{"comment continued by a splice", "// comment \\\n#include \"/etc/passwd\"\n", true},
+		{"stringification", "#define NAME(x) #x\n", true},
+
+		{"absolute path", "#include \"/etc/passwd\"\n", false},
+		{"proc", "#include \"/proc/self/environ\"\n", false},
+		{"parent directory", "#include \"../../.env\"\n", false},
+		{"parent directory through glm", "#include <glm/../../../.env>\n", false},
+		{"template header", "#include \"simulo__pre.h\"\n", false},
+		{"standard header in quotes", "#include \"vector\"\n", false},
+		{"unknown header", "#include <fstream>\n", false},
+		{"macro", "#define F \"/etc/passwd\"\n#include F\n", false},
+		{"digraph", "%:include \"/etc/passwd\"\n", false},
+		{"line splice", "#inc\\\nlude \"/etc/passwd\"\n", false},
+		{"raw string hiding a comment", "auto s = R\"x(\" /* )x\";\n#include \"/etc/passwd\"\n*/\n", false},
+		{"include_next", "#include_next <vector>\n", false},
+		{"import", "#import \"/etc/passwd\"\n", false},
+		{"embed", "#embed \"/etc/passwd\"\n", false},
+		{"has_include", "#if __has_include(\"/etc/passwd\")\n#endif\n", false},
+		{"inline assembly", "__asm__(\".incbin \\\"/etc/passwd\\\"\");\n", false},
+		{"token pasting", "#define PASTE(a, b) a##b\n", false},
+		{"digraph token pasting", "#define PASTE(a, b) a%:%:b\n", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := checkDirectives(test.code)
+			if ok := len(problems) == 0; ok != test.wantOK {
+				t.Errorf("got problems %+v", problems)
+			}
+		})
+	}
+}
+
+func TestCheckDirectivesPosition(t *testing.T) {
+	problems := checkDirectives("#include <vector>\n#inc\\\nlude \"/etc/passwd\"\n")
+	if len(problems) != 1 {
+		t.Fatalf("got problems %+v", problems)
+	}
+
+	// Positions are in the submitted code, before lines are spliced
+	if problems[0].line != 3 || problems[0].column != 7 || !strings.Contains(problems[0].message, "/etc/passwd") {
+		t.Errorf("got problem %+v", problems[0])
+	}
+}
+
+// testProgramWithHelpers is a valid program using constructs the analyzer has
+// to look past at global scope.
+const testProgramWithHelpers = `#include <vector>
+
+namespace shapes {
+const float kRadius = 0.5f;
+
+struct Point {
+    float x = 0, y = 0;
+    bool operator==(const Point& other) const { return x == other.x && y == other.y; }
+};
+}
+
+template <typename T = float>
+T clamp01(T value) {
+    return value < 0 ? 0 : (value > 1 ? 1 : value);
+}
+
+static std::vector<int> sizes = {1, 2, 3};
+auto square = [](float x) { return x * x; };
+
+class Ball : public RenderedObject {
+public:
+    Ball(const Material& material) : RenderedObject(material) {}
+};
+
+// Default arguments don't make this an initializer
+void spawn(Object* parent, const Material& material, int count = 3) {
+    for (int i = 0; i < count; i++) {
+        parent->add_child(std::make_unique<Ball>(material));
+    }
+}
+
+class Game : public Object {
+public:
+    Game() : material(0, 1.0f, 0.0f, 0.0f) {
+        spawn(this, material);
+    }
+
+    static std::unique_ptr<Game> create() {
+        return std::make_unique<Game>();
+    }
+
+    void on_pose(int id, std::optional<Pose> pose) {}
+
+private:
+    Material material;
+};
+`
+
+func TestCheckSource(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		// wantProblems are parts of the problems' messages, in order
+		wantProblems []string
+	}{
+		{"minimal", testProgram, nil},
+		{"helpers", testProgramWithHelpers, nil},
+		{"no Game", "class Ball : public Object {};", []string{"Game is not defined"}},
+		{"no create", strings.Replace(testProgram, "create()", "make()", 1), []string{"create()"}},
+		{"no on_pose", strings.Replace(testProgram, "on_pose", "on_move", 1), []string{"on_pose"}},
+		{"global material", "Material red(0, 1.0f, 0.0f, 0.0f);\n" + testProgram, []string{"global scope"}},
+		{"global subclass", testProgramWithHelpers + "\nauto ball = std::make_unique<Ball>(Material(0, 1, 1, 1));\n", []string{"global scope"}},
+		{"global window size", "float width = window_size().x;\n" + testProgram, []string{"global scope"}},
+		{"global in namespace", "namespace game {\nObject root;\n}\n" + testProgram, []string{"global scope"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := checkSource(test.code)
+			if len(problems) != len(test.wantProblems) {
+				t.Fatalf("got problems %+v", problems)
+			}
+
+			for i, problem := range problems {
+				if !strings.Contains(problem.message, test.wantProblems[i]) {
+					t.Errorf("got problem %q, want %q", problem.message, test.wantProblems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckSourcePosition(t *testing.T) {
+	problems := checkSource("// comment\nfloat width = window_size().x;\n" + testProgram)
+	if len(problems) != 1 || problems[0].line != 2 || problems[0].column != 15 {
+		t.Fatalf("got problems %+v", problems)
+	}
+
+	if want := "main.cpp:3:15: error: "; !strings.HasPrefix(formatSourceProblems(problems), want) {
+		t.Errorf("formatted as %q", formatSourceProblems(problems))
+	}
+}
+
+func TestIsDefinitionHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"void update(float delta) ", true},
+		{"\nvoid spawn(Object* p, int count = 3) ", true},
+		{"int clamp(int value, int low = 0, int high = 10) const noexcept ", true},
+		{"bool operator==(const Point& other) const ", true},
+		{"Point& operator=(const Point& other) ", true},
+		{"template <typename T = float>\nT clamp01(T value) ", true},
+		{"template <typename T = float> struct Box ", true},
+		{"class Ball : public Object ", true},
+		{"namespace shapes ", true},
+		{"auto square = [](float x) ", false},
+		{"std::vector<int> sizes = ", false},
+		{"Point origin ", false},
+	}
+
+	for _, test := range tests {
+		if got := isDefinitionHeader(test.header); got != test.want {
+			t.Errorf("isDefinitionHeader(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
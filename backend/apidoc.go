@@ -0,0 +1,182 @@
+package main
+
+import (
+	_ "embed"
+	"regexp"
+	"strings"
+)
+
+// templateHeader is embedded so that the documentation in the system prompt
+// always matches the header programs are compiled against.
+//
+//go:embed template/simulo__pre.h
+var templateHeader string
+
+// apiPlaceholder marks where prompt.md's API documentation goes.
+const apiPlaceholder = "{{api}}"
+
+// headerItem is a declaration or access specifier in the template header.
+type headerItem struct {
+	doc []string
+	// blank is true if a blank line separates the item from the previous one
+	blank bool
+	lines []string
+}
+
+var (
+	accessSpecifierPattern = regexp.MustCompile(`^(public|protected|private)\s*:$`)
+	classHeaderPattern     = regexp.MustCompile(`^(class|struct)\s+\w+[^;{(]*\{$`)
+)
+
+// apiDocumentation renders the declarations in a header that have a ///
+// comment as C++ declarations without their bodies, each preceded by its
+// comment. Documented classes include all of their public members. Runtime
+// imports are documented the same way, so a new simulo_* import or a wrapper
+// for it only needs a /// comment to be taught to the model.
+func apiDocumentation(header string) string {
+	sections := []string{}
+	for _, item := range headerItems(strings.Split(header, "\n")) {
+		if len(item.doc) > 0 && item.lines != nil {
+			sections = append(sections, renderHeaderItem(item, ""))
+		}
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// headerItems splits lines of a header, or of a class body, into items.
+// Preprocessor directives and plain comments are left out.
+func headerItems(lines []string) []headerItem {
+	items := []headerItem{}
+	var current *headerItem
+	blank := false
+	depth := 0
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if current == nil {
+			switch {
+			case trimmed == "":
+				blank = true
+				continue
+			case strings.HasPrefix(trimmed, "///"):
+				doc := strings.TrimPrefix(strings.TrimPrefix(trimmed, "///"), " ")
+				if len(items) == 0 || items[len(items)-1].lines != nil {
+					items = append(items, headerItem{blank: blank})
+					blank = false
+				}
+				items[len(items)-1].doc = append(items[len(items)-1].doc, doc)
+				continue
+			case strings.HasPrefix(trimmed, "//"), strings.HasPrefix(trimmed, "#"):
+				continue
+			}
+
+			if len(items) == 0 || items[len(items)-1].lines != nil {
+				items = append(items, headerItem{blank: blank})
+				blank = false
+			}
+			current = &items[len(items)-1]
+		}
+
+		current.lines = append(current.lines, line)
+		for _, c := range stripCommentsAndStrings(line) {
+			switch c {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+			}
+		}
+
+		code := strings.TrimSpace(stripCommentsAndStrings(line))
+		if depth == 0 && (strings.HasSuffix(code, ";") || strings.HasSuffix(code, "}") || accessSpecifierPattern.MatchString(code)) {
+			current = nil
+		}
+	}
+
+	return items
+}
+
+// renderHeaderItem renders a declaration with its comment.
+func renderHeaderItem(item headerItem, indent string) string {
+	var out strings.Builder
+	for _, doc := range item.doc {
+		out.WriteString(strings.TrimRight(indent+"// "+doc, " ") + "\n")
+	}
+
+	first := strings.TrimSpace(item.lines[0])
+	if !classHeaderPattern.MatchString(first) {
+		out.WriteString(indent + declarationSignature(item.lines))
+		return out.String()
+	}
+
+	// Classes are private by default, structs public
+	public := strings.HasPrefix(first, "struct")
+	members := []string{}
+	for _, member := range headerItems(item.lines[1 : len(item.lines)-1]) {
+		if member.lines == nil {
+			continue
+		}
+
+		if match := accessSpecifierPattern.FindStringSubmatch(strings.TrimSpace(member.lines[0])); match != nil {
+			public = match[1] == "public"
+			continue
+		}
+
+		if !public || strings.HasPrefix(strings.TrimSpace(member.lines[0]), "friend ") {
+			continue
+		}
+
+		rendered := renderHeaderItem(member, indent+"    ")
+		if member.blank && len(members) > 0 {
+			rendered = "\n" + rendered
+		}
+		members = append(members, rendered)
+	}
+
+	out.WriteString(indent + first + "\n")
+	out.WriteString(indent + "public:\n")
+	for _, member := range members {
+		out.WriteString(member + "\n")
+	}
+	out.WriteString(indent + "};")
+	return out.String()
+}
+
+// declarationSignature returns a declaration without attributes, constructor
+// initializers or function body.
+func declarationSignature(lines []string) string {
+	parts := []string{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "__attribute__") {
+			parts = append(parts, line)
+		}
+	}
+	declaration := strings.Join(parts, " ")
+
+	// Variables are shown as they are, with their initializers
+	open := strings.Index(declaration, "(")
+	if open == -1 {
+		return declaration
+	}
+
+	depth := 0
+	for i := open; i < len(declaration); i++ {
+		switch declaration[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+
+		if depth == 0 {
+			rest := declaration[i+1:]
+			if end := strings.IndexAny(rest, ":{;"); end != -1 {
+				rest = rest[:end]
+			}
+			return declaration[:i+1] + strings.TrimRight(rest, " ") + ";"
+		}
+	}
+
+	return declaration
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAPIDocumentation(t *testing.T) {
+	header := `#include <vector>
+
+// A plain comment isn't documentation
+int undocumented() {
+   return 0;
+}
+
+/// Returns a random number
+/// between 0 and 1.
+__attribute__((import_module("env"), import_name("random")))
+float random_float() {
+   return simulo_random();
+}
+
+/// The number of things.
+static int kCount = 3;
+
+/// A documented class.
+class Thing : public Base {
+   int hidden;
+
+public:
+   /// Makes a thing.
+   Thing(int a,
+         int b) : Base(), hidden(a + b) {}
+
+   void undocumented_method() {
+      if (hidden) {
+         hidden--;
+      }
+   }
+   int value;
+
+private:
+   friend void ::simulo__start();
+   void secret() {}
+};
+
+/// Structs are public by default.
+struct Point {
+   float x;
+   float y;
+};
+`
+
+	want := `// Returns a random number
+// between 0 and 1.
+float random_float();
+
+// The number of things.
+static int kCount = 3;
+
+// A documented class.
+class Thing : public Base {
+public:
+    // Makes a thing.
+    Thing(int a, int b);
+
+    void undocumented_method();
+    int value;
+};
+
+// Structs are public by default.
+struct Point {
+public:
+    float x;
+    float y;
+};`
+
+	if got := apiDocumentation(header); got != want {
+		t.Errorf("got:\n%s\n\nwant:\n%s", got, want)
+	}
+}
+
+func TestTemplateAPIDocumentation(t *testing.T) {
+	if strings.Contains(AI_INSTRUCTIONS, apiPlaceholder) {
+		t.Fatal("the instructions still contain the placeholder")
+	}
+
+	documentation := apiDocumentation(templateHeader)
+	for _, want := range []string{
+		"class Object {",
+		"    void add_child(std::unique_ptr<Object> object);",
+		"class RenderedObject : public Object {",
+		"    Material(uint32_t image, float r, float g, float b);",
+		"float random_float();",
+	} {
+		if !strings.Contains(documentation, want) {
+			t.Errorf("documentation is missing %q", want)
+		}
+
+		if !strings.Contains(AI_INSTRUCTIONS, want) {
+			t.Errorf("instructions are missing %q", want)
+		}
+	}
+
+	// Only what the program may use is documented
+	for _, unwanted := range []string{"simulo__id", "friend", "__attribute__", "#include"} {
+		if strings.Contains(documentation, unwanted) {
+			t.Errorf("documentation contains %q", unwanted)
+		}
+	}
+}
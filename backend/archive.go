@@ -0,0 +1,558 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"unicode/utf8"
+)
+
+// archiveVersion is incremented whenever the archive layout changes
+// incompatibly.
+const archiveVersion = 1
+
+// maxArchiveSize limits an uploaded project archive.
+const maxArchiveSize = 4 * 1024 * 1024 * 1024
+
+// maxPromptImageSize matches the limit of E2SAddImages.
+const maxPromptImageSize = 10 * 1024 * 1024
+
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// A project archive is a zip file containing manifest.json, scene.json and the
+// files listed in the manifest.
+type archiveManifest struct {
+	Version      int           `json:"version"`
+	Name         string        `json:"name"`
+	Assets       []archiveFile `json:"assets"`
+	PromptImages []archiveFile `json:"prompt_images"`
+	// Source is the C++ source main.wasm was compiled from, if it's known
+	Source *archiveFile `json:"source,omitempty"`
+}
+
+type archiveFile struct {
+	// Name is the asset name or, for prompt images, the ID the scene refers to
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Sha256      string `json:"sha256"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// handleExportProject streams a project as a zip archive.
+func (s *Server) handleExportProject(w http.ResponseWriter, r *http.Request) {
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var name, scene string
+	err := s.db.QueryRow("SELECT name, scene FROM projects WHERE id = $1", project.ID).Scan(&name, &scene)
+	if err != nil {
+		log.Printf("failed to get project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	assets, err := s.getExistingAssets(project.ID)
+	if err != nil {
+		log.Printf("failed to get existing assets: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	source, err := s.currentSource(project.ID)
+	if err != nil {
+		log.Printf("failed to get source: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="project-%d.zip"`, project.ID))
+
+	// Headers are sent with the first file, so failures past this point are
+	// only logged. The archive is left without its directory, which clients
+	// reject when they open it.
+	archive := zip.NewWriter(w)
+	manifest := archiveManifest{
+		Version:      archiveVersion,
+		Name:         name,
+		Assets:       []archiveFile{},
+		PromptImages: []archiveFile{},
+	}
+
+	for assetName, asset := range assets {
+		file, err := s.exportObject(archive, asset.Object, "assets/"+assetName)
+		if err != nil {
+			log.Printf("failed to export asset %s: %v", assetName, err)
+			return
+		}
+
+		file.Name = assetName
+		file.ContentType = asset.ContentType
+		manifest.Assets = append(manifest.Assets, *file)
+	}
+
+	for _, image := range promptImagesOf(scene) {
+		file, err := s.exportObject(archive, image, "prompt-images/"+image)
+		if err != nil {
+			log.Printf("failed to export prompt image %s: %v", image, err)
+			return
+		}
+
+		file.Name = image
+		manifest.PromptImages = append(manifest.PromptImages, *file)
+	}
+
+	if source != nil {
+		hash := sha256.Sum256([]byte(source.Source))
+		manifest.Source = &archiveFile{
+			Name:   "main.cpp",
+			Path:   "source/main.cpp",
+			Size:   int64(len(source.Source)),
+			Sha256: hex.EncodeToString(hash[:]),
+		}
+
+		if err := writeArchiveFile(archive, manifest.Source.Path, []byte(source.Source)); err != nil {
+			log.Printf("failed to export source: %v", err)
+			return
+		}
+	}
+
+	if err := writeArchiveFile(archive, "scene.json", []byte(scene)); err != nil {
+		log.Printf("failed to export scene: %v", err)
+		return
+	}
+
+	manifestData, _ := json.MarshalIndent(manifest, "", "\t")
+	if err := writeArchiveFile(archive, "manifest.json", manifestData); err != nil {
+		log.Printf("failed to export manifest: %v", err)
+		return
+	}
+
+	if err := archive.Close(); err != nil {
+		log.Printf("failed to finish archive: %v", err)
+	}
+}
+
+func writeArchiveFile(archive *zip.Writer, name string, data []byte) error {
+	writer, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(data)
+	return err
+}
+
+// exportObject copies an object into the archive, hashing it on the way.
+func (s *Server) exportObject(archive *zip.Writer, object, filePath string) (*archiveFile, error) {
+	reader, err := s.store.Open(object)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	writer, err := archive.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(writer, hasher), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveFile{
+		Path:   filePath,
+		Size:   size,
+		Sha256: hex.EncodeToString(hasher.Sum(nil)),
+	}, nil
+}
+
+// handleImportProject creates a project owned by the caller from an archive
+// made by handleExportProject. The name defaults to the one in the archive,
+// and the project is created in an organization if one is given.
+func (s *Server) handleImportProject(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var organization *int64
+	if value := r.URL.Query().Get("organization"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid organization", http.StatusBadRequest)
+			return
+		}
+		organization = &id
+	}
+
+	// zip needs random access, so the archive is spooled to disk first
+	file, err := os.CreateTemp("", "project-import-*.zip")
+	if err != nil {
+		log.Printf("failed to create temporary file: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, http.MaxBytesReader(w, r.Body, maxArchiveSize))
+	if err != nil {
+		http.Error(w, "Archive too large or incomplete", http.StatusBadRequest)
+		return
+	}
+
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		http.Error(w, "Invalid archive", http.StatusBadRequest)
+		return
+	}
+
+	manifest, scene, err := readArchiveManifest(archive)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = manifest.Name
+	}
+
+	if name == "" || len(name) > 255 {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+
+	projectID, err := s.createProject(user.ID, name, organization)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to create project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.importProject(projectID, user.ID, archive, manifest, scene); err != nil {
+		if err := s.deleteProject(projectID); err != nil {
+			log.Printf("failed to delete partially imported project: %v", err)
+		}
+
+		switch {
+		case errors.Is(err, ErrQuotaExceeded):
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, ErrInvalidArchive), isImageError(err):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("failed to import project: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": projectID})
+}
+
+func readArchiveJSON(archive *zip.Reader, name string, value any) error {
+	file, err := archive.Open(name)
+	if err != nil {
+		return fmt.Errorf("%w: missing %s", ErrInvalidArchive, name)
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(io.LimitReader(file, 16*1024*1024)).Decode(value); err != nil {
+		return fmt.Errorf("%w: malformed %s", ErrInvalidArchive, name)
+	}
+
+	return nil
+}
+
+// readArchiveManifest reads and validates the manifest and scene of an archive.
+func readArchiveManifest(archive *zip.Reader) (*archiveManifest, []map[string]interface{}, error) {
+	var manifest archiveManifest
+	if err := readArchiveJSON(archive, "manifest.json", &manifest); err != nil {
+		return nil, nil, err
+	}
+
+	if manifest.Version != archiveVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, manifest.Version)
+	}
+
+	var scene []map[string]interface{}
+	if err := readArchiveJSON(archive, "scene.json", &scene); err != nil {
+		return nil, nil, err
+	}
+
+	if len(scene) == 0 {
+		return nil, nil, fmt.Errorf("%w: empty scene", ErrInvalidArchive)
+	}
+
+	names := map[string]bool{}
+	for _, file := range manifest.Assets {
+		if _, err := checkAssetName(file.Name); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidArchive, file.Name, err)
+		}
+
+		if names[file.Name] {
+			return nil, nil, fmt.Errorf("%w: duplicate asset %s", ErrInvalidArchive, file.Name)
+		}
+		names[file.Name] = true
+
+		if err := checkArchiveFile(archive, file, maxAssetSize); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, file := range manifest.PromptImages {
+		if err := checkArchiveFile(archive, file, maxPromptImageSize); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if manifest.Source != nil {
+		if err := checkArchiveFile(archive, *manifest.Source, maxSourceSize); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &manifest, scene, nil
+}
+
+func checkArchiveFile(archive *zip.Reader, file archiveFile, maxSize int64) error {
+	hash, err := hex.DecodeString(file.Sha256)
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("%w: invalid hash for %s", ErrInvalidArchive, file.Name)
+	}
+
+	if file.Size < 0 || file.Size > maxSize {
+		return fmt.Errorf("%w: invalid size for %s", ErrInvalidArchive, file.Name)
+	}
+
+	for _, entry := range archive.File {
+		if entry.Name != file.Path {
+			continue
+		}
+
+		if entry.UncompressedSize64 != uint64(file.Size) {
+			return fmt.Errorf("%w: size mismatch for %s", ErrInvalidArchive, file.Name)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: missing %s", ErrInvalidArchive, file.Path)
+}
+
+// importProject fills a new project with the contents of an archive.
+func (s *Server) importProject(projectID int64, userID string, archive *zip.Reader, manifest *archiveManifest, scene []map[string]interface{}) error {
+	var total int64
+	for _, file := range manifest.Assets {
+		total += file.Size
+	}
+	for _, file := range manifest.PromptImages {
+		total += file.Size
+	}
+
+	budget, err := s.storageBudget(projectID, userID, total, total)
+	if err != nil {
+		return err
+	}
+
+	if budget < 0 {
+		return ErrQuotaExceeded
+	}
+
+	for _, file := range manifest.Assets {
+		if err := s.importAsset(projectID, userID, archive, file); err != nil {
+			return err
+		}
+	}
+
+	// Prompt images are stored under new IDs, so the scene is updated to
+	// refer to them
+	imageIDs := map[string]string{}
+	for _, file := range manifest.PromptImages {
+		data, err := readArchiveFile(archive, file)
+		if err != nil {
+			return err
+		}
+
+		imageID := generateRandomHex(16)
+		if err := s.storePromptImage(projectID, userID, imageID, data); err != nil {
+			if err := s.deleteObject(imageID); err != nil {
+				log.Printf("failed to rollback prompt image: %v", err)
+			}
+			return err
+		}
+		imageIDs[file.Name] = imageID
+	}
+
+	oldImages, _ := scene[0]["promptImages"].([]interface{})
+	promptImages := []interface{}{}
+	for _, image := range oldImages {
+		if id, ok := image.(string); ok && imageIDs[id] != "" {
+			promptImages = append(promptImages, imageIDs[id])
+		}
+	}
+	scene[0]["promptImages"] = promptImages
+
+	sceneData, _ := json.Marshal(scene)
+	if _, err := s.db.Exec("UPDATE projects SET scene = $1 WHERE id = $2", string(sceneData), projectID); err != nil {
+		return fmt.Errorf("failed to save scene: %w", err)
+	}
+
+	if manifest.Source != nil {
+		return s.importSource(projectID, userID, archive, manifest)
+	}
+
+	return nil
+}
+
+// importSource starts the project's source history with the source of the
+// archive. It isn't compiled, so nothing vouches for it having built the
+// imported main.wasm and it doesn't become the current source.
+func (s *Server) importSource(projectID int64, userID string, archive *zip.Reader, manifest *archiveManifest) error {
+	data, err := readArchiveFile(archive, *manifest.Source)
+	if err != nil {
+		return err
+	}
+
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) != -1 {
+		return fmt.Errorf("%w: source is not text", ErrInvalidArchive)
+	}
+
+	version := &SourceVersion{
+		Source: string(data),
+		Origin: SourceImported,
+		Status: SourceUncompiled,
+	}
+
+	return s.recordSource(projectID, userID, version)
+}
+
+func readArchiveFile(archive *zip.Reader, file archiveFile) ([]byte, error) {
+	reader, err := archive.Open(file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidArchive, file.Path)
+	}
+	defer reader.Close()
+
+	hash, _ := hex.DecodeString(file.Sha256)
+	data, err := io.ReadAll(NewVerifyingReader(reader, hash, file.Size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidArchive, file.Name, err)
+	}
+
+	return data, nil
+}
+
+// importAsset stores an asset from an archive. The entry is read and checked
+// against its hash even if the store already has the contents, so an archive
+// can't get a copy of another project's object by naming its hash, and its
+// actual size is what counts towards the quotas.
+func (s *Server) importAsset(projectID int64, userID string, archive *zip.Reader, file archiveFile) error {
+	fileType, _ := checkAssetName(file.Name)
+	hash, _ := hex.DecodeString(file.Sha256)
+	object := assetObjectName(file.Sha256)
+
+	state, err := s.acquireObject(object)
+	if err != nil {
+		return err
+	}
+
+	// Objects of another or an unknown type are uploaded again to be sniffed
+	var size int64
+	if state.Stored && state.ContentType == fileType.contentType {
+		size, err = verifyArchiveFile(archive, file, hash)
+	} else {
+		size, err = s.uploadArchiveFile(archive, file, object, hash)
+	}
+	if err != nil {
+		s.releaseObjects([]string{object})
+		return err
+	}
+
+	asset := Asset{Hash: file.Sha256, Object: object, ContentType: fileType.contentType, Size: size}
+	if err := s.putAsset(context.Background(), projectID, userID, file.Name, asset); err != nil {
+		s.releaseObjects([]string{object})
+		return err
+	}
+
+	return nil
+}
+
+// verifyArchiveFile checks an archive entry against its hash without storing
+// it and returns its size.
+func verifyArchiveFile(archive *zip.Reader, file archiveFile, hash []byte) (int64, error) {
+	reader, err := archive.Open(file.Path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: missing %s", ErrInvalidArchive, file.Path)
+	}
+	defer reader.Close()
+
+	verifier := NewVerifyingReader(reader, hash, file.Size)
+	if _, err := io.Copy(io.Discard, verifier); err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrInvalidArchive, file.Name, err)
+	}
+
+	return verifier.Size(), nil
+}
+
+// uploadArchiveFile stores an archive entry after checking its hash and type,
+// and returns its size.
+func (s *Server) uploadArchiveFile(archive *zip.Reader, file archiveFile, object string, hash []byte) (int64, error) {
+	reader, err := archive.Open(file.Path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: missing %s", ErrInvalidArchive, file.Path)
+	}
+	defer reader.Close()
+
+	verifier := NewVerifyingReader(reader, hash, file.Size)
+	buffered := bufio.NewReaderSize(verifier, sniffLength)
+
+	header, _ := buffered.Peek(sniffLength)
+	contentType, err := sniffAsset(file.Name, header)
+	if err != nil && verifier.Err() == nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	err = s.store.Upload(object, buffered, -1, hash, contentType)
+	if verifier.Err() != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrInvalidArchive, file.Name, verifier.Err())
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := s.processImageAsset(object, contentType, verifier.Size())
+	if err != nil {
+		return 0, err
+	}
+
+	return size, s.markObjectStored(object, contentType, size)
+}
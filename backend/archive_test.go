@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func testArchive(t *testing.T, files map[string][]byte) *zip.Reader {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for name, data := range files {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write(data)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+func TestImportStoredAsset(t *testing.T) {
+	stored := []byte(`{"secret": true}`)
+	storedHash := sha256.Sum256(stored)
+	object := assetObjectName(hex.EncodeToString(storedHash[:]))
+
+	tests := []struct {
+		name    string
+		entry   []byte
+		wantErr error
+	}{
+		{"matching contents", stored, nil},
+		// Naming the hash of an object from another project isn't enough
+		{"other contents", []byte(`{"secret": 0000}`), ErrInvalidArchive},
+		{"empty", []byte{}, ErrInvalidArchive},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, _ := newTestServer(t)
+			archive := testArchive(t, map[string][]byte{"assets/data.json": test.entry})
+			file := archiveFile{
+				Name:   "data.json",
+				Path:   "assets/data.json",
+				Size:   int64(len(stored)),
+				Sha256: hex.EncodeToString(storedHash[:]),
+			}
+
+			mock.ExpectQuery("INSERT INTO objects").WithArgs(object).
+				WillReturnRows(sqlmock.NewRows([]string{"stored", "content_type", "size"}).AddRow(true, "application/json", len(stored)))
+
+			if test.wantErr == nil {
+				// The size recorded is that of the entry, not the manifest's
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT object FROM project_assets").WillReturnError(sql.ErrNoRows)
+				mock.ExpectExec("INSERT INTO project_assets").
+					WithArgs("data.json", file.Sha256, object, int64(1), "application/json", int64(len(stored)), "user-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE objects SET refs = refs - 1").WithArgs(object).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT refs FROM objects").WithArgs(object).
+					WillReturnRows(sqlmock.NewRows([]string{"refs"}).AddRow(1))
+				mock.ExpectRollback()
+			}
+
+			err := server.importAsset(1, "user-1", archive, file)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestImportSourceIsUncompiled(t *testing.T) {
+	server, mock, _ := newTestServer(t)
+
+	source := []byte("#include \"simulo__pre.h\"\n")
+	hash := sha256.Sum256(source)
+	archive := testArchive(t, map[string][]byte{"main.cpp": source})
+	manifest := &archiveManifest{
+		Assets: []archiveFile{{Name: "main.wasm", Path: "assets/main.wasm", Sha256: "00"}},
+		Source: &archiveFile{Name: "main.cpp", Path: "main.cpp", Size: int64(len(source)), Sha256: hex.EncodeToString(hash[:])},
+	}
+
+	// Nothing vouches for the source having built the archive's main.wasm
+	mock.ExpectBegin()
+	mock.ExpectExec("FOR UPDATE").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO project_sources").
+		WithArgs(int64(1), string(source), SourceImported, "", "", SourceUncompiled, "", nil, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	if err := server.importSource(1, "user-1", archive, manifest); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLength is how many leading bytes of a file are needed to detect its type.
+const sniffLength = 512
+
+type assetType struct {
+	extension   string
+	contentType string
+	sniff       func(header []byte) bool
+}
+
+func hasMagic(magic string) func([]byte) bool {
+	return func(header []byte) bool {
+		return bytes.HasPrefix(header, []byte(magic))
+	}
+}
+
+func isRIFF(format string) func([]byte) bool {
+	return func(header []byte) bool {
+		return len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == format
+	}
+}
+
+func isMP3(header []byte) bool {
+	if bytes.HasPrefix(header, []byte("ID3")) {
+		return true
+	}
+
+	// MPEG audio frame sync
+	return len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0
+}
+
+func isMP4(header []byte) bool {
+	return len(header) >= 8 && string(header[4:8]) == "ftyp"
+}
+
+func isTrueType(header []byte) bool {
+	return hasMagic("\x00\x01\x00\x00")(header) || hasMagic("true")(header)
+}
+
+func isJSON(header []byte) bool {
+	header = bytes.TrimPrefix(header, []byte("\xEF\xBB\xBF"))
+	header = bytes.TrimLeft(header, " \t\r\n")
+	return len(header) > 0 && (header[0] == '{' || header[0] == '[')
+}
+
+var wasmType = assetType{".wasm", "application/wasm", hasMagic("\x00asm")}
+
+// assetTypes lists the extensions that may be uploaded as project assets with
+// the type their contents must have. Detection tries them in order, so loose
+// checks such as MP3 frame sync and JSON come last.
+var assetTypes = []assetType{
+	{".png", "image/png", hasMagic("\x89PNG\r\n\x1a\n")},
+	{".jpg", "image/jpeg", hasMagic("\xFF\xD8\xFF")},
+	{".jpeg", "image/jpeg", hasMagic("\xFF\xD8\xFF")},
+	{".webp", "image/webp", isRIFF("WEBP")},
+	{".ogg", "audio/ogg", hasMagic("OggS")},
+	{".wav", "audio/wav", isRIFF("WAVE")},
+	{".mp4", "video/mp4", isMP4},
+	{".webm", "video/webm", hasMagic("\x1A\x45\xDF\xA3")},
+	{".ttf", "font/ttf", isTrueType},
+	{".otf", "font/otf", hasMagic("OTTO")},
+	{".woff", "font/woff", hasMagic("wOFF")},
+	{".woff2", "font/woff2", hasMagic("wOF2")},
+	{".mp3", "audio/mpeg", isMP3},
+	{".json", "application/json", isJSON},
+}
+
+var errAssetType = errors.New("main.wasm and image, audio, video, font and JSON files can be uploaded")
+
+func assetTypeOf(name string) (assetType, error) {
+	if name == "main.wasm" {
+		return wasmType, nil
+	}
+
+	extension := strings.ToLower(path.Ext(name))
+	for _, fileType := range assetTypes {
+		if fileType.extension == extension {
+			return fileType, nil
+		}
+	}
+
+	return assetType{}, errAssetType
+}
+
+// sniffAsset checks that the leading bytes of a file match the type implied by
+// its name and returns its content type.
+func sniffAsset(name string, header []byte) (string, error) {
+	fileType, err := assetTypeOf(name)
+	if err != nil {
+		return "", err
+	}
+
+	if !fileType.sniff(header) {
+		return "", errors.New(name + " is not a valid " + fileType.contentType + " file")
+	}
+
+	return fileType.contentType, nil
+}
+
+// detectContentType returns the content type of a file from its leading bytes,
+// recognizing every asset type in addition to those known to net/http.
+func detectContentType(header []byte) string {
+	if wasmType.sniff(header) {
+		return wasmType.contentType
+	}
+
+	for _, fileType := range assetTypes {
+		if fileType.sniff(header) {
+			return fileType.contentType
+		}
+	}
+
+	return http.DetectContentType(header)
+}
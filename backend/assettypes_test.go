@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"\x00asm\x01\x00\x00\x00", "application/wasm"},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"\xFF\xD8\xFF\xE0\x00\x10JFIF", "image/jpeg"},
+		{"RIFF\x24\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"RIFF\x24\x00\x00\x00WAVEfmt ", "audio/wav"},
+		{"OggS\x00\x02", "audio/ogg"},
+		{"ID3\x03\x00", "audio/mpeg"},
+		{"\xFF\xFB\x90\x00", "audio/mpeg"},
+		{"\x00\x00\x00\x18ftypmp42", "video/mp4"},
+		{"\x1A\x45\xDF\xA3\x9F\x42\x86\x81", "video/webm"},
+		{"\x00\x01\x00\x00\x00\x10\x01\x00", "font/ttf"},
+		{"OTTO\x00\x0B", "font/otf"},
+		{"wOFF\x00\x01", "font/woff"},
+		{"wOF2\x00\x01", "font/woff2"},
+		{"\xEF\xBB\xBF  {\"a\": 1}", "application/json"},
+		{"[1, 2]", "application/json"},
+		{"plain text", "text/plain; charset=utf-8"},
+	}
+
+	for _, test := range tests {
+		if got := detectContentType([]byte(test.header)); got != test.want {
+			t.Errorf("%q detected as %s, want %s", test.header, got, test.want)
+		}
+	}
+}
+
+func TestSniffAsset(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"main.wasm", "\x00asm", "application/wasm", false},
+		{"image.PNG", "\x89PNG\r\n\x1a\n", "image/png", false},
+		{"image.jpeg", "\xFF\xD8\xFF\xE0", "image/jpeg", false},
+		{"image.png", "\xFF\xD8\xFF\xE0", "", true},
+		{"level.json", "not json", "", true},
+		{"other.wasm", "\x00asm", "", true},
+		{"script.js", "alert(1)", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := sniffAsset(test.name, []byte(test.header))
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%s: got %q, %v", test.name, got, err)
+		}
+	}
+}
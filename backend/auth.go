@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nedpals/supabase-go"
+)
+
+// Principal is an authenticated user.
+type Principal struct {
+	ID    string
+	Email string
+}
+
+// IdentityProvider turns a bearer token into the user it was issued to.
+type IdentityProvider interface {
+	Authenticate(ctx context.Context, token string) (*Principal, error)
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+type SupabaseIdentityProvider struct {
+	client *supabase.Client
+}
+
+func NewSupabaseIdentityProvider(url, apiKey string) *SupabaseIdentityProvider {
+	return &SupabaseIdentityProvider{client: supabase.CreateClient(url, apiKey)}
+}
+
+func (p *SupabaseIdentityProvider) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	user, err := p.client.Auth.User(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return &Principal{ID: user.ID, Email: user.Email}, nil
+}
+
+// JWTIdentityProvider validates HS256 tokens locally against a shared secret,
+// such as the JWT secret of a Supabase project, without a network round trip.
+type JWTIdentityProvider struct {
+	key      []byte
+	audience string
+}
+
+func NewJWTIdentityProvider(key []byte, audience string) *JWTIdentityProvider {
+	return &JWTIdentityProvider{key: key, audience: audience}
+}
+
+func (p *JWTIdentityProvider) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var claims struct {
+		Subject   string          `json:"sub"`
+		Email     string          `json:"email"`
+		ExpiresAt int64           `json:"exp"`
+		NotBefore int64           `json:"nbf"`
+		Audience  json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, fmt.Errorf("token expired")
+	}
+
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+
+	if p.audience != "" && !hasAudience(claims.Audience, p.audience) {
+		return nil, fmt.Errorf("token audience mismatch")
+	}
+
+	if claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+
+	return &Principal{ID: claims.Subject, Email: claims.Email}, nil
+}
+
+// hasAudience checks an "aud" claim, which may be a single string or a list.
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == audience
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return slices.Contains(list, audience)
+	}
+
+	return false
+}
+
+// FakeIdentityProvider accepts a fixed set of tokens. Intended for tests.
+type FakeIdentityProvider struct {
+	Tokens map[string]Principal
+}
+
+func (p *FakeIdentityProvider) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	principal, ok := p.Tokens[token]
+	if !ok {
+		return nil, errInvalidToken
+	}
+
+	return &principal, nil
+}
+
+// NewIdentityProvider selects the identity provider named by AUTH_PROVIDER,
+// defaulting to Supabase.
+func NewIdentityProvider(getenv func(string) string) (IdentityProvider, error) {
+	switch getenv("AUTH_PROVIDER") {
+	case "", "supabase":
+		return NewSupabaseIdentityProvider(getenv("SUPABASE_URL"), getenv("SUPABASE_API_KEY")), nil
+
+	case "jwt":
+		secret := getenv("JWT_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("JWT_SECRET is required for the jwt auth provider")
+		}
+		return NewJWTIdentityProvider([]byte(secret), getenv("JWT_AUDIENCE")), nil
+
+	default:
+		return nil, fmt.Errorf("unknown auth provider %q", getenv("AUTH_PROVIDER"))
+	}
+}
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	projectAccessKey
+)
+
+// ProjectAccess is the project addressed by a request and the caller's role on it.
+type ProjectAccess struct {
+	ID   int64
+	Role ProjectRole
+}
+
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey).(*Principal)
+	return principal
+}
+
+func ProjectAccessFromContext(ctx context.Context) ProjectAccess {
+	access, _ := ctx.Value(projectAccessKey).(ProjectAccess)
+	return access
+}
+
+func (s *Server) authenticate(ctx context.Context, token string) (*Principal, error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if token == "" {
+		return nil, fmt.Errorf("no token")
+	}
+
+	return s.identity.Authenticate(ctx, token)
+}
+
+// withCORS sets CORS headers and answers preflight requests.
+func (s *Server) withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.setCORSHeaders(w)
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// withAuth rejects requests without a valid Authorization header and places
+// the authenticated Principal on the request context.
+func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return s.withCORS(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := s.authenticate(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey, principal)
+		next(w, r.WithContext(ctx))
+	})
+}
+
+// withProject authenticates the request and resolves the caller's role on the
+// project in the {id} path segment.
+func (s *Server) withProject(next http.HandlerFunc) http.HandlerFunc {
+	return s.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		user := PrincipalFromContext(r.Context())
+		access, ok := s.checkProjectRole(w, r.PathValue("id"), user.ID, ProjectRole.Valid)
+		if !ok {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), projectAccessKey, access)
+		next(w, r.WithContext(ctx))
+	})
+}
+
+// checkProjectRole looks up the user's role on a project and verifies it with
+// allowed, writing an error response and returning false if that fails. Users
+// without any access get a 404 so project IDs are not leaked.
+func (s *Server) checkProjectRole(w http.ResponseWriter, projectID, userID string, allowed func(ProjectRole) bool) (ProjectAccess, bool) {
+	id, err := strconv.ParseInt(projectID, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return ProjectAccess{}, false
+	}
+
+	role, err := s.GetProjectRole(id, userID)
+	if err != nil {
+		log.Printf("failed to get project role: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return ProjectAccess{}, false
+	}
+
+	if role == "" {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return ProjectAccess{}, false
+	}
+
+	if !allowed(role) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return ProjectAccess{}, false
+	}
+
+	return ProjectAccess{ID: id, Role: role}, true
+}
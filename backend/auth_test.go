@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testJWTKey = []byte("test secret")
+
+func signTestToken(t *testing.T, key []byte, header, claims map[string]any) string {
+	t.Helper()
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTIdentityProvider(t *testing.T) {
+	now := time.Now().Unix()
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	valid := func() map[string]any {
+		return map[string]any{
+			"sub":   "user-1",
+			"email": "user@example.com",
+			"exp":   now + 3600,
+			"aud":   "authenticated",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		token  func() string
+		wantID string
+	}{
+		{
+			name:   "valid",
+			token:  func() string { return signTestToken(t, testJWTKey, hs256, valid()) },
+			wantID: "user-1",
+		},
+		{
+			name: "audience list",
+			token: func() string {
+				claims := valid()
+				claims["aud"] = []string{"other", "authenticated"}
+				return signTestToken(t, testJWTKey, hs256, claims)
+			},
+			wantID: "user-1",
+		},
+		{
+			name: "audience mismatch",
+			token: func() string {
+				claims := valid()
+				claims["aud"] = "anon"
+				return signTestToken(t, testJWTKey, hs256, claims)
+			},
+		},
+		{
+			name: "missing audience",
+			token: func() string {
+				claims := valid()
+				delete(claims, "aud")
+				return signTestToken(t, testJWTKey, hs256, claims)
+			},
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := valid()
+				claims["exp"] = now - 1
+				return signTestToken(t, testJWTKey, hs256, claims)
+			},
+		},
+		{
+			name: "no expiry",
+			token: func() string {
+				claims := valid()
+				delete(claims, "exp")
+				return signTestToken(t, testJWTKey, hs256, claims)
+			},
+		},
+		{
+			name: "not yet valid",
+			token: func() string {
+				claims := valid()
+				claims["nbf"] = now + 600
+				return signTestToken(t, testJWTKey, hs256, claims)
+			},
+		},
+		{
+			name: "no subject",
+			token: func() string {
+				claims := valid()
+				delete(claims, "sub")
+				return signTestToken(t, testJWTKey, hs256, claims)
+			},
+		},
+		{
+			name:  "wrong key",
+			token: func() string { return signTestToken(t, []byte("other secret"), hs256, valid()) },
+		},
+		{
+			name: "alg none",
+			token: func() string {
+				token := signTestToken(t, testJWTKey, map[string]any{"alg": "none"}, valid())
+				return token[:strings.LastIndex(token, ".")+1]
+			},
+		},
+		{
+			name:  "alg HS512",
+			token: func() string { return signTestToken(t, testJWTKey, map[string]any{"alg": "HS512"}, valid()) },
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				token := signTestToken(t, testJWTKey, hs256, valid())
+				claims := valid()
+				claims["sub"] = "user-2"
+				forged := signTestToken(t, testJWTKey, hs256, claims)
+				return forged[:strings.LastIndex(forged, ".")] + token[strings.LastIndex(token, "."):]
+			},
+		},
+		{
+			name:  "malformed",
+			token: func() string { return "not.a-token" },
+		},
+	}
+
+	provider := NewJWTIdentityProvider(testJWTKey, "authenticated")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal, err := provider.Authenticate(context.Background(), test.token())
+			if test.wantID == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got principal %+v", principal)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if principal.ID != test.wantID || principal.Email != "user@example.com" {
+				t.Errorf("got principal %+v", principal)
+			}
+		})
+	}
+}
+
+func TestJWTIdentityProviderWithoutAudience(t *testing.T) {
+	provider := NewJWTIdentityProvider(testJWTKey, "")
+	token := signTestToken(t, testJWTKey, map[string]any{"alg": "HS256"}, map[string]any{
+		"sub": "user-1",
+		"exp": time.Now().Unix() + 60,
+	})
+
+	if _, err := provider.Authenticate(context.Background(), token); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWithAuth(t *testing.T) {
+	server := &Server{identity: &FakeIdentityProvider{
+		Tokens: map[string]Principal{"token-1": {ID: "user-1", Email: "user@example.com"}},
+	}}
+
+	handler := server.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(PrincipalFromContext(r.Context()).ID))
+	})
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		wantStatus    int
+		wantBody      string
+	}{
+		{"bearer token", "GET", "Bearer token-1", http.StatusOK, "user-1"},
+		{"bare token", "GET", "token-1", http.StatusOK, "user-1"},
+		{"unknown token", "GET", "Bearer token-2", http.StatusUnauthorized, ""},
+		{"no token", "GET", "", http.StatusUnauthorized, ""},
+		{"preflight", "OPTIONS", "", http.StatusNoContent, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, "/projects", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.wantStatus)
+			}
+
+			if test.wantBody != "" && recorder.Body.String() != test.wantBody {
+				t.Errorf("got body %q, want %q", recorder.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CompileDiagnostic is an error, warning or note reported by the compiler.
+type CompileDiagnostic struct {
+	// File is main.cpp for the submitted source, or the template header the
+	// diagnostic points into
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+var (
+	diagnosticPattern      = regexp.MustCompile(`^([^:\s][^:]*):(\d+):(\d+): (fatal error|error|warning|note): (.*)$`)
+	undefinedSymbolPattern = regexp.MustCompile(`^wasm-ld: error: .*: (undefined symbol: .*)$`)
+)
+
+// sanitizeCompileOutput keeps the diagnostics in compiler output that point
+// into main.cpp or the template's headers, along with undefined symbols. The
+// rest, such as quoted lines of other files and the toolchain's paths, is left
+// out, since the output is shown to users and the model.
+func sanitizeCompileOutput(output string) string {
+	var out strings.Builder
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if match := diagnosticPattern.FindStringSubmatch(line); match != nil {
+			file := strings.TrimPrefix(match[1], "./")
+			if file == "main.cpp" || file == "simulo__pre.h" || file == "simulo__post.h" || strings.HasPrefix(file, "glm/") {
+				out.WriteString(file + strings.TrimPrefix(line, match[1]) + "\n")
+			}
+		} else if match := undefinedSymbolPattern.FindStringSubmatch(line); match != nil {
+			out.WriteString("wasm-ld: error: " + match[1] + "\n")
+		}
+	}
+	return out.String()
+}
+
+// parseDiagnostics extracts clang diagnostics from compiler output. Lines of
+// main.cpp are numbered as in the submitted source, without the template
+// include that precedes it.
+func parseDiagnostics(output string) []CompileDiagnostic {
+	diagnostics := []CompileDiagnostic{}
+	for _, line := range strings.Split(output, "\n") {
+		match := diagnosticPattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if match == nil {
+			continue
+		}
+
+		lineNumber, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		if match[1] == "main.cpp" {
+			lineNumber = max(1, lineNumber-sourceLineOffset)
+		}
+
+		severity := match[4]
+		if severity == "fatal error" {
+			severity = "error"
+		}
+
+		diagnostics = append(diagnostics, CompileDiagnostic{
+			File:     match[1],
+			Line:     lineNumber,
+			Column:   column,
+			Severity: severity,
+			Message:  match[5],
+		})
+	}
+
+	return diagnostics
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestSanitizeCompileOutput(t *testing.T) {
+	output := `In file included from main.cpp:2:
+./simulo__pre.h:10:5: note: candidate function not viable
+/etc/passwd:1:5: error: unknown type name 'root'
+    1 | root:x:0:0:root:/root:/bin/bash
+      |     ^
+main.cpp:3:1: error: expected ';' after class
+    3 | }
+      |  ^
+/emsdk/upstream/emscripten/cache/sysroot/include/c++/v1/vector:100:3: note: in instantiation
+wasm-ld: error: /tmp/emscripten_temp_abc/main_0.o: undefined symbol: spawn()
+2 errors generated.
+em++: error: '/emsdk/upstream/bin/clang++ main.cpp' failed (returned 1)
+`
+
+	want := `simulo__pre.h:10:5: note: candidate function not viable
+main.cpp:3:1: error: expected ';' after class
+wasm-ld: error: undefined symbol: spawn()
+`
+
+	if got := sanitizeCompileOutput(output); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	diagnostics := parseDiagnostics(sanitizeCompileOutput(output))
+	if len(diagnostics) != 2 || diagnostics[1].File != "main.cpp" || diagnostics[1].Line != 3-sourceLineOffset {
+		t.Errorf("got diagnostics %+v", diagnostics)
+	}
+}
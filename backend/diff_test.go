@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func numberedLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = "line " + strconv.Itoa(i+1)
+	}
+	return lines
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	twenty := numberedLines(20)
+	changed := append([]string{}, twenty...)
+	changed[1] = "second"
+	changed[17] = "eighteenth"
+
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", ""},
+		{"both empty", "", "", ""},
+		{
+			name: "changed line",
+			from: "a\nb\nc\n",
+			to:   "a\nB\nc\n",
+			want: "--- v1\n+++ v2\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name: "from empty",
+			from: "",
+			to:   "x\n",
+			want: "--- v1\n+++ v2\n@@ -0,0 +1 @@\n+x\n",
+		},
+		{
+			name: "to empty",
+			from: "x\ny\n",
+			to:   "",
+			want: "--- v1\n+++ v2\n@@ -1,2 +0,0 @@\n-x\n-y\n",
+		},
+		{
+			name: "separate hunks",
+			from: strings.Join(twenty, "\n"),
+			to:   strings.Join(changed, "\n"),
+			want: "--- v1\n+++ v2\n" +
+				"@@ -1,5 +1,5 @@\n line 1\n-line 2\n+second\n line 3\n line 4\n line 5\n" +
+				"@@ -15,6 +15,6 @@\n line 15\n line 16\n line 17\n-line 18\n+eighteenth\n line 19\n line 20\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := unifiedDiff("v1", "v2", test.from, test.to); got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+// applyUnifiedDiff applies a diff made by unifiedDiff to the lines it was made
+// from.
+func applyUnifiedDiff(t *testing.T, from []string, diff string) []string {
+	t.Helper()
+
+	result := []string{}
+	next := 0
+	lines := splitLines(diff)
+	for i := 2; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "@@") {
+			var start int
+			fmt.Sscanf(line, "@@ -%d", &start)
+			// Ranges of empty hunks name the line before them
+			if !strings.HasPrefix(line, fmt.Sprintf("@@ -%d,0 ", start)) {
+				start--
+			}
+			result = append(result, from[next:start]...)
+			next = start
+			continue
+		}
+
+		switch line[0] {
+		case ' ':
+			if from[next] != line[1:] {
+				t.Fatalf("context %q doesn't match line %d, %q", line[1:], next+1, from[next])
+			}
+			result = append(result, line[1:])
+			next++
+		case '-':
+			if from[next] != line[1:] {
+				t.Fatalf("removed %q doesn't match line %d, %q", line[1:], next+1, from[next])
+			}
+			next++
+		case '+':
+			result = append(result, line[1:])
+		}
+	}
+
+	return append(result, from[next:]...)
+}
+
+func TestUnifiedDiffApplies(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	words := []string{"a", "b", "c", "d"}
+	randomLines := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = words[random.Intn(len(words))]
+		}
+		return lines
+	}
+
+	for i := 0; i < 200; i++ {
+		from, to := randomLines(random.Intn(30)), randomLines(random.Intn(30))
+		diff := unifiedDiff("v1", "v2", strings.Join(from, "\n"), strings.Join(to, "\n"))
+		if len(from) == 0 && len(to) == 0 {
+			continue
+		}
+
+		got := applyUnifiedDiff(t, from, diff)
+		if strings.Join(got, "\n") != strings.Join(to, "\n") {
+			t.Fatalf("diff of %q and %q applies as %q:\n%s", from, to, got, diff)
+		}
+	}
+}
+
+func TestUnifiedDiffLargeChange(t *testing.T) {
+	// Too many edits to minimize, so the changed region is replaced whole
+	from, to := make([]string, 3000), make([]string, 3000)
+	for i := range from {
+		from[i] = "old " + strconv.Itoa(i)
+		to[i] = "new " + strconv.Itoa(i)
+	}
+
+	diff := unifiedDiff("v1", "v2", strings.Join(from, "\n"), strings.Join(to, "\n"))
+	got := applyUnifiedDiff(t, from, diff)
+	if strings.Join(got, "\n") != strings.Join(to, "\n") {
+		t.Error("large diff doesn't apply")
+	}
+}
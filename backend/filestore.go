@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileStore keeps objects in a local directory. Presigned URLs point back at
+// this backend and are verified with an HMAC of the object name and expiry.
+type FileStore struct {
+	dir       string
+	publicURL string
+	key       []byte
+}
+
+func NewFileStore(dir, publicURL string, key []byte) (*FileStore, error) {
+	if dir == "" {
+		dir = "storage"
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &FileStore{dir: dir, publicURL: publicURL, key: key}, nil
+}
+
+func (f *FileStore) path(name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+
+	return filepath.Join(f.dir, filepath.FromSlash(name)), nil
+}
+
+// Content types aren't recorded, they are detected again from the contents when
+// an object is read.
+func (f *FileStore) Upload(name string, reader io.Reader, size int64, hash []byte, contentType string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(path, reader, size); err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file first so readers never observe
+// partial files.
+func writeFileAtomic(path string, reader io.Reader, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if size >= 0 {
+		reader = io.LimitReader(reader, size)
+	}
+
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *FileStore) Delete(name string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	return nil
+}
+
+func (f *FileStore) PresignURL(name string, expiresIn time.Duration) (string, error) {
+	if _, err := f.path(name); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(expiresIn).Unix(), 10)
+	query := url.Values{
+		"expires":   {expires},
+		"signature": {f.sign(name, expires)},
+	}
+
+	return f.publicURL + "/objects/" + name + "?" + query.Encode(), nil
+}
+
+func (f *FileStore) Open(name string) (io.ReadSeekCloser, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object: %w", err)
+	}
+
+	return file, nil
+}
+
+func (f *FileStore) GetHash(name string) ([]byte, error) {
+	info, err := f.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Hash, nil
+}
+
+func (f *FileStore) Stat(name string) (*ObjectInfo, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object metadata: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object metadata: %w", err)
+	}
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("failed to hash object: %w", err)
+	}
+
+	hasher := sha256.New()
+	hasher.Write(header[:n])
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, fmt.Errorf("failed to hash object: %w", err)
+	}
+
+	return &ObjectInfo{
+		Name:         name,
+		Size:         stat.Size(),
+		Hash:         hasher.Sum(nil),
+		ContentType:  detectContentType(header[:n]),
+		LastModified: stat.ModTime(),
+	}, nil
+}
+
+func (f *FileStore) List(fn func(info ObjectInfo) error) error {
+	return filepath.WalkDir(f.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip multipart parts and partially written files
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() && path != f.dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(f.dir, path)
+		if err != nil {
+			return err
+		}
+
+		return fn(ObjectInfo{
+			Name:         filepath.ToSlash(name),
+			Size:         stat.Size(),
+			LastModified: stat.ModTime(),
+		})
+	})
+}
+
+func (f *FileStore) sign(name, expires string) string {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(name + "|" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandleDownload serves objects through URLs created by PresignURL.
+func (f *FileStore) HandleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	expires := r.URL.Query().Get("expires")
+	signature := r.URL.Query().Get("signature")
+
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresUnix {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(f.sign(name, expires))) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	path, err := f.path(name)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	header := make([]byte, sniffLength)
+	n, _ := io.ReadFull(file, header)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", detectContentType(header[:n]))
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
+
+func (f *FileStore) multipartDir(uploadID string) (string, error) {
+	if !filepath.IsLocal(uploadID) {
+		return "", fmt.Errorf("invalid upload ID %q", uploadID)
+	}
+
+	return filepath.Join(f.dir, ".multipart", uploadID), nil
+}
+
+func (f *FileStore) CreateMultipartUpload(name string, hash []byte, contentType string) (string, error) {
+	if _, err := f.path(name); err != nil {
+		return "", err
+	}
+
+	uploadID := generateRandomHex(16)
+	dir, err := f.multipartDir(uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	return uploadID, nil
+}
+
+func (f *FileStore) UploadPart(name, uploadID string, partNumber int, reader io.Reader, size int64) (string, error) {
+	dir, err := f.multipartDir(uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, strconv.Itoa(partNumber)), reader, size); err != nil {
+		return "", fmt.Errorf("failed to upload part: %w", err)
+	}
+
+	return strconv.Itoa(partNumber), nil
+}
+
+func (f *FileStore) CompleteMultipartUpload(name, uploadID string, etags []string) error {
+	dir, err := f.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, len(etags))
+	for i := range etags {
+		part, err := os.Open(filepath.Join(dir, strconv.Itoa(i+1)))
+		if err != nil {
+			return fmt.Errorf("failed to open part: %w", err)
+		}
+		defer part.Close()
+		readers[i] = part
+	}
+
+	if err := f.Upload(name, io.MultiReader(readers...), -1, nil, ""); err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func (f *FileStore) AbortMultipartUpload(name, uploadID string) error {
+	dir, err := f.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+type GCReport struct {
+	Scanned  int
+	Orphaned []string
+	Bytes    int64
+	Deleted  int
+}
+
+// ObjectCollector periodically deletes objects from the store that nothing in
+// the database refers to, such as leftovers of failed rollbacks. Objects
+// younger than the grace period are kept since they may belong to an upload
+// that hasn't been recorded yet.
+type ObjectCollector struct {
+	server      *Server
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+}
+
+func NewObjectCollector(server *Server, interval, gracePeriod time.Duration, dryRun bool) *ObjectCollector {
+	return &ObjectCollector{
+		server:      server,
+		interval:    interval,
+		gracePeriod: gracePeriod,
+		dryRun:      dryRun,
+	}
+}
+
+func (c *ObjectCollector) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := c.Sweep()
+		if err != nil {
+			log.Printf("object collection failed: %v", err)
+			continue
+		}
+
+		if c.dryRun {
+			for _, name := range report.Orphaned {
+				log.Printf("[gc dry run] would delete %s", name)
+			}
+			log.Printf("[gc dry run] scanned %d objects, %d orphaned (%d bytes)", report.Scanned, len(report.Orphaned), report.Bytes)
+		} else {
+			log.Printf("[gc] scanned %d objects, deleted %d of %d orphaned (%d bytes)", report.Scanned, report.Deleted, len(report.Orphaned), report.Bytes)
+		}
+	}
+}
+
+func (c *ObjectCollector) Sweep() (*GCReport, error) {
+	referenced, err := c.referencedObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{}
+	cutoff := time.Now().Add(-c.gracePeriod)
+
+	err = c.server.store.List(func(info ObjectInfo) error {
+		report.Scanned++
+		if referenced[info.Name] || info.LastModified.After(cutoff) {
+			return nil
+		}
+
+		report.Orphaned = append(report.Orphaned, info.Name)
+		report.Bytes += info.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dryRun {
+		return report, nil
+	}
+
+	for _, name := range report.Orphaned {
+		deleted, err := c.collect(name, cutoff)
+		if err != nil {
+			log.Printf("failed to collect object %s: %v", name, err)
+			continue
+		}
+
+		if deleted {
+			report.Deleted++
+		}
+	}
+
+	return report, nil
+}
+
+// referencedObjects returns every object named by project assets,
+// deployments, pending upload sessions or prompt images in scenes, along with
+// their image variants.
+func (c *ObjectCollector) referencedObjects() (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	query := `
+		SELECT object FROM project_assets
+		UNION SELECT object FROM deployment_assets
+		UNION SELECT object FROM upload_sessions
+	`
+	rows, err := c.server.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referenced objects: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			return nil, err
+		}
+		referenced[object] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sceneRows, err := c.server.db.Query("SELECT scene FROM projects")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scenes: %w", err)
+	}
+	defer sceneRows.Close()
+
+	for sceneRows.Next() {
+		var scene string
+		if err := sceneRows.Scan(&scene); err != nil {
+			return nil, err
+		}
+
+		for _, image := range promptImagesOf(scene) {
+			referenced[image] = true
+		}
+	}
+
+	if err := sceneRows.Err(); err != nil {
+		return nil, err
+	}
+
+	variantRows, err := c.server.db.Query("SELECT object, variant_object FROM image_variants")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image variants: %w", err)
+	}
+	defer variantRows.Close()
+
+	for variantRows.Next() {
+		var object, variant string
+		if err := variantRows.Scan(&object, &variant); err != nil {
+			return nil, err
+		}
+
+		if referenced[object] {
+			referenced[variant] = true
+		}
+	}
+
+	return referenced, variantRows.Err()
+}
+
+// collect deletes an orphaned object. It rechecks the references, including
+// scenes' prompt images, while holding the object's row lock, since a
+// content-addressed object may have been reused by an upload after the sweep
+// started.
+func (c *ObjectCollector) collect(name string, cutoff time.Time) (bool, error) {
+	tx, err := c.server.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var refs int
+	var updatedAt time.Time
+	err = tx.QueryRow("SELECT refs, updated_at FROM objects WHERE name = $1 FOR UPDATE", name).Scan(&refs, &updatedAt)
+	hasRow := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	// A recent reference may be an upload that's still in progress
+	if hasRow && refs > 0 && updatedAt.After(cutoff) {
+		return false, nil
+	}
+
+	// Variants are deleted along with the image they belong to
+	var isVariant bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM image_variants WHERE variant_object = $1)", name).Scan(&isVariant); err != nil {
+		return false, err
+	}
+
+	if isVariant {
+		return false, nil
+	}
+
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM project_assets WHERE object = $1) +
+			(SELECT COUNT(*) FROM deployment_assets WHERE object = $1) +
+			(SELECT COUNT(*) FROM upload_sessions WHERE object = $1)
+	`
+	var actualRefs int
+	if err := tx.QueryRow(query, name).Scan(&actualRefs); err != nil {
+		return false, err
+	}
+
+	if actualRefs > 0 {
+		// Repair a count that drifted from the rows referencing the object
+		if hasRow && refs != actualRefs {
+			if _, err := tx.Exec("UPDATE objects SET refs = $1 WHERE name = $2", actualRefs, name); err != nil {
+				return false, err
+			}
+		}
+		return false, tx.Commit()
+	}
+
+	// Prompt images are referenced by scenes, which aren't counted
+	inScene, err := referencedByScene(tx, name)
+	if err != nil {
+		return false, err
+	}
+
+	if inScene {
+		return false, tx.Commit()
+	}
+
+	if err := c.server.deleteObject(name); err != nil {
+		return false, err
+	}
+
+	if hasRow {
+		if _, err := tx.Exec("DELETE FROM objects WHERE name = $1", name); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// referencedByScene reports whether a project's scene has an object as a
+// prompt image. The scenes mentioning it stay locked until the transaction
+// ends, so they can't be edited while the object is deleted.
+func referencedByScene(tx *sql.Tx, name string) (bool, error) {
+	rows, err := tx.Query("SELECT scene FROM projects WHERE strpos(scene::text, $1) > 0 FOR SHARE", name)
+	if err != nil {
+		return false, fmt.Errorf("failed to get scenes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scene string
+		if err := rows.Scan(&scene); err != nil {
+			return false, err
+		}
+
+		if slices.Contains(promptImagesOf(scene), name) {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+// promptImagesOf returns the prompt image objects stored in a scene.
+func promptImagesOf(scene string) []string {
+	var sceneData []map[string]interface{}
+	if err := json.Unmarshal([]byte(scene), &sceneData); err != nil || len(sceneData) == 0 {
+		return nil
+	}
+
+	promptImages, _ := sceneData[0]["promptImages"].([]interface{})
+
+	images := []string{}
+	for _, image := range promptImages {
+		if id, ok := image.(string); ok {
+			images = append(images, id)
+		}
+	}
+
+	return images
+}
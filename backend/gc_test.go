@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectReferencedObjects expects the queries of referencedObjects.
+func expectReferencedObjects(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT object FROM project_assets").
+		WillReturnRows(sqlmock.NewRows([]string{"object"}).AddRow("sha256/asset").AddRow("sha256/upload"))
+	mock.ExpectQuery("SELECT scene FROM projects").
+		WillReturnRows(sqlmock.NewRows([]string{"scene"}).
+			AddRow(`[{"type": "root", "promptImages": ["sha256/prompt"]}]`).
+			AddRow(`not a scene`))
+	mock.ExpectQuery("SELECT object, variant_object FROM image_variants").
+		WillReturnRows(sqlmock.NewRows([]string{"object", "variant_object"}).
+			AddRow("sha256/prompt", "variants/prompt").
+			AddRow("sha256/orphan", "variants/orphan"))
+}
+
+func TestSweepFindsOrphans(t *testing.T) {
+	server, mock, store := newTestServer(t)
+
+	for _, name := range []string{"sha256/asset", "sha256/upload", "sha256/prompt", "variants/prompt", "sha256/orphan", "variants/orphan"} {
+		if err := UploadBuffer(store, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectReferencedObjects(mock)
+	report, err := NewObjectCollector(server, time.Hour, 0, true).Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Variants are only referenced through the image they belong to
+	sort.Strings(report.Orphaned)
+	if report.Scanned != 6 || strings.Join(report.Orphaned, ",") != "sha256/orphan,variants/orphan" {
+		t.Errorf("got report %+v", report)
+	}
+
+	if report.Bytes != int64(len("sha256/orphan")+len("variants/orphan")) {
+		t.Errorf("orphans have %d bytes", report.Bytes)
+	}
+
+	if report.Deleted != 0 {
+		t.Errorf("dry run deleted %d objects", report.Deleted)
+	}
+}
+
+func TestSweepKeepsRecentObjects(t *testing.T) {
+	server, mock, store := newTestServer(t)
+
+	if err := UploadBuffer(store, "sha256/orphan", []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReferencedObjects(mock)
+	report, err := NewObjectCollector(server, time.Hour, time.Hour, false).Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Orphaned) != 0 {
+		t.Errorf("orphaned objects in their grace period: %v", report.Orphaned)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	cutoff := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name        string
+		expect      func(mock sqlmock.Sqlmock)
+		wantDeleted bool
+	}{
+		{
+			name: "unreferenced",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT refs, updated_at FROM objects").
+					WillReturnRows(sqlmock.NewRows([]string{"refs", "updated_at"}).AddRow(0, cutoff.Add(-time.Hour)))
+				mock.ExpectQuery("FROM image_variants WHERE variant_object").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("FROM upload_sessions WHERE object").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectQuery("SELECT scene FROM projects").WithArgs("sha256/object").
+					WillReturnRows(sqlmock.NewRows([]string{"scene"}).AddRow(`[{"promptImages": ["sha256/object-other"]}]`))
+				mock.ExpectExec("DELETE FROM prompt_images").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("DELETE FROM image_variants").
+					WillReturnRows(sqlmock.NewRows([]string{"variant_object"}))
+				mock.ExpectExec("DELETE FROM objects").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			wantDeleted: true,
+		},
+		{
+			name: "prompt image added to a scene during the sweep",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT refs, updated_at FROM objects").WillReturnRows(sqlmock.NewRows([]string{"refs", "updated_at"}))
+				mock.ExpectQuery("FROM image_variants WHERE variant_object").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("FROM upload_sessions WHERE object").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectQuery("SELECT scene FROM projects").WithArgs("sha256/object").
+					WillReturnRows(sqlmock.NewRows([]string{"scene"}).AddRow(`[{"type": "root", "promptImages": ["sha256/object"]}]`))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "acquired during the sweep",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT refs, updated_at FROM objects").
+					WillReturnRows(sqlmock.NewRows([]string{"refs", "updated_at"}).AddRow(1, time.Now()))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name: "variant",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT refs, updated_at FROM objects").WillReturnRows(sqlmock.NewRows([]string{"refs", "updated_at"}))
+				mock.ExpectQuery("FROM image_variants WHERE variant_object").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+		},
+		{
+			name: "drifted count",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT refs, updated_at FROM objects").
+					WillReturnRows(sqlmock.NewRows([]string{"refs", "updated_at"}).AddRow(0, cutoff.Add(-time.Hour)))
+				mock.ExpectQuery("FROM image_variants WHERE variant_object").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("FROM upload_sessions WHERE object").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+				mock.ExpectExec("UPDATE objects SET refs").WithArgs(2, "sha256/object").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, store := newTestServer(t)
+			if err := UploadBuffer(store, "sha256/object", []byte("contents")); err != nil {
+				t.Fatal(err)
+			}
+
+			mock.ExpectBegin()
+			test.expect(mock)
+
+			deleted, err := NewObjectCollector(server, time.Hour, time.Hour, false).collect("sha256/object", cutoff)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if deleted != test.wantDeleted {
+				t.Errorf("deleted is %v", deleted)
+			}
+
+			if _, ok := store.Get("sha256/object"); ok == test.wantDeleted {
+				t.Errorf("object exists is %v", ok)
+			}
+		})
+	}
+}
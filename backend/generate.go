@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxPromptLength = 2000
+	// maxGenerationAttempts is how many times the model may retry after its
+	// code fails to compile.
+	maxGenerationAttempts = 3
+	// Only the latest messages of a project's conversation are sent with a
+	// prompt, since each reply contains a whole program.
+	maxConversationMessages = 6
+)
+
+var errGenerationFailed = errors.New("generated code failed to compile")
+
+// conversationHistory returns the latest messages of a project's conversation
+// with the model, oldest first.
+func (s *Server) conversationHistory(projectID int64) ([]ChatMessage, error) {
+	query := `
+		SELECT role, content FROM (
+			SELECT id, role, content FROM project_conversation_messages
+			WHERE project = $1
+			ORDER BY id DESC
+			LIMIT $2
+		) latest
+		ORDER BY id
+	`
+
+	rows, err := s.db.Query(query, projectID, maxConversationMessages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []ChatMessage{}
+	for rows.Next() {
+		var message ChatMessage
+		if err := rows.Scan(&message.Role, &message.Content); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	// A window starting with a reply would be missing its prompt
+	if len(messages) > 0 && messages[0].Role == ChatRoleAssistant {
+		messages = messages[1:]
+	}
+
+	return messages, rows.Err()
+}
+
+// appendConversation records a prompt and the code the model answered it with.
+func (s *Server) appendConversation(projectID int64, prompt, code string) error {
+	query := `
+		INSERT INTO project_conversation_messages (project, role, content)
+		VALUES ($1, $2, $3), ($1, $4, $5)
+	`
+	reply := "```cpp\n" + strings.TrimSpace(code) + "\n```"
+	if _, err := s.db.Exec(query, projectID, ChatRoleUser, prompt, ChatRoleAssistant, reply); err != nil {
+		return fmt.Errorf("failed to save conversation: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) clearConversation(projectID int64) error {
+	_, err := s.db.Exec("DELETE FROM project_conversation_messages WHERE project = $1", projectID)
+	return err
+}
+
+// handleGenerate generates a program for a project from a prompt and makes it
+// the project's main.wasm. If the project already has source, the model revises
+// it, continuing the project's conversation, unless "new" is set to start over.
+// Starting over clears the conversation once the new program compiles.
+func (s *Server) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !project.Role.CanEdit() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Prompt string `json:"prompt"`
+		New    bool   `json:"new"`
+	}
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8*maxPromptLength)).Decode(&request); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(request.Prompt) == "" {
+		http.Error(w, "No prompt provided", http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Prompt) > maxPromptLength {
+		http.Error(w, "Prompt too long", http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.generate(r.Context(), project.ID, user.ID, request.Prompt, request.New)
+	switch {
+	case err == nil:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"version":   version.Version,
+			"wasm_hash": version.WasmHash,
+		})
+
+	case errors.Is(err, errGenerationFailed):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error":       err.Error(),
+			"diagnostics": parseDiagnostics(version.CompileOutput),
+		})
+
+	case errors.Is(err, ErrQuotaExceeded):
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+
+	default:
+		log.Printf("failed to generate code: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// generate runs a prompt through the model until its code compiles, storing
+// every attempt as a version of the project's source. On errGenerationFailed,
+// the last attempt is returned.
+func (s *Server) generate(ctx context.Context, projectID int64, userID, prompt string, startOver bool) (*SourceVersion, error) {
+	var scene string
+	if err := s.db.QueryRow("SELECT scene FROM projects WHERE id = $1", projectID).Scan(&scene); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("project %d not found", projectID)
+		}
+		return nil, fmt.Errorf("failed to get project: %w", err)
+	}
+
+	images, err := s.promptImageInputs(scene)
+	if err != nil {
+		return nil, err
+	}
+
+	var existingCode string
+	history := []ChatMessage{}
+	if !startOver {
+		current, err := s.currentSource(projectID)
+		if err != nil {
+			return nil, err
+		}
+
+		if current != nil {
+			existingCode = current.Source
+			history, err = s.conversationHistory(projectID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	conversation := NewCodeConversation(prompt, existingCode, images, history)
+
+	var version *SourceVersion
+	for range maxGenerationAttempts {
+		code, err := conversation.Generate(ctx, s.llm)
+		if err != nil {
+			log.Printf("AI generation failed: %v", err)
+			continue
+		}
+
+		// Mistakes the analyzer catches are reported without using a compile slot
+		var result *JobResult
+		if problems := checkSource(code); len(problems) > 0 {
+			result = &JobResult{Status: StatusCompileError, Result: formatSourceProblems(problems)}
+		} else {
+			result = s.compileQueue.Enqueue(code)
+		}
+
+		version = &SourceVersion{Source: code, Origin: SourceGenerated, Prompt: prompt, Model: s.llm.Model}
+		if err := s.saveCompiledSource(ctx, projectID, userID, version, result); err != nil {
+			return nil, err
+		}
+
+		switch result.Status {
+		case StatusSuccess:
+			// Starting over only forgets the conversation once there's a new
+			// program to continue from
+			if startOver {
+				if err := s.clearConversation(projectID); err != nil {
+					return nil, fmt.Errorf("failed to clear conversation: %w", err)
+				}
+			}
+			return version, s.appendConversation(projectID, prompt, code)
+
+		case StatusCompileError:
+			conversation.ReportError(version.CompileOutput)
+
+		default:
+			return nil, fmt.Errorf("failed to compile: %s", version.CompileOutput)
+		}
+	}
+
+	if version == nil {
+		return nil, errors.New("model did not produce any code")
+	}
+
+	return version, errGenerationFailed
+}
+
+// handleConversation clears a project's conversation on DELETE, so the next
+// prompt is answered without the earlier ones.
+func (s *Server) handleConversation(w http.ResponseWriter, r *http.Request) {
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !project.Role.CanEdit() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := s.clearConversation(project.ID); err != nil {
+		log.Printf("failed to clear conversation: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var testWasm = []byte("\x00asm\x01\x00\x00\x00")
+
+// fakeCompiler fails with its errors while there are any left, then compiles
+// every program to testWasm.
+type fakeCompiler struct {
+	t        *testing.T
+	errors   []string
+	programs []string
+}
+
+func (c *fakeCompiler) Enqueue(code string) *JobResult {
+	c.programs = append(c.programs, code)
+	if len(c.errors) > 0 {
+		output := c.errors[0]
+		c.errors = c.errors[1:]
+		return &JobResult{Status: StatusCompileError, Result: output}
+	}
+
+	path := filepath.Join(c.t.TempDir(), "main.wasm")
+	if err := os.WriteFile(path, testWasm, 0644); err != nil {
+		c.t.Fatal(err)
+	}
+	return &JobResult{Status: StatusSuccess, Result: JobSuccess{ID: "test", WasmPath: path}}
+}
+
+// expectRecordSource expects a version of project 1's source to be recorded.
+func expectRecordSource(mock sqlmock.Sqlmock, version int, code, status, wasmHash string) {
+	hash := any(nil)
+	if wasmHash != "" {
+		hash = wasmHash
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("FOR UPDATE").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO project_sources").
+		WithArgs(int64(1), code, SourceGenerated, "draw a circle", "test-model", status, sqlmock.AnyArg(), hash, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "created_at"}).AddRow(version, time.Now()))
+	mock.ExpectCommit()
+}
+
+func generateRequest(server *Server, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "/projects/1/generate", strings.NewReader(body))
+	request = withTestProject(request, "user-1", 1, RoleOwner)
+
+	recorder := httptest.NewRecorder()
+	server.handleGenerate(recorder, request)
+	return recorder
+}
+
+func TestGenerateStartsOver(t *testing.T) {
+	server, mock, _ := newTestServer(t)
+	provider := NewScriptedProvider([]string{testReply, testReply})
+	server.llm = &LLM{Provider: provider, Model: "test-model"}
+	server.compileQueue = &fakeCompiler{t: t, errors: []string{"main.cpp:1:1: error: expected ';'\n"}}
+
+	hash := sha256.Sum256(testWasm)
+	wasmHash := hex.EncodeToString(hash[:])
+
+	mock.ExpectQuery("SELECT scene FROM projects").WillReturnRows(sqlmock.NewRows([]string{"scene"}).AddRow("[]"))
+	expectRecordSource(mock, 2, testProgram, SourceCompileError, "")
+
+	// main.wasm is already this program's, so it isn't stored again
+	mock.ExpectQuery("FROM project_assets").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "hash", "object", "content_type", "size", "uploaded_by"}).
+			AddRow("main.wasm", wasmHash, assetObjectName(wasmHash), wasmType.contentType, len(testWasm), "user-1"))
+	expectRecordSource(mock, 3, testProgram, SourceSuccess, wasmHash)
+
+	// The conversation is only cleared once there's a program to replace it
+	mock.ExpectExec("DELETE FROM project_conversation_messages").WithArgs(int64(1)).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec("INSERT INTO project_conversation_messages").
+		WithArgs(int64(1), ChatRoleUser, "draw a circle", ChatRoleAssistant, "```cpp\n"+testProgram+"\n```").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	response := generateRequest(server, `{"prompt": "draw a circle", "new": true}`)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), wasmHash) {
+		t.Fatalf("got %d %s", response.Code, response.Body.String())
+	}
+
+	// The compile error is reported to the model, which starts without history
+	messages := provider.Requests()[1].Messages
+	if len(messages) != 4 || messages[1].Content != "draw a circle" || !strings.Contains(messages[3].Content, "expected ';'") {
+		t.Errorf("retry was sent %+v", messages)
+	}
+}
+
+func TestGenerateFailureKeepsConversation(t *testing.T) {
+	server, mock, _ := newTestServer(t)
+	server.llm = &LLM{Provider: NewScriptedProvider([]string{testReply, testReply, testReply}), Model: "test-model"}
+
+	compiler := &fakeCompiler{t: t}
+	for range maxGenerationAttempts {
+		compiler.errors = append(compiler.errors, "main.cpp:1:1: error: expected ';'\n")
+	}
+	server.compileQueue = compiler
+
+	mock.ExpectQuery("SELECT scene FROM projects").WillReturnRows(sqlmock.NewRows([]string{"scene"}).AddRow("[]"))
+	for i := range maxGenerationAttempts {
+		expectRecordSource(mock, i+1, testProgram, SourceCompileError, "")
+	}
+
+	response := generateRequest(server, `{"prompt": "draw a circle", "new": true}`)
+	if response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), "expected ';'") {
+		t.Errorf("got %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestGenerateRevisesCurrentSource(t *testing.T) {
+	server, mock, _ := newTestServer(t)
+	provider := NewScriptedProvider([]string{testReply})
+	server.llm = &LLM{Provider: provider, Model: "test-model"}
+	server.compileQueue = &fakeCompiler{t: t}
+
+	hash := sha256.Sum256(testWasm)
+	wasmHash := hex.EncodeToString(hash[:])
+	current := "// the current program\n" + testProgram
+
+	mock.ExpectQuery("SELECT scene FROM projects").WillReturnRows(sqlmock.NewRows([]string{"scene"}).AddRow("[]"))
+	mock.ExpectQuery("SELECT version FROM project_sources").WithArgs(int64(1), SourceSuccess).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(4))
+	mock.ExpectQuery("FROM project_sources WHERE project = \\$1 AND version = \\$2").WithArgs(int64(1), 4).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "origin", "prompt", "model", "status", "wasm_hash", "created_by", "created_at", "source", "compile_output"}).
+			AddRow(4, SourceGenerated, "draw a square", "test-model", SourceSuccess, wasmHash, "user-1", time.Now(), current, ""))
+
+	// A window starting with a reply is missing its prompt, so it's dropped
+	mock.ExpectQuery("FROM project_conversation_messages").WithArgs(int64(1), maxConversationMessages).
+		WillReturnRows(sqlmock.NewRows([]string{"role", "content"}).
+			AddRow(ChatRoleAssistant, "an old reply").
+			AddRow(ChatRoleUser, "draw a square").
+			AddRow(ChatRoleAssistant, "```cpp\n"+current+"\n```"))
+
+	mock.ExpectQuery("FROM project_assets").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "hash", "object", "content_type", "size", "uploaded_by"}).
+			AddRow("main.wasm", wasmHash, assetObjectName(wasmHash), wasmType.contentType, len(testWasm), "user-1"))
+	expectRecordSource(mock, 5, testProgram, SourceSuccess, wasmHash)
+	mock.ExpectExec("INSERT INTO project_conversation_messages").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	response := generateRequest(server, `{"prompt": "draw a circle"}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("got %d %s", response.Code, response.Body.String())
+	}
+
+	messages := provider.Requests()[0].Messages
+	if len(messages) != 4 || messages[1].Content != "draw a square" || messages[2].Role != ChatRoleAssistant {
+		t.Fatalf("got messages %+v", messages)
+	}
+
+	if !strings.Contains(messages[3].Content, current) || !strings.HasSuffix(messages[3].Content, "Request: draw a circle") {
+		t.Errorf("got prompt %q", messages[3].Content)
+	}
+}
+
+func TestGenerateRejectsLargeBodies(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	body := `{"prompt": "draw a circle", "padding": "` + strings.Repeat("x", 16*maxPromptLength) + `"}`
+	if response := generateRequest(server, body); response.Code != http.StatusBadRequest {
+		t.Errorf("got %d", response.Code)
+	}
+}
+
+func TestGenerateChecksBeforeCompiling(t *testing.T) {
+	server, mock, _ := newTestServer(t)
+	program := strings.Replace(testProgram, "on_pose", "on_move", 1)
+	provider := NewScriptedProvider([]string{"```cpp\n" + program + "\n```", testReply})
+	server.llm = &LLM{Provider: provider, Model: "test-model"}
+	compiler := &fakeCompiler{t: t}
+	server.compileQueue = compiler
+
+	hash := sha256.Sum256(testWasm)
+	wasmHash := hex.EncodeToString(hash[:])
+
+	mock.ExpectQuery("SELECT scene FROM projects").WillReturnRows(sqlmock.NewRows([]string{"scene"}).AddRow("[]"))
+	mock.ExpectBegin()
+	mock.ExpectExec("FOR UPDATE").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO project_sources").
+		WithArgs(int64(1), program, SourceGenerated, "draw a circle", "test-model", SourceCompileError, formatSourceProblems(checkSource(program)), nil, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	mock.ExpectQuery("FROM project_assets").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "hash", "object", "content_type", "size", "uploaded_by"}).
+			AddRow("main.wasm", wasmHash, assetObjectName(wasmHash), wasmType.contentType, len(testWasm), "user-1"))
+	expectRecordSource(mock, 2, testProgram, SourceSuccess, wasmHash)
+	mock.ExpectExec("DELETE FROM project_conversation_messages").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO project_conversation_messages").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if response := generateRequest(server, `{"prompt": "draw a circle", "new": true}`); response.Code != http.StatusOK {
+		t.Fatalf("got %d %s", response.Code, response.Body.String())
+	}
+
+	// Only the program that passed the analyzer was compiled
+	if len(compiler.programs) != 1 || compiler.programs[0] != testProgram {
+		t.Errorf("compiled %q", compiler.programs)
+	}
+
+	retry := provider.Requests()[1].Messages
+	if !strings.Contains(retry[len(retry)-1].Content, "on_pose") {
+		t.Errorf("model was told %q", retry[len(retry)-1].Content)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+)
+
+const (
+	// Images with a larger width or height are rejected rather than decoded.
+	maxImageDimension = 8192
+	// Prompt images are downscaled to fit, since they are only used as
+	// references for generation.
+	promptImageDimension = 2048
+	thumbnailDimension   = 256
+	// Machines receive textures no larger than this.
+	textureDimension = 2048
+	// Image assets are downscaled to fit when they are uploaded.
+	assetImageDimension = 4096
+	// Larger images are rejected before they are decoded.
+	maxImageBytes = 64 * 1024 * 1024
+	// Only this many prompt images are sent to the model, since providers
+	// limit the images per request. Groq accepts 5.
+	maxVisionImages = 5
+)
+
+// Image variants are resized copies of an image that are stored alongside it.
+const (
+	thumbnailVariant = "thumbnail"
+	textureVariant   = "texture"
+)
+
+var (
+	ErrImageFormat  = errors.New("unsupported image format")
+	ErrImageSize    = errors.New("image too large")
+	ErrImageInvalid = errors.New("invalid image")
+)
+
+// encodedImage is an image that was re-encoded without its metadata.
+type encodedImage struct {
+	data   []byte
+	width  int
+	height int
+}
+
+// decodeImage decodes a PNG or JPEG after checking its dimensions.
+func decodeImage(data []byte) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return nil, "", ErrImageFormat
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrImageInvalid, err)
+	}
+
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxImageDimension || config.Height > maxImageDimension {
+		return nil, "", ErrImageSize
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrImageInvalid, err)
+	}
+
+	return img, format, nil
+}
+
+// encodeImage downscales img to fit within maxDimension and encodes it in the
+// given format. Only pixels are encoded, so metadata such as EXIF is dropped.
+func encodeImage(img image.Image, format string, maxDimension int) (*encodedImage, error) {
+	bounds := img.Bounds()
+	width, height := fitDimensions(bounds.Dx(), bounds.Dy(), maxDimension)
+	resized := resizeImage(img, width, height)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+
+	default:
+		if err := png.Encode(&buf, resized); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+	}
+
+	return &encodedImage{
+		data:   buf.Bytes(),
+		width:  width,
+		height: height,
+	}, nil
+}
+
+func fitDimensions(width, height, maxDimension int) (int, int) {
+	if width <= maxDimension && height <= maxDimension {
+		return width, height
+	}
+
+	if width >= height {
+		return maxDimension, max(1, height*maxDimension/width)
+	}
+
+	return max(1, width*maxDimension/height), maxDimension
+}
+
+// resizeImage downscales with a box filter, averaging every source pixel that
+// falls within each destination pixel. The result is always RGBA, which is
+// uploaded to the GPU as is.
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max(y0+1, (y+1)*srcHeight/height)
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max(x0+1, (x+1)*srcWidth/width)
+
+			// Channels are premultiplied, so transparent pixels don't bleed
+			// their color into the average
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pixel := row[sx*4 : sx*4+4]
+					r += uint64(pixel[0])
+					g += uint64(pixel[1])
+					b += uint64(pixel[2])
+					a += uint64(pixel[3])
+					count++
+				}
+			}
+
+			offset := y*dst.Stride + x*4
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+
+	return dst
+}
+
+// variantObjectName returns the object a variant of an image is stored as.
+func variantObjectName(object, variant string) string {
+	return object + "-" + variant
+}
+
+// storeImageVariant uploads a variant of an image and records it so that it's
+// served in place of the original and deleted along with it.
+func (s *Server) storeImageVariant(object, variant string, img *encodedImage) error {
+	variantObject := variantObjectName(object, variant)
+	if err := UploadBuffer(s.store, variantObject, img.data); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(img.data)
+	query := `
+		INSERT INTO image_variants (object, variant, variant_object, width, height, size, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (object, variant) DO UPDATE SET
+			variant_object = $3, width = $4, height = $5, size = $6, hash = $7
+	`
+	_, err := s.db.Exec(query, object, variant, variantObject, img.width, img.height, len(img.data), hex.EncodeToString(hash[:]))
+	if err != nil {
+		return fmt.Errorf("failed to record image variant: %w", err)
+	}
+
+	return nil
+}
+
+// storePromptImage stores an image from the editor without its metadata and
+// downscaled to promptImageDimension, along with a thumbnail for the editor.
+// Returns ErrQuotaExceeded if the user or project has no room for it.
+func (s *Server) storePromptImage(projectID int64, userID, object string, data []byte) error {
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return err
+	}
+
+	original, err := encodeImage(img, format, promptImageDimension)
+	if err != nil {
+		return err
+	}
+
+	thumbnail, err := encodeImage(img, format, thumbnailDimension)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(original.data) + len(thumbnail.data))
+	budget, err := s.storageBudget(projectID, userID, size, size)
+	if err != nil {
+		return err
+	}
+
+	if budget < 0 {
+		return ErrQuotaExceeded
+	}
+
+	if err := UploadBuffer(s.store, object, original.data); err != nil {
+		return err
+	}
+
+	if err := s.storeImageVariant(object, thumbnailVariant, thumbnail); err != nil {
+		return err
+	}
+
+	return s.recordPromptImage(object, projectID, userID, size)
+}
+
+// recordPromptImage counts a stored prompt image towards the storage quotas,
+// returning ErrQuotaExceeded if there is no longer room for it.
+func (s *Server) recordPromptImage(object string, projectID int64, userID string, size int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.lockStorageUsage(tx, projectID, userID); err != nil {
+		return err
+	}
+
+	query := "INSERT INTO prompt_images (object, project, uploaded_by, size) VALUES ($1, $2, $3, $4)"
+	if _, err := tx.Exec(query, object, projectID, userID, size); err != nil {
+		return fmt.Errorf("failed to record prompt image: %w", err)
+	}
+
+	if err := s.checkStorageQuotas(tx, projectID, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// promptImageInputs returns the URLs to send the model for the prompt images
+// of a scene, in the form the LLM's vision setting asks for. Returns nothing if
+// the model can't see images.
+func (s *Server) promptImageInputs(scene string) ([]string, error) {
+	if s.llm.Vision == "" {
+		return nil, nil
+	}
+
+	images := promptImagesOf(scene)
+	if len(images) > maxVisionImages {
+		images = images[:maxVisionImages]
+	}
+
+	inputs := []string{}
+	for _, image := range images {
+		if s.llm.Vision == VisionURL {
+			url, err := s.store.PresignURL(image, s.assetURLLifetime.Base)
+			if err != nil {
+				return nil, fmt.Errorf("failed to presign prompt image: %w", err)
+			}
+			inputs = append(inputs, url)
+			continue
+		}
+
+		data, err := s.readObject(image, maxPromptImageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		dataURL := "data:" + http.DetectContentType(data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+		inputs = append(inputs, dataURL)
+	}
+
+	return inputs, nil
+}
+
+// processImageAsset replaces an uploaded image asset of size bytes with a copy
+// without its metadata, downscaled to assetImageDimension, and creates the
+// thumbnail shown in the editor and the texture that machines download
+// instead. Returns the size of the stored copy. Formats that can't be decoded,
+// such as WebP, are stored and sent to machines as they are.
+func (s *Server) processImageAsset(object, contentType string, size int64) (int64, error) {
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return size, nil
+	}
+
+	reader, err := s.store.Open(object)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxImageBytes+1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read image: %w", err)
+	}
+
+	if len(data) > maxImageBytes {
+		return 0, ErrImageSize
+	}
+
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return 0, err
+	}
+
+	original, err := encodeImage(img, format, assetImageDimension)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, variant := range []struct {
+		name      string
+		dimension int
+	}{
+		{thumbnailVariant, thumbnailDimension},
+		{textureVariant, textureDimension},
+	} {
+		encoded, err := encodeImage(img, format, variant.dimension)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := s.storeImageVariant(object, variant.name, encoded); err != nil {
+			return 0, err
+		}
+	}
+
+	// The object keeps the name derived from the uploaded file so that
+	// clients still find it by the hash they computed
+	if err := UploadBuffer(s.store, object, original.data); err != nil {
+		return 0, err
+	}
+
+	return int64(len(original.data)), nil
+}
+
+// isImageError reports whether an image was rejected because of its contents.
+func isImageError(err error) bool {
+	return errors.Is(err, ErrImageFormat) || errors.Is(err, ErrImageSize) || errors.Is(err, ErrImageInvalid)
+}
+
+// imageVariantObject returns the object to serve for a variant of an image,
+// which is the image itself if the variant wasn't created.
+func (s *Server) imageVariantObject(object, variant string) (string, error) {
+	var variantObject string
+	query := "SELECT variant_object FROM image_variants WHERE object = $1 AND variant = $2"
+	err := s.db.QueryRow(query, object, variant).Scan(&variantObject)
+	if err == sql.ErrNoRows {
+		return object, nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get image variant: %w", err)
+	}
+
+	return variantObject, nil
+}
+
+// deleteObject deletes an object from the store along with its variants.
+func (s *Server) deleteObject(name string) error {
+	if _, err := s.db.Exec("DELETE FROM prompt_images WHERE object = $1", name); err != nil {
+		return fmt.Errorf("failed to delete prompt image: %w", err)
+	}
+
+	rows, err := s.db.Query("DELETE FROM image_variants WHERE object = $1 RETURNING variant_object", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete image variants: %w", err)
+	}
+	defer rows.Close()
+
+	variants := []string{}
+	for rows.Next() {
+		var variant string
+		if err := rows.Scan(&variant); err != nil {
+			return err
+		}
+		variants = append(variants, variant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, variant := range variants {
+		if err := s.store.Delete(variant); err != nil {
+			log.Printf("failed to delete image variant %s: %v", variant, err)
+		}
+	}
+
+	return s.store.Delete(name)
+}
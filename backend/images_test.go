@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPromptImageInputs(t *testing.T) {
+	server, _, store := newTestServer(t)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	images := []string{}
+	for i := range maxVisionImages + 1 {
+		name := fmt.Sprintf("sha256/image%d", i)
+		if err := UploadBuffer(store, name, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, name)
+	}
+
+	scene, err := json.Marshal([]map[string]any{{"promptImages": images}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.llm = &LLM{}
+	if inputs, err := server.promptImageInputs(string(scene)); err != nil || len(inputs) != 0 {
+		t.Errorf("without vision, got inputs %v and error %v", inputs, err)
+	}
+
+	// Only the first maxVisionImages are sent
+	server.llm.Vision = VisionURL
+	inputs, err := server.promptImageInputs(string(scene))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{}
+	for _, image := range images[:maxVisionImages] {
+		want = append(want, "memory:///"+image)
+	}
+	if !slices.Equal(inputs, want) {
+		t.Errorf("got URLs %v", inputs)
+	}
+
+	server.llm.Vision = VisionInline
+	inputs, err = server.promptImageInputs(string(scene))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inputs) != maxVisionImages {
+		t.Fatalf("got %d inputs", len(inputs))
+	}
+
+	data, found := strings.CutPrefix(inputs[0], "data:image/png;base64,")
+	if decoded, err := base64.StdEncoding.DecodeString(data); !found || err != nil || !bytes.Equal(decoded, buf.Bytes()) {
+		t.Errorf("got data URL %q", inputs[0])
+	}
+}
+
+func TestCodeConversationImages(t *testing.T) {
+	provider := NewScriptedProvider([]string{testReply})
+	llm := &LLM{Provider: provider, Vision: VisionURL}
+	images := []string{"memory:///sha256/sketch"}
+
+	conversation := NewCodeConversation("follow the sketch", "", images, nil)
+	if _, err := conversation.Generate(context.Background(), llm); err != nil {
+		t.Fatal(err)
+	}
+
+	prompt := provider.Requests()[0].Messages[1]
+	if !slices.Equal(prompt.Images, images) || !strings.Contains(prompt.Content, "attached images") {
+		t.Errorf("got prompt %+v", prompt)
+	}
+}
+
+// withTextChunk inserts a tEXt chunk after the header of a PNG, like the
+// metadata that editors and cameras add.
+func withTextChunk(data []byte, text string) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(chunk, "tEXt"+text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// The signature and IHDR chunk take 33 bytes
+	return slices.Concat(data[:33], chunk, data[33:])
+}
+
+func TestProcessImageAsset(t *testing.T) {
+	server, mock, store := newTestServer(t)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, assetImageDimension+100, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	data := withTextChunk(buf.Bytes(), "Comment\x00taken at home")
+	object := "sha256/image"
+	if err := UploadBuffer(store, object, data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, variant := range []string{thumbnailVariant, textureVariant} {
+		mock.ExpectExec("INSERT INTO image_variants").
+			WithArgs(object, variant, variantObjectName(object, variant), sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	size, err := server.processImageAsset(object, "image/png", int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := readStoredObject(t, store, object)
+	if size != int64(len(stored)) || bytes.Contains(stored, []byte("taken at home")) {
+		t.Errorf("got size %d, stored %d bytes %q", size, len(stored), stored)
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(stored))
+	if err != nil || config.Width != assetImageDimension {
+		t.Errorf("stored an image of width %d, error %v", config.Width, err)
+	}
+
+	thumbnail, err := png.DecodeConfig(bytes.NewReader(readStoredObject(t, store, variantObjectName(object, thumbnailVariant))))
+	if err != nil || thumbnail.Width != thumbnailDimension {
+		t.Errorf("stored a thumbnail of width %d, error %v", thumbnail.Width, err)
+	}
+}
+
+func TestProcessImageAssetKeepsOtherFiles(t *testing.T) {
+	server, _, store := newTestServer(t)
+
+	data := []byte("glTF model")
+	if err := UploadBuffer(store, "sha256/model", data); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := server.processImageAsset("sha256/model", "model/gltf-binary", int64(len(data)))
+	if err != nil || size != int64(len(data)) {
+		t.Errorf("got size %d and error %v", size, err)
+	}
+
+	if stored := readStoredObject(t, store, "sha256/model"); !bytes.Equal(stored, data) {
+		t.Errorf("stored %q", stored)
+	}
+}
@@ -7,12 +7,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
-const WORK_DIR = "workdir"
 const TEMPLATE_DIR = "template"
 
+// compilerEnvironment are the variables em++ is run with. The rest of the
+// server's environment, which holds its secrets, is left out.
+var compilerEnvironment = []string{"PATH", "HOME", "EMSDK", "EMSDK_NODE", "EMSDK_PYTHON", "EM_CONFIG", "EM_CACHE"}
+
+// sourceLineOffset is the number of lines runJob adds before the source.
+const sourceLineOffset = 1
+
 type Job struct {
 	Code string
 	Done chan *JobResult
@@ -35,20 +42,64 @@ type JobResult struct {
 	Result any
 }
 
+// Compiler compiles programs with the template headers.
+type Compiler interface {
+	// Enqueue compiles code once earlier programs are done and returns the
+	// result. Successful results must be cleaned up.
+	Enqueue(code string) *JobResult
+}
+
 type JobQueue struct {
 	queue   []*Job
 	mutex   sync.Mutex
 	running bool
+
+	// workDir holds a directory for each job, outside of the server's own
+	// directory so that relative paths can't reach its files
+	workDir string
+	env     []string
+	// sandbox is the path to bwrap, or empty to run em++ directly
+	sandbox string
+
+	includeDirsOnce sync.Once
+	includeDirs     []string
+	includeDirsErr  error
 }
 
-func NewJobQueue() *JobQueue {
-	if err := os.MkdirAll(WORK_DIR, 0755); err != nil {
-		panic(fmt.Sprintf("failed to create work directory: %v", err))
+// NewJobQueue creates a queue that compiles programs with em++. Unless
+// COMPILE_SANDBOX is "none", em++ runs in a bubblewrap sandbox where only the
+// job's directory and the toolchain are visible.
+func NewJobQueue(getenv func(string) string) (*JobQueue, error) {
+	jq := &JobQueue{
+		queue:   make([]*Job, 0),
+		workDir: filepath.Join(os.TempDir(), "simulo-jobs"),
 	}
 
-	return &JobQueue{
-		queue: make([]*Job, 0),
+	if err := os.MkdirAll(jq.workDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
 	}
+
+	for _, name := range compilerEnvironment {
+		if value := getenv(name); value != "" {
+			jq.env = append(jq.env, name+"="+value)
+		}
+	}
+
+	switch getenv("COMPILE_SANDBOX") {
+	case "", "bwrap":
+		bwrap, err := exec.LookPath("bwrap")
+		if err != nil {
+			return nil, fmt.Errorf("bwrap is required to sandbox the compiler, set COMPILE_SANDBOX=none to compile without it: %w", err)
+		}
+		jq.sandbox = bwrap
+
+	case "none":
+
+	default:
+		return nil, fmt.Errorf("unknown compile sandbox %q", getenv("COMPILE_SANDBOX"))
+	}
+
+	return jq, nil
 }
 
 func (jq *JobQueue) Enqueue(code string) *JobResult {
@@ -91,49 +142,151 @@ func (jq *JobQueue) process() {
 }
 
 func (jq *JobQueue) runJob(code string) (*JobResult, error) {
+	// The compiler's output is shown to users, so it mustn't be able to read
+	// files other than the headers
+	if problems := checkDirectives(code); len(problems) > 0 {
+		return &JobResult{Status: StatusCompileError, Result: formatSourceProblems(problems)}, nil
+	}
+
+	includeDirs, err := jq.systemIncludeDirs()
+	if err != nil {
+		return nil, err
+	}
+
 	id := "a" + generateRandomHex(16)
 	fmt.Printf("Running job %s\n", id)
 
-	dir := filepath.Join(WORK_DIR, id)
+	dir := filepath.Join(jq.workDir, id)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %v", err)
 	}
 
 	if err := copyDir(TEMPLATE_DIR, dir); err != nil {
+		os.RemoveAll(dir)
 		return nil, fmt.Errorf("failed to copy templates: %v", err)
 	}
 
+	// Diagnostics are offset by sourceLineOffset since the header comes first
 	fullCode := "#include \"simulo__pre.h\"\n" + code + "\n#include \"simulo__post.h\""
 	if err := os.WriteFile(filepath.Join(dir, "main.cpp"), []byte(fullCode), 0644); err != nil {
+		os.RemoveAll(dir)
 		return nil, fmt.Errorf("failed to write main.cpp: %v", err)
 	}
 
-	cmd := exec.Command(
-		"em++",
+	// The default include paths are replaced by the toolchain's own, so that
+	// only the standard library, the template and glm can be included
+	args := []string{
 		"main.cpp",
 		"--no-entry",
 		"-sEXPORTED_FUNCTIONS=[\"_simulo__start\", \"_simulo__update\", \"_simulo__recalculate_transform\", \"_simulo__pose\", \"_simulo__drop\"]",
 		"-sSTANDALONE_WASM=1",
-		"-Iglm",
-		"-o",
-		"main.wasm",
-	)
+		"-nostdinc",
+		"-nostdinc++",
+	}
+	for _, includeDir := range includeDirs {
+		args = append(args, "-isystem", includeDir)
+	}
+	args = append(args, "-Iglm", "-o", "main.wasm")
 
-	cmd.Dir = dir
-	output, err := cmd.CombinedOutput()
+	output, err := jq.compiler(dir, args...).CombinedOutput()
 	if err != nil {
-		return &JobResult{Status: StatusCompileError, Result: string(output)}, nil
+		os.RemoveAll(dir)
+		sanitized := sanitizeCompileOutput(string(output))
+		if sanitized == "" {
+			sanitized = "main.cpp:1:1: error: compilation failed\n"
+		}
+		return &JobResult{Status: StatusCompileError, Result: sanitized}, nil
 	}
 
 	wasmPath := filepath.Join(dir, "main.wasm")
 
 	fmt.Printf("Job %s completed\n", id)
-	return &JobResult{Status: StatusSuccess, Result: JobSuccess{ID: id, WasmPath: wasmPath}}, nil
+	return &JobResult{Status: StatusSuccess, Result: JobSuccess{ID: id, WasmPath: wasmPath, Output: sanitizeCompileOutput(string(output))}}, nil
+}
+
+// compiler returns a command running em++ in dir, in the sandbox if there is
+// one. The sandbox has no network and its own process namespace, so the
+// server's processes can't be inspected through /proc.
+func (jq *JobQueue) compiler(dir string, args ...string) *exec.Cmd {
+	if jq.sandbox == "" {
+		cmd := exec.Command("em++", args...)
+		cmd.Dir = dir
+		cmd.Env = jq.env
+		return cmd
+	}
+
+	sandboxArgs := []string{
+		"--die-with-parent",
+		"--new-session",
+		"--unshare-all",
+		"--clearenv",
+		"--ro-bind", "/usr", "/usr",
+		"--ro-bind-try", "/bin", "/bin",
+		"--ro-bind-try", "/lib", "/lib",
+		"--ro-bind-try", "/lib64", "/lib64",
+		"--ro-bind-try", "/etc/alternatives", "/etc/alternatives",
+		"--proc", "/proc",
+		"--dev", "/dev",
+		"--tmpfs", "/tmp",
+	}
+
+	// The toolchain may live outside of /usr, and emscripten's cache is
+	// written to when it's locked
+	for _, variable := range jq.env {
+		name, value, _ := strings.Cut(variable, "=")
+		switch name {
+		case "EMSDK", "EM_CONFIG":
+			sandboxArgs = append(sandboxArgs, "--ro-bind", value, value)
+		case "EM_CACHE":
+			sandboxArgs = append(sandboxArgs, "--bind", value, value)
+		}
+		sandboxArgs = append(sandboxArgs, "--setenv", name, value)
+	}
+
+	sandboxArgs = append(sandboxArgs, "--bind", dir, dir, "--chdir", dir, "em++")
+	return exec.Command(jq.sandbox, append(sandboxArgs, args...)...)
+}
+
+// systemIncludeDirs returns em++'s default include directories in the order
+// they're searched, so that they can be passed explicitly with -nostdinc.
+func (jq *JobQueue) systemIncludeDirs() ([]string, error) {
+	jq.includeDirsOnce.Do(func() {
+		output, err := jq.compiler(jq.workDir, "-E", "-v", "-x", "c++", "/dev/null").CombinedOutput()
+		if err != nil {
+			jq.includeDirsErr = fmt.Errorf("failed to get include directories: %v: %s", err, output)
+			return
+		}
+
+		jq.includeDirs = parseIncludeDirs(string(output))
+		if len(jq.includeDirs) == 0 {
+			jq.includeDirsErr = fmt.Errorf("em++ didn't list its include directories: %s", output)
+		}
+	})
+
+	return jq.includeDirs, jq.includeDirsErr
+}
+
+// parseIncludeDirs returns the directories listed for #include <...> in the
+// verbose output of clang.
+func parseIncludeDirs(output string) []string {
+	dirs := []string{}
+	listing := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "#include <...> search starts here:"):
+			listing = true
+		case strings.HasPrefix(line, "End of search list."):
+			listing = false
+		case listing && strings.HasPrefix(line, " "):
+			dirs = append(dirs, strings.TrimSuffix(strings.TrimSpace(line), " (framework directory)"))
+		}
+	}
+	return dirs
 }
 
 func (jr *JobSuccess) Cleanup() {
-	dir := filepath.Join(WORK_DIR, jr.ID)
-	os.RemoveAll(dir)
+	os.RemoveAll(filepath.Dir(jr.WasmPath))
 }
 
 func generateRandomHex(length int) string {
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseIncludeDirs(t *testing.T) {
+	output := `clang version 19.0.0
+#include "..." search starts here:
+#include <...> search starts here:
+ /emsdk/upstream/emscripten/cache/sysroot/include/c++/v1
+ /emsdk/upstream/lib/clang/19/include
+ /emsdk/upstream/emscripten/cache/sysroot/include
+End of search list.
+`
+
+	want := []string{
+		"/emsdk/upstream/emscripten/cache/sysroot/include/c++/v1",
+		"/emsdk/upstream/lib/clang/19/include",
+		"/emsdk/upstream/emscripten/cache/sysroot/include",
+	}
+
+	if got := parseIncludeDirs(output); !slices.Equal(got, want) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestCompilerEnvironment(t *testing.T) {
+	env := map[string]string{"PATH": "/usr/bin", "EMSDK": "/emsdk", "POSTGRES_URL": "postgres://secret", "COMPILE_SANDBOX": "none"}
+	jq, err := NewJobQueue(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := jq.compiler(t.TempDir(), "main.cpp")
+	if !slices.Equal(cmd.Env, []string{"PATH=/usr/bin", "EMSDK=/emsdk"}) {
+		t.Errorf("em++ runs with %v", cmd.Env)
+	}
+}
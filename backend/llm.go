@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/conneroisu/groq-go"
+)
+
+type ChatRole string
+
+const (
+	ChatRoleSystem    ChatRole = "system"
+	ChatRoleUser      ChatRole = "user"
+	ChatRoleAssistant ChatRole = "assistant"
+)
+
+type ChatMessage struct {
+	Role    ChatRole
+	Content string
+	// Images are URLs of images following the content, which may be data
+	// URLs. They are only sent to providers with vision enabled.
+	Images []string
+}
+
+type ChatRequest struct {
+	Model       string
+	Temperature float32
+	Messages    []ChatMessage
+}
+
+// ChatProvider completes chat conversations with a language model.
+type ChatProvider interface {
+	// ChatCompletion returns the content of the model's reply.
+	ChatCompletion(ctx context.Context, request ChatRequest) (string, error)
+}
+
+// Ways of sending images to models with vision.
+const (
+	// VisionURL sends presigned URLs, which the provider must be able to reach
+	VisionURL = "url"
+	// VisionInline embeds images in requests as data URLs
+	VisionInline = "inline"
+)
+
+// LLM is the provider and model settings used to generate code.
+type LLM struct {
+	Provider    ChatProvider
+	Model       string
+	Temperature float32
+	// Vision is how images are sent to the model, or empty if it can't see them
+	Vision string
+}
+
+// NewLLM reads LLM_PROVIDER, which is one of:
+//   - groq (default), using GROQ_API_KEY
+//   - openai, for any OpenAI-compatible API at LLM_BASE_URL, using LLM_API_KEY
+//     if set. Local servers usually don't need a key.
+//   - scripted, which replies with the strings in the JSON array in the file
+//     at LLM_SCRIPT, in order
+//
+// LLM_MODEL and LLM_TEMPERATURE default to openai/gpt-oss-120b and 0.2. If the
+// model supports vision, LLM_VISION sets how images are sent to it, either
+// "url" or "inline".
+func NewLLM(getenv func(string) string) (*LLM, error) {
+	llm := &LLM{Model: getenv("LLM_MODEL"), Temperature: 0.2, Vision: getenv("LLM_VISION")}
+	if llm.Model == "" {
+		llm.Model = "openai/gpt-oss-120b"
+	}
+
+	if llm.Vision != "" && llm.Vision != VisionURL && llm.Vision != VisionInline {
+		return nil, fmt.Errorf("invalid LLM_VISION: %q", llm.Vision)
+	}
+
+	if value := getenv("LLM_TEMPERATURE"); value != "" {
+		temperature, err := strconv.ParseFloat(value, 32)
+		if err != nil || temperature < 0 || temperature > 2 {
+			return nil, fmt.Errorf("invalid LLM_TEMPERATURE: %q", value)
+		}
+		llm.Temperature = float32(temperature)
+	}
+
+	switch getenv("LLM_PROVIDER") {
+	case "", "groq":
+		provider, err := NewGroqProvider(getenv("GROQ_API_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		llm.Provider = provider
+
+	case "openai":
+		baseURL := getenv("LLM_BASE_URL")
+		if baseURL == "" {
+			return nil, errors.New("LLM_BASE_URL is required for the openai provider")
+		}
+		llm.Provider = NewOpenAIProvider(baseURL, getenv("LLM_API_KEY"))
+
+	case "scripted":
+		data, err := os.ReadFile(getenv("LLM_SCRIPT"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LLM_SCRIPT: %w", err)
+		}
+
+		var replies []string
+		if err := json.Unmarshal(data, &replies); err != nil {
+			return nil, fmt.Errorf("LLM_SCRIPT is not a JSON array of strings: %w", err)
+		}
+		llm.Provider = NewScriptedProvider(replies)
+
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", getenv("LLM_PROVIDER"))
+	}
+
+	return llm, nil
+}
+
+// Complete sends a conversation to the configured model. Images are left out
+// unless vision is enabled.
+func (l *LLM) Complete(ctx context.Context, messages []ChatMessage) (string, error) {
+	if l.Vision == "" {
+		textOnly := make([]ChatMessage, len(messages))
+		for i, message := range messages {
+			textOnly[i] = ChatMessage{Role: message.Role, Content: message.Content}
+		}
+		messages = textOnly
+	}
+
+	return l.Provider.ChatCompletion(ctx, ChatRequest{
+		Model:       l.Model,
+		Temperature: l.Temperature,
+		Messages:    messages,
+	})
+}
+
+type GroqProvider struct {
+	client *groq.Client
+}
+
+func NewGroqProvider(apiKey string) (*GroqProvider, error) {
+	client, err := groq.NewClient(apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Groq client: %w", err)
+	}
+	return &GroqProvider{client: client}, nil
+}
+
+func (p *GroqProvider) ChatCompletion(ctx context.Context, request ChatRequest) (string, error) {
+	messages := make([]groq.ChatCompletionMessage, len(request.Messages))
+	for i, message := range request.Messages {
+		messages[i] = groq.ChatCompletionMessage{Role: groq.Role(message.Role)}
+		if len(message.Images) == 0 {
+			messages[i].Content = message.Content
+			continue
+		}
+
+		messages[i].MultiContent = []groq.ChatMessagePart{
+			{Type: groq.ChatMessagePartTypeText, Text: message.Content},
+		}
+		for _, image := range message.Images {
+			messages[i].MultiContent = append(messages[i].MultiContent, groq.ChatMessagePart{
+				Type:     groq.ChatMessagePartTypeImageURL,
+				ImageURL: &groq.ChatMessageImageURL{URL: image},
+			})
+		}
+	}
+
+	chatCompletion, err := p.client.ChatCompletion(ctx, groq.ChatCompletionRequest{
+		Model:       groq.ChatModel(request.Model),
+		Messages:    messages,
+		Temperature: request.Temperature,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create chat completion: %w", err)
+	}
+
+	if len(chatCompletion.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from Groq")
+	}
+
+	return chatCompletion.Choices[0].Message.Content, nil
+}
+
+// OpenAIProvider uses the chat completions endpoint of an OpenAI-compatible
+// API, such as OpenAI itself or a local llama.cpp, vLLM or Ollama server.
+type OpenAIProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewOpenAIProvider(baseURL, apiKey string) *OpenAIProvider {
+	return &OpenAIProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+type openAIMessage struct {
+	Role ChatRole `json:"role"`
+	// Content is a string, or an array of parts for messages with images
+	Content any `json:"content"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+func (p *OpenAIProvider) ChatCompletion(ctx context.Context, request ChatRequest) (string, error) {
+	body := struct {
+		Model       string          `json:"model"`
+		Messages    []openAIMessage `json:"messages"`
+		Temperature float32         `json:"temperature"`
+	}{
+		Model:       request.Model,
+		Messages:    make([]openAIMessage, len(request.Messages)),
+		Temperature: request.Temperature,
+	}
+
+	for i, message := range request.Messages {
+		body.Messages[i] = openAIMessage{Role: message.Role, Content: message.Content}
+		if len(message.Images) == 0 {
+			continue
+		}
+
+		parts := []openAIContentPart{{Type: "text", Text: message.Content}}
+		for _, image := range message.Images {
+			parts = append(parts, openAIContentPart{Type: "image_url", ImageURL: &openAIImageURL{URL: image}})
+		}
+		body.Messages[i].Content = parts
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to create chat completion: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("chat completion failed with status %d: %s", resp.StatusCode, message)
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", fmt.Errorf("failed to decode chat completion: %w", err)
+	}
+
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from %s", p.baseURL)
+	}
+
+	return completion.Choices[0].Message.Content, nil
+}
+
+var ErrScriptExhausted = errors.New("scripted provider has no more replies")
+
+// ScriptedProvider replies with canned responses, for exercising generation
+// without a model. It records every request it receives.
+type ScriptedProvider struct {
+	mutex    sync.Mutex
+	replies  []string
+	requests []ChatRequest
+}
+
+func NewScriptedProvider(replies []string) *ScriptedProvider {
+	return &ScriptedProvider{replies: replies}
+}
+
+func (p *ScriptedProvider) ChatCompletion(ctx context.Context, request ChatRequest) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.requests = append(p.requests, request)
+	if len(p.replies) == 0 {
+		return "", ErrScriptExhausted
+	}
+
+	reply := p.replies[0]
+	p.replies = p.replies[1:]
+	return reply, nil
+}
+
+// Requests returns the requests received so far.
+func (p *ScriptedProvider) Requests() []ChatRequest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]ChatRequest(nil), p.requests...)
+}
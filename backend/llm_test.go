@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testProgram is a minimal program that follows the instructions.
+const testProgram = `class Game : public Object {
+public:
+    static std::unique_ptr<Game> create() {
+        return std::make_unique<Game>();
+    }
+
+    void on_pose(int id, std::optional<Pose> pose) {}
+};`
+
+// testReply is a model's reply containing testProgram.
+const testReply = "Here is the program:\n\n```cpp\n" + testProgram + "\n```\n"
+
+func TestNewLLM(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script.json")
+	if err := os.WriteFile(script, []byte(`["first", "second"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm, err := NewLLM(func(name string) string {
+		return map[string]string{"LLM_PROVIDER": "scripted", "LLM_SCRIPT": script, "LLM_TEMPERATURE": "0.7"}[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if llm.Model != "openai/gpt-oss-120b" || llm.Temperature != 0.7 || llm.Vision != "" {
+		t.Errorf("got model %q, temperature %v and vision %q", llm.Model, llm.Temperature, llm.Vision)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		if reply, err := llm.Complete(context.Background(), nil); err != nil || reply != want {
+			t.Errorf("got reply %q and error %v, want %q", reply, err, want)
+		}
+	}
+
+	invalid := []map[string]string{
+		{"LLM_PROVIDER": "unknown"},
+		{"LLM_PROVIDER": "openai"},
+		{"LLM_PROVIDER": "scripted", "LLM_SCRIPT": filepath.Join(t.TempDir(), "missing.json")},
+		{"LLM_PROVIDER": "openai", "LLM_BASE_URL": "http://localhost", "LLM_TEMPERATURE": "3"},
+		{"LLM_PROVIDER": "openai", "LLM_BASE_URL": "http://localhost", "LLM_VISION": "always"},
+	}
+
+	for _, env := range invalid {
+		if _, err := NewLLM(func(name string) string { return env[name] }); err == nil {
+			t.Errorf("%v was accepted", env)
+		}
+	}
+}
+
+func TestLLMComplete(t *testing.T) {
+	messages := []ChatMessage{
+		{Role: ChatRoleSystem, Content: "instructions"},
+		{Role: ChatRoleUser, Content: "prompt", Images: []string{"https://images.test/sketch.png"}},
+	}
+
+	for _, vision := range []string{"", VisionURL} {
+		provider := NewScriptedProvider([]string{"reply"})
+		llm := &LLM{Provider: provider, Model: "test-model", Temperature: 0.5, Vision: vision}
+
+		if _, err := llm.Complete(context.Background(), messages); err != nil {
+			t.Fatal(err)
+		}
+
+		requests := provider.Requests()
+		if len(requests) != 1 || requests[0].Model != "test-model" || requests[0].Temperature != 0.5 {
+			t.Fatalf("got requests %+v", requests)
+		}
+
+		// Models without vision only receive text
+		images := requests[0].Messages[1].Images
+		if (vision == "") != (len(images) == 0) {
+			t.Errorf("vision %q sent images %v", vision, images)
+		}
+	}
+}
+
+func TestScriptedProviderExhausted(t *testing.T) {
+	provider := NewScriptedProvider([]string{"only"})
+	if _, err := provider.ChatCompletion(context.Background(), ChatRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provider.ChatCompletion(context.Background(), ChatRequest{}); !errors.Is(err, ErrScriptExhausted) {
+		t.Errorf("got error %v", err)
+	}
+
+	if len(provider.Requests()) != 2 {
+		t.Errorf("recorded %d requests", len(provider.Requests()))
+	}
+}
+
+func TestOpenAIProvider(t *testing.T) {
+	var body struct {
+		Model       string          `json:"model"`
+		Temperature float32         `json:"temperature"`
+		Messages    []openAIMessage `json:"messages"`
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer key" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(`{"choices": [{"message": {"content": "reply"}}]}`))
+	}))
+	defer server.Close()
+
+	provider := NewOpenAIProvider(server.URL+"/v1/", "key")
+	reply, err := provider.ChatCompletion(context.Background(), ChatRequest{
+		Model:       "local-model",
+		Temperature: 0.2,
+		Messages: []ChatMessage{
+			{Role: ChatRoleSystem, Content: "instructions"},
+			{Role: ChatRoleUser, Content: "prompt", Images: []string{"data:image/png;base64,AAAA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply != "reply" || body.Model != "local-model" || body.Temperature != 0.2 || len(body.Messages) != 2 {
+		t.Fatalf("got reply %q for request %+v", reply, body)
+	}
+
+	if body.Messages[0].Content != "instructions" {
+		t.Errorf("text message has content %v", body.Messages[0].Content)
+	}
+
+	// Messages with images are sent as parts
+	parts, err := json.Marshal(body.Messages[1].Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"text":"prompt","type":"text"},{"image_url":{"url":"data:image/png;base64,AAAA"},"type":"image_url"}]`
+	if string(parts) != want {
+		t.Errorf("got parts %s", parts)
+	}
+
+	failing := NewOpenAIProvider(server.URL, "wrong key")
+	if _, err := failing.ChatCompletion(context.Background(), ChatRequest{}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestCodeConversationGenerate(t *testing.T) {
+	provider := NewScriptedProvider([]string{"I can't write code.", testReply})
+	llm := &LLM{Provider: provider, Model: "test-model"}
+	conversation := NewCodeConversation("draw a circle", "", nil, nil)
+
+	// Replies without a program are answered with a complaint
+	if _, err := conversation.Generate(context.Background(), llm); !errors.Is(err, ErrMalformedResponse) {
+		t.Fatalf("got error %v", err)
+	}
+
+	code, err := conversation.Generate(context.Background(), llm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != testProgram {
+		t.Errorf("got code %q", code)
+	}
+
+	messages := provider.Requests()[1].Messages
+	roles := []ChatRole{}
+	for _, message := range messages {
+		roles = append(roles, message.Role)
+	}
+
+	if len(roles) != 4 || roles[0] != ChatRoleSystem || roles[2] != ChatRoleAssistant || roles[3] != ChatRoleUser {
+		t.Fatalf("second request has roles %v", roles)
+	}
+
+	if messages[0].Content != AI_INSTRUCTIONS || messages[1].Content != "draw a circle" || !strings.Contains(messages[3].Content, "code block") {
+		t.Errorf("second request was %+v", messages[1:])
+	}
+}
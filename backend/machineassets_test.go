@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testMachineAsset = "machine asset contents"
+
+// newTestMachineKey returns a machine key along with its public key as stored
+// in the machines table.
+func newTestMachineKey(t *testing.T) (ed25519.PrivateKey, string) {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privateKey, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// machineAssetRequest requests an asset for machineID, signed with key as the
+// machine signing signedID would sign it.
+func machineAssetRequest(key ed25519.PrivateKey, machineID, signedID int, name string, timestamp time.Time) *http.Request {
+	message := fmt.Sprintf("%d|%s|%d", signedID, name, timestamp.Unix())
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(message)))
+
+	request := httptest.NewRequest("GET", fmt.Sprintf("/machines/%d/assets/%s", machineID, name), nil)
+	request.SetPathValue("id", strconv.Itoa(machineID))
+	request.SetPathValue("name", name)
+	request.Header.Set("Authorization", fmt.Sprintf("Machine %d:%s", timestamp.Unix(), signature))
+	return request
+}
+
+func expectMachineKey(mock sqlmock.Sqlmock, machineID int, publicKey string) {
+	mock.ExpectQuery("SELECT public_key FROM machines").WithArgs(machineID).
+		WillReturnRows(sqlmock.NewRows([]string{"public_key"}).AddRow(publicKey))
+}
+
+func expectMachineAssetList(mock sqlmock.Sqlmock, machineID int) {
+	hash := sha256.Sum256([]byte(testMachineAsset))
+	mock.ExpectQuery("SELECT locations.latest_deployment").WithArgs(machineID).
+		WillReturnRows(sqlmock.NewRows([]string{"latest_deployment"}).AddRow(int64(7)))
+	mock.ExpectQuery("FROM deployment_assets").WithArgs(int64(7), textureVariant).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "object", "hash", "size", "content_type"}).
+			AddRow("main.wasm", "sha256/asset", hex.EncodeToString(hash[:]), len(testMachineAsset), "application/wasm"))
+}
+
+func TestMachineAssetAuthentication(t *testing.T) {
+	key, publicKey := newTestMachineKey(t)
+	otherKey, otherPublicKey := newTestMachineKey(t)
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		request    *http.Request
+		expect     func(mock sqlmock.Sqlmock)
+		wantStatus int
+	}{
+		{
+			name:    "signed",
+			request: machineAssetRequest(key, 3, 3, "main.wasm", now),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMachineKey(mock, 3, publicKey)
+				expectMachineAssetList(mock, 3)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:    "other key",
+			request: machineAssetRequest(otherKey, 3, 3, "main.wasm", now),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMachineKey(mock, 3, publicKey)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "other asset",
+			request: machineAssetRequest(key, 3, 3, "other.wasm", now),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMachineKey(mock, 3, publicKey)
+				expectMachineAssetList(mock, 3)
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			// Machine 3 can't reuse its signature to download machine 4's
+			// assets, even with its own key
+			name:    "other machine",
+			request: machineAssetRequest(key, 4, 3, "main.wasm", now),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMachineKey(mock, 4, otherPublicKey)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "unknown machine",
+			request: machineAssetRequest(key, 5, 5, "main.wasm", now),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT public_key FROM machines").WithArgs(5).
+					WillReturnRows(sqlmock.NewRows([]string{"public_key"}))
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "expired",
+			request:    machineAssetRequest(key, 3, 3, "main.wasm", now.Add(-machineRequestMaxSkew-time.Minute)),
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "from the future",
+			request:    machineAssetRequest(key, 3, 3, "main.wasm", now.Add(machineRequestMaxSkew+time.Minute)),
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "within skew",
+			request: machineAssetRequest(key, 3, 3, "main.wasm", now.Add(machineRequestMaxSkew-time.Minute)),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMachineKey(mock, 3, publicKey)
+				expectMachineAssetList(mock, 3)
+			},
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, store := newTestServer(t)
+			if err := UploadBuffer(store, "sha256/asset", []byte(testMachineAsset)); err != nil {
+				t.Fatal(err)
+			}
+			test.expect(mock)
+
+			recorder := httptest.NewRecorder()
+			server.handleMachineAsset(recorder, test.request)
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("got status %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			if test.wantStatus == http.StatusOK && recorder.Body.String() != testMachineAsset {
+				t.Errorf("got body %q", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestMachineAssetConditionalRequests(t *testing.T) {
+	key, publicKey := newTestMachineKey(t)
+	hash := sha256.Sum256([]byte(testMachineAsset))
+	etag := `"` + hex.EncodeToString(hash[:]) + `"`
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"resumed", "Range", "bytes=8-12", http.StatusPartialContent, testMachineAsset[8:13]},
+		{"unchanged", "If-None-Match", etag, http.StatusNotModified, ""},
+		{"changed", "If-None-Match", `"outdated"`, http.StatusOK, testMachineAsset},
+		{"resumed after a change", "If-Range", `"outdated"`, http.StatusOK, testMachineAsset},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, store := newTestServer(t)
+			if err := UploadBuffer(store, "sha256/asset", []byte(testMachineAsset)); err != nil {
+				t.Fatal(err)
+			}
+			expectMachineKey(mock, 3, publicKey)
+			expectMachineAssetList(mock, 3)
+
+			request := machineAssetRequest(key, 3, 3, "main.wasm", time.Now())
+			request.Header.Set(test.header, test.value)
+			if test.header == "If-Range" {
+				// A resumed download restarts if the asset changed since
+				request.Header.Set("Range", "bytes=8-12")
+			}
+
+			recorder := httptest.NewRecorder()
+			server.handleMachineAsset(recorder, request)
+			if recorder.Code != test.wantStatus || recorder.Body.String() != test.wantBody {
+				t.Errorf("got status %d and body %q", recorder.Code, recorder.Body.String())
+			}
+
+			if got := recorder.Header().Get("ETag"); got != etag {
+				t.Errorf("got ETag %s", got)
+			}
+		})
+	}
+}
@@ -1,24 +1,23 @@
 package main
 
 import (
-	"context"
+	"bufio"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
-	"github.com/nedpals/supabase-go"
 )
 
 // Database types
@@ -28,38 +27,92 @@ type User struct {
 }
 
 type Project struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID           int         `json:"id"`
+	Name         string      `json:"name"`
+	Organization *int64      `json:"organization"`
+	Role         ProjectRole `json:"role"`
 }
 
 type ProjectData struct {
-	Owner string `json:"owner"`
-	Scene string `json:"scene"`
+	Owner    string `json:"owner"`
+	Scene    string `json:"scene"`
+	Revision int64  `json:"revision"`
 }
 
+var ErrSceneConflict = errors.New("project scene was modified concurrently")
+
+// maxAssetSize limits a single uploaded project asset.
+const maxAssetSize = 1024 * 1024 * 1024
+
 type Server struct {
-	supabaseCli  *supabase.Client
-	db           *sql.DB
-	s3Client     *S3Client
-	groqClient   *GroqClient
-	compileQueue *JobQueue
-	upgrader     websocket.Upgrader
+	identity         IdentityProvider
+	db               *sql.DB
+	store            ObjectStore
+	quotas           StorageQuotas
+	manifestSigner   *ManifestSigner
+	assetURLLifetime AssetURLLifetime
+	llm              *LLM
+	compileQueue     Compiler
+	upgrader         websocket.Upgrader
 }
 
-func (s *Server) UpdateProjectScene(projectID, scene string) error {
-	query := "UPDATE projects SET scene = $1 WHERE id = $2"
-	_, err := s.db.Exec(query, scene, projectID)
+// UpdateProjectScene replaces the scene of a project only if its revision still
+// matches the one the caller read. Returns the new revision on success, or
+// ErrSceneConflict if another write happened in between.
+func (s *Server) UpdateProjectScene(projectID, scene string, revision int64) (int64, error) {
+	query := `
+		UPDATE projects SET scene = $1, revision = revision + 1
+		WHERE id = $2 AND revision = $3
+		RETURNING revision
+	`
+
+	var newRevision int64
+	err := s.db.QueryRow(query, scene, projectID, revision).Scan(&newRevision)
+	if err == sql.ErrNoRows {
+		return 0, ErrSceneConflict
+	}
+
 	if err != nil {
-		return fmt.Errorf("failed to update project scene: %w", err)
+		return 0, fmt.Errorf("failed to update project scene: %w", err)
 	}
-	return nil
+
+	return newRevision, nil
+}
+
+// maxSceneEditAttempts is how many times EditProjectScene applies an edit
+// before giving up on a scene that keeps changing.
+const maxSceneEditAttempts = 3
+
+// EditProjectScene applies edit to a project's current scene and writes it
+// back. If another write happens in between, the scene is read again and the
+// edit reapplied, so edit must only depend on the scene it's given. Returns
+// the new revision, or ErrSceneConflict if every attempt conflicted.
+func (s *Server) EditProjectScene(projectID string, edit func(scene []map[string]interface{})) (int64, error) {
+	for range maxSceneEditAttempts {
+		projectData, err := s.GetProject(projectID)
+		if err != nil {
+			return 0, err
+		}
+
+		scene := []map[string]interface{}{}
+		json.Unmarshal([]byte(projectData.Scene), &scene)
+		edit(scene)
+
+		updatedScene, _ := json.Marshal(scene)
+		revision, err := s.UpdateProjectScene(projectID, string(updatedScene), projectData.Revision)
+		if !errors.Is(err, ErrSceneConflict) {
+			return revision, err
+		}
+	}
+
+	return 0, ErrSceneConflict
 }
 
 func (s *Server) GetProject(projectID string) (*ProjectData, error) {
-	query := "SELECT owner, scene FROM projects WHERE id = $1"
+	query := "SELECT owner, scene, revision FROM projects WHERE id = $1"
 
 	var project ProjectData
-	err := s.db.QueryRow(query, projectID).Scan(&project.Owner, &project.Scene)
+	err := s.db.QueryRow(query, projectID).Scan(&project.Owner, &project.Scene, &project.Revision)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("project not found")
@@ -70,250 +123,280 @@ func (s *Server) GetProject(projectID string) (*ProjectData, error) {
 	return &project, nil
 }
 
-func (s *Server) Deploy(locationId int64, data string) error {
+// Deploy snapshots a project's assets into a new deployment for a location.
+// The deployment keeps the objects alive even if the project changes.
+func (s *Server) Deploy(locationId, projectId int64, data string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to deploy: %w", err)
+	}
+	defer tx.Rollback()
+
+	var deploymentId int64
+	if err := tx.QueryRow("INSERT INTO deployments (data) VALUES ($1) RETURNING id", data).Scan(&deploymentId); err != nil {
+		return fmt.Errorf("failed to deploy: %w", err)
+	}
+
 	query := `
-		WITH new_deployment AS (
-			INSERT INTO deployments (data) VALUES ($1) RETURNING id
-		)
-		UPDATE locations SET latest_deployment = (SELECT id FROM new_deployment) WHERE id = $2
+		INSERT INTO deployment_assets (deployment, name, hash, object, content_type)
+		SELECT $1, name, hash, object, content_type FROM project_assets WHERE project = $2
 	`
+	if _, err := tx.Exec(query, deploymentId, projectId); err != nil {
+		return fmt.Errorf("failed to snapshot assets: %w", err)
+	}
 
-	_, err := s.db.Exec(query, data, locationId)
-	if err != nil {
+	query = `
+		UPDATE objects SET refs = refs + counts.refs
+		FROM (
+			SELECT object, COUNT(*) AS refs FROM deployment_assets WHERE deployment = $1 GROUP BY object
+		) counts
+		WHERE objects.name = counts.object
+	`
+	if _, err := tx.Exec(query, deploymentId); err != nil {
+		return fmt.Errorf("failed to reference assets: %w", err)
+	}
+
+	if _, err := tx.Exec("UPDATE locations SET latest_deployment = $1 WHERE id = $2", deploymentId, locationId); err != nil {
 		return fmt.Errorf("failed to deploy: %w", err)
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func main() {
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
-		log.Println(".env not loaded")
+// createProject creates an empty project owned by a user, or by an
+// organization if one is given. Returns sql.ErrNoRows if the user may not
+// create it.
+func (s *Server) createProject(userID, name string, organization *int64) (int64, error) {
+	var projectId int64
+	var err error
+	if organization == nil {
+		query := `
+			WITH new_project AS (
+				INSERT INTO projects (name, owner)
+				SELECT $1, $2
+				WHERE EXISTS (SELECT 1 FROM roles WHERE "user" = $2 AND role = 'developer')
+				RETURNING id
+			)
+			INSERT INTO project_members (project, "user", role)
+			SELECT id, $2, 'owner' FROM new_project
+			RETURNING project
+		`
+		err = s.db.QueryRow(query, name, userID).Scan(&projectId)
+	} else {
+		// Developers may create projects in organizations where they can
+		// develop. The creator also becomes a direct owner, so they keep
+		// access to the project if their organization role changes.
+		query := `
+			WITH new_project AS (
+				INSERT INTO projects (name, organization)
+				SELECT $1, $2
+				WHERE EXISTS (SELECT 1 FROM roles WHERE "user" = $3 AND role = 'developer')
+				AND EXISTS (
+					SELECT 1 FROM organization_members
+					WHERE organization = $2 AND "user" = $3 AND role IN ('owner', 'admin', 'developer')
+				)
+				RETURNING id
+			)
+			INSERT INTO project_members (project, "user", role)
+			SELECT id, $3, 'owner' FROM new_project
+			RETURNING project
+		`
+		err = s.db.QueryRow(query, name, *organization, userID).Scan(&projectId)
 	}
 
-	supabaseCli := supabase.CreateClient(os.Getenv("SUPABASE_URL"), os.Getenv("SUPABASE_API_KEY"))
+	return projectId, err
+}
 
-	// Initialize clients
-	db, err := sql.Open("postgres", os.Getenv("POSTGRES_URL"))
+// deleteProject deletes a project and releases the objects of its assets.
+func (s *Server) deleteProject(projectId int64) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		return err
 	}
+	defer tx.Rollback()
 
-	if err := db.Ping(); err != nil {
-		log.Fatal("Failed to ping database:", err)
-	}
-
-	s3Client, err := NewS3Client(
-		os.Getenv("S3_ENDPOINT"),
-		os.Getenv("S3_ACCESS_KEY_ID"),
-		os.Getenv("S3_SECRET_ACCESS_KEY"),
-		os.Getenv("S3_BUCKET"),
-	)
+	rows, err := tx.Query("DELETE FROM project_assets WHERE project = $1 RETURNING object", projectId)
 	if err != nil {
-		log.Fatal("failed to initialize S3 client: ", err)
+		return err
 	}
 
-	groqClient := NewGroqClient(os.Getenv("GROQ_API_KEY"))
-	compileQueue := NewJobQueue()
-
-	cors := os.Getenv("CORS")
+	var released []string
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			rows.Close()
+			return err
+		}
+		released = append(released, object)
+	}
+	rows.Close()
 
-	server := &Server{
-		supabaseCli:  supabaseCli,
-		db:           db,
-		s3Client:     s3Client,
-		groqClient:   groqClient,
-		compileQueue: compileQueue,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				origin := r.Header.Get("Origin")
-				return origin == "" || origin == cors
-			},
-		},
+	if err := dropObjectRefs(tx, released); err != nil {
+		return err
 	}
 
-	http.HandleFunc("/projects", server.handleProjects)
-	http.HandleFunc("/projects/{id}/assets", server.handleAssets)
-	http.HandleFunc("/machines/{id}/project", server.handleMachineProject)
-	http.HandleFunc("/", server.handleWebSocket)
+	if _, err := tx.Exec("DELETE FROM projects WHERE id = $1", projectId); err != nil {
+		return err
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 
-	fmt.Printf("Server running on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	s.deleteUnreferencedObjects(released)
+	return nil
 }
 
-func (s *Server) setCORSHeaders(w http.ResponseWriter) {
-	cors := os.Getenv("CORS")
-	if cors == "" {
-		cors = "*"
+func main() {
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		log.Println(".env not loaded")
 	}
-	w.Header().Set("Access-Control-Allow-Origin", cors)
-	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-}
-
-/*func (s *Server) handleProjectAgent(w http.ResponseWriter, r *http.Request) {
-	s.setCORSHeaders(w)
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusNoContent)
-		return
+	identity, err := NewIdentityProvider(os.Getenv)
+	if err != nil {
+		log.Fatal("Failed to initialize identity provider: ", err)
 	}
 
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	// Initialize clients
+	db, err := sql.Open("postgres", os.Getenv("POSTGRES_URL"))
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
 	}
 
-	// Extract project ID from URL
-	projectID := s.parseProjectID(r.URL.Path)
-	if projectID == "" {
-		http.Error(w, "Project not found", http.StatusNotFound)
-		return
+	if err := db.Ping(); err != nil {
+		log.Fatal("Failed to ping database:", err)
 	}
 
-	// Parse form data
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
+	store, err := NewObjectStore(os.Getenv)
+	if err != nil {
+		log.Fatal("failed to initialize object store: ", err)
 	}
 
-	prompt := r.FormValue("prompt")
-	if len(prompt) < 1 {
-		http.Error(w, "No prompt provided", http.StatusBadRequest)
-		return
+	quotas, err := NewStorageQuotas(os.Getenv)
+	if err != nil {
+		log.Fatal("failed to read storage quotas: ", err)
 	}
 
-	if len(prompt) > 2000 {
-		http.Error(w, "Prompt too long", http.StatusBadRequest)
-		return
+	manifestSigner, err := NewManifestSigner(os.Getenv)
+	if err != nil {
+		log.Fatal("failed to initialize manifest signer: ", err)
 	}
 
-	// Authorize user
-	_, err := s.authorize(r)
+	assetURLLifetime, err := NewAssetURLLifetime(os.Getenv)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		log.Fatal("failed to read asset URL lifetime: ", err)
 	}
 
-	// Get project data
-	query := `
-		SELECT p.id, p.scene, COALESCE(d.source, '') as source, COALESCE(d.created_at::text, '') as created_at
-		FROM projects p
-		LEFT JOIN deployments d ON p.id = d.project_id
-		WHERE p.id = $1
-		ORDER BY d.created_at DESC
-		LIMIT 1
-	`
-
-	var projectData ProjectWithDeployment
-	err = s.db.QueryRow(query, projectID).Scan(
-		&projectData.ID,
-		&projectData.Scene,
-		&projectData.Source,
-		&projectData.CreatedAt,
-	)
-
+	llm, err := NewLLM(os.Getenv)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Project not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		log.Fatal("failed to initialize LLM provider: ", err)
 	}
 
-	// Update project scene with new prompt
-	var sceneData []map[string]interface{}
-	if err := json.Unmarshal([]byte(projectData.Scene), &sceneData); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	compileQueue, err := NewJobQueue(os.Getenv)
+	if err != nil {
+		log.Fatal("failed to initialize compile queue: ", err)
 	}
 
-	if len(sceneData) > 0 {
-		sceneData[0]["prompt"] = prompt
-	}
+	cors := os.Getenv("CORS")
 
-	updatedScene, _ := json.Marshal(sceneData)
-	if err := s.UpdateProjectScene(projectID, string(updatedScene)); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	server := &Server{
+		identity:         identity,
+		db:               db,
+		store:            store,
+		quotas:           quotas,
+		manifestSigner:   manifestSigner,
+		assetURLLifetime: assetURLLifetime,
+		llm:              llm,
+		compileQueue:     compileQueue,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				return origin == "" || origin == cors
+			},
+		},
 	}
 
-	// Generate code using AI
-	conversation := NewCodeConversation(prompt, projectData.Source)
-	var result JobSuccess
-	var code string
-
-Retry:
-	for range 2 {
-		code, err = conversation.Generate(s.groqClient)
-		if err != nil {
-			log.Printf("AI generation failed: %v", err)
-			continue
-		}
+	http.HandleFunc("/projects", server.withAuth(server.handleProjects))
+	http.HandleFunc("/projects/import", server.withAuth(server.handleImportProject))
+	http.HandleFunc("/projects/{id}/export", server.withProject(server.handleExportProject))
+	http.HandleFunc("/projects/{id}/duplicate", server.withProject(server.handleDuplicateProject))
+	http.HandleFunc("/projects/{id}/template", server.withProject(server.handleProjectTemplate))
+	http.HandleFunc("/projects/{id}/generate", server.withProject(server.handleGenerate))
+	http.HandleFunc("/projects/{id}/conversation", server.withProject(server.handleConversation))
+	http.HandleFunc("/projects/{id}/sources", server.withProject(server.handleSources))
+	http.HandleFunc("/projects/{id}/sources/{version}", server.withProject(server.handleSource))
+	http.HandleFunc("/projects/{id}/sources/{version}/diff", server.withProject(server.handleSourceDiff))
+	http.HandleFunc("/projects/{id}/assets", server.withProject(server.handleAssets))
+	http.HandleFunc("/projects/{id}/members", server.withProject(server.handleMembers))
+	http.HandleFunc("/projects/{id}/usage", server.withProject(server.handleStorageUsage))
+	http.HandleFunc("/projects/{id}/uploads", server.withProject(server.handleUploadSessions))
+	http.HandleFunc("/projects/{id}/uploads/{upload}", server.withProject(server.handleUploadSession))
+	http.HandleFunc("/projects/{id}/uploads/{upload}/complete", server.withProject(server.handleCompleteUpload))
+	http.HandleFunc("/templates", server.withAuth(server.handleTemplates))
+	http.HandleFunc("/organizations", server.withAuth(server.handleOrganizations))
+	http.HandleFunc("/organizations/{id}/members", server.withAuth(server.handleOrganizationMembers))
+	http.HandleFunc("/machines/{id}/project", server.withAuth(server.handleMachineProject))
+	http.HandleFunc("/machines/{id}/assets/{name...}", server.handleMachineAsset)
+	http.HandleFunc("/", server.handleWebSocket)
 
-		log.Printf("AI generated code: %s", code)
+	if fileStore, ok := store.(*FileStore); ok {
+		http.HandleFunc("/objects/{name...}", fileStore.HandleDownload)
+	}
 
-		compileResult := s.compileQueue.Enqueue(code)
-		switch compileResult.Status {
-		case StatusSuccess:
-			result = compileResult.Result.(JobSuccess)
-			break Retry
+	go server.cleanupUploadSessions()
+	go server.backfillStorageSizes()
 
-		case StatusCompileError:
-			conversation.ReportError(compileResult.Result.(string))
-			log.Printf("Compile error: %s", compileResult.Result.(string))
-			continue
+	gcInterval, err := time.ParseDuration(getenvDefault("GC_INTERVAL", "6h"))
+	if err != nil {
+		log.Fatal("invalid GC_INTERVAL: ", err)
+	}
 
-		case StatusInternalError:
-			log.Printf("Internal error: %s", compileResult.Result.(error).Error())
-			break Retry
-		}
+	gcGracePeriod, err := time.ParseDuration(getenvDefault("GC_GRACE_PERIOD", "24h"))
+	if err != nil {
+		log.Fatal("invalid GC_GRACE_PERIOD: ", err)
 	}
 
-	defer result.Cleanup()
+	collector := NewObjectCollector(server, gcInterval, gcGracePeriod, os.Getenv("GC_DRY_RUN") == "true")
+	go collector.Run()
 
-	if result.ID == "" {
-		http.Error(w, "Job failed", http.StatusInternalServerError)
-		return
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
 	}
 
-	if err := s.s3Client.UploadFile(result.ID, result.WasmPath); err != nil {
-		log.Printf("WASM upload failed: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
+	fmt.Printf("Server running on port %s\n", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
 
-	// Save deployment
-	query = "INSERT INTO deployments (project_id, source, compiled_object) VALUES ($1, $2, $3)"
-	_, err = s.db.Exec(query, projectID, code, result.ID)
-	if err != nil {
-		log.Printf("Failed to save deployment: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+func getenvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
+	return fallback
+}
 
-	w.Write([]byte("OK"))
-}*/
+func (s *Server) setCORSHeaders(w http.ResponseWriter) {
+	cors := os.Getenv("CORS")
+	if cors == "" {
+		cors = "*"
+	}
+	w.Header().Set("Access-Control-Allow-Origin", cors)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+}
 
 func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
-	s.setCORSHeaders(w)
-
-	user, err := s.authorize(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	user := PrincipalFromContext(r.Context())
 
 	switch r.Method {
 	case "GET":
-		query := "SELECT id, name FROM projects WHERE owner = $1"
+		query := `
+			SELECT projects.id, projects.name, projects.organization, project_roles.role
+			FROM projects
+			JOIN project_roles ON project_roles.project = projects.id
+			WHERE project_roles."user" = $1
+		`
 		rows, err := s.db.Query(query, user.ID)
 		if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -324,7 +407,7 @@ func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
 		var projects []Project
 		for rows.Next() {
 			var project Project
-			if err := rows.Scan(&project.ID, &project.Name); err != nil {
+			if err := rows.Scan(&project.ID, &project.Name, &project.Organization, &project.Role); err != nil {
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
@@ -336,7 +419,10 @@ func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
 
 	case "POST":
 		var request struct {
-			Name string `json:"name"`
+			Name         string `json:"name"`
+			Organization *int64 `json:"organization"`
+			// Template is the ID of a template to copy instead of starting empty
+			Template *int64 `json:"template"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -354,15 +440,30 @@ func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		query := `
-			INSERT INTO projects (name, owner)
-			SELECT $1, $2
-			WHERE EXISTS (SELECT 1 FROM roles WHERE "user" = $2 AND role = 'developer')
-			RETURNING id
-		`
+		if request.Template != nil {
+			isTemplate, err := s.isTemplate(*request.Template)
+			if err != nil {
+				log.Printf("Failed to get template: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if !isTemplate {
+				http.Error(w, "Template not found", http.StatusNotFound)
+				return
+			}
+
+			projectId, err := s.duplicateProject(*request.Template, user.ID, request.Name, request.Organization)
+			if !writeDuplicateError(w, err) {
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int64{"id": projectId})
+			return
+		}
 
-		var projectId int64
-		err = s.db.QueryRow(query, request.Name, user.ID).Scan(&projectId)
+		projectId, err := s.createProject(user.ID, request.Name, request.Organization)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
@@ -403,27 +504,18 @@ func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		query := "UPDATE projects SET name = $1 WHERE id = $2 AND owner = $3"
-
-		result, err := s.db.Exec(query, request.Name, request.ProjectID, user.ID)
-		if err != nil {
-			log.Printf("Failed to rename project: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		access, ok := s.checkProjectRole(w, request.ProjectID, user.ID, ProjectRole.CanEdit)
+		if !ok {
 			return
 		}
 
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			log.Printf("Failed to get rows affected: %v", err)
+		query := "UPDATE projects SET name = $1 WHERE id = $2"
+		if _, err := s.db.Exec(query, request.Name, access.ID); err != nil {
+			log.Printf("Failed to rename project: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		if rowsAffected == 0 {
-			http.Error(w, "Project not found", http.StatusNotFound)
-			return
-		}
-
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 
@@ -434,34 +526,20 @@ func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		query := "DELETE FROM projects WHERE id = $1 AND owner = $2"
-
-		result, err := s.db.Exec(query, projectID, user.ID)
-		if err != nil {
-			log.Printf("Failed to delete project: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		access, ok := s.checkProjectRole(w, projectID, user.ID, ProjectRole.CanManage)
+		if !ok {
 			return
 		}
 
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			log.Printf("Failed to get rows affected: %v", err)
+		if err := s.deleteProject(access.ID); err != nil {
+			log.Printf("Failed to delete project: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		if rowsAffected == 0 {
-			http.Error(w, "Project not found", http.StatusNotFound)
-			return
-		}
-
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 
-	case "OPTIONS":
-		w.WriteHeader(http.StatusNoContent)
-		return
-
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -469,24 +547,13 @@ func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
-	s.setCORSHeaders(w)
-
-	user, err := s.authorize(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	projectId := r.PathValue("id")
-	projectIdInt, err := strconv.ParseInt(projectId, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid project ID", http.StatusBadRequest)
-		return
-	}
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+	projectIdInt := project.ID
 
 	switch r.Method {
 	case "GET":
-		existingFiles, err := s.getExistingAssets(projectIdInt, user.ID)
+		existingFiles, err := s.getExistingAssets(projectIdInt)
 		if err != nil {
 			log.Printf("failed to get existing assets: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -502,87 +569,229 @@ func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(assets)
 
 	case "POST":
-		if err := r.ParseMultipartForm(1024 * 1024 * 10); err != nil {
+		if !project.Role.CanEdit() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		reader, err := r.MultipartReader()
+		if err != nil {
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
 
+		// Files are streamed straight to the object store, so their expected
+		// hashes must be known before the first one arrives
+		part, err := reader.NextPart()
+		if err != nil || part.FormName() != "hashes" {
+			http.Error(w, "hashes must be the first form field", http.StatusBadRequest)
+			return
+		}
+
 		newFiles := make(map[string]string)
-		if err := json.Unmarshal([]byte(r.FormValue("hashes")), &newFiles); err != nil {
+		if err := json.NewDecoder(io.LimitReader(part, 1024*1024)).Decode(&newFiles); err != nil {
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
 
-		existingFiles, err := s.getExistingAssets(projectIdInt, user.ID)
+		fileTypes := make(map[string]assetType)
+		for name := range newFiles {
+			fileType, err := checkAssetName(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fileTypes[name] = fileType
+		}
+
+		existingFiles, err := s.getExistingAssets(projectIdInt)
 		if err != nil {
 			log.Printf("failed to get existing assets: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+		// Each changed file holds a reference to its object from here on, which
+		// is handed over to its project_assets row once the transaction commits
 		complete := false
-		createdFiles := map[string]Asset{}
+		acquired := []string{}
 		defer func() {
 			if !complete {
-				for _, file := range createdFiles {
-					if err := s.s3Client.Delete(file.Object); err != nil {
-						log.Printf("failed to rollback file: %v", err)
-					}
-				}
+				s.releaseObjects(acquired)
 			}
 		}()
 
+		createdFiles := map[string]Asset{}
+		pendingFiles := map[string][]byte{}
 		for name, clientHash := range newFiles {
-			if len(name) == 0 || len(name) > 255 {
-				http.Error(w, "file name has invalid length", http.StatusBadRequest)
+			existingFile, ok := existingFiles[name]
+			needsUpload := !ok || existingFile.Hash != clientHash
+			if !needsUpload {
+				continue
+			}
+
+			hash, err := hex.DecodeString(clientHash)
+			if err != nil || len(hash) != sha256.Size {
+				http.Error(w, "Invalid hash", http.StatusBadRequest)
 				return
 			}
 
-			if name != "main.wasm" && !strings.HasSuffix(name, ".png") {
-				http.Error(w, "only main.wasm and .png files can be uploaded", http.StatusBadRequest)
+			hashString := hex.EncodeToString(hash)
+			object := assetObjectName(hashString)
+			state, err := s.acquireObject(object)
+			if err != nil {
+				log.Printf("failed to acquire object: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
+			acquired = append(acquired, object)
+
+			reused := state.Stored && state.ContentType != ""
+			if reused {
+				reused, err = s.canReuseObject(user.ID, object)
+				if err != nil {
+					log.Printf("failed to check object access: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
 
-			existingFile, ok := existingFiles[name]
-			needsUpload := !ok || existingFile.Hash != clientHash
-			if !needsUpload {
+			if !reused {
+				createdFiles[name] = Asset{Hash: hashString, Object: object, ContentType: fileTypes[name].contentType}
+				pendingFiles[name] = hash
 				continue
 			}
 
-			s3Name := uuid.New().String()
-			uploadedFile, _, err := r.FormFile(name)
-			if err == http.ErrMissingFile {
-				http.Error(w, "Upload missing", http.StatusBadRequest)
+			// The stored contents were sniffed when they were first uploaded
+			contentType := fileTypes[name].contentType
+			if state.ContentType != contentType {
+				http.Error(w, name+" is not a valid "+contentType+" file", http.StatusBadRequest)
 				return
 			}
 
+			createdFiles[name] = Asset{Hash: hashString, Object: object, ContentType: contentType, Size: state.Size}
+		}
+
+		// Files that are replaced or removed no longer count towards the quotas,
+		// while the sizes of pending files are only known once they arrive
+		var projectDelta, userDelta int64
+		for name, existingFile := range existingFiles {
+			if newFiles[name] == existingFile.Hash {
+				continue
+			}
+
+			projectDelta -= existingFile.Size
+			if existingFile.UploadedBy == user.ID {
+				userDelta -= existingFile.Size
+			}
+		}
+
+		for _, file := range createdFiles {
+			projectDelta += file.Size
+			userDelta += file.Size
+		}
+
+		budget, err := s.storageBudget(projectIdInt, user.ID, projectDelta, userDelta)
+		if err != nil {
+			log.Printf("failed to check storage quota: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if budget < 0 {
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+
 			if err != nil {
-				log.Printf("failed to parse uploaded file: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				http.Error(w, "Bad request", http.StatusBadRequest)
 				return
 			}
 
-			data, err := io.ReadAll(uploadedFile)
-			if err != nil {
-				log.Printf("failed to read uploaded file: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			name := part.FormName()
+			hash, ok := pendingFiles[name]
+			if !ok {
+				// Unchanged files and files the user already has are skipped
+				continue
+			}
+			delete(pendingFiles, name)
+
+			object := createdFiles[name].Object
+			limit := min(maxAssetSize, budget)
+			verifier := NewVerifyingReader(part, hash, limit)
+			buffered := bufio.NewReaderSize(verifier, sniffLength)
+
+			// Read errors are returned again by the upload below
+			header, _ := buffered.Peek(sniffLength)
+			contentType, err := sniffAsset(name, header)
+			if err != nil && verifier.Err() == nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			hash := sha256.Sum256(data)
-			hashString := hex.EncodeToString(hash[:])
-			if hashString != clientHash {
+			err = s.store.Upload(object, buffered, -1, hash, contentType)
+
+			switch verifier.Err() {
+			case ErrHashMismatch:
 				http.Error(w, "Hash mismatch", http.StatusBadRequest)
 				return
+			case ErrObjectTooLarge:
+				if limit < maxAssetSize {
+					http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+				} else {
+					http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+				}
+				return
 			}
 
-			if err := s.s3Client.UploadBuffer(s3Name, data); err != nil {
+			if err != nil {
 				log.Printf("failed to upload file: %v", err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
 
-			createdFiles[name] = Asset{Hash: hashString, Object: s3Name}
+			size, err := s.processImageAsset(object, contentType, verifier.Size())
+			if err != nil {
+				if isImageError(err) {
+					http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				log.Printf("failed to process image: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if err := s.markObjectStored(object, contentType, size); err != nil {
+				log.Printf("failed to mark object stored: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			file := createdFiles[name]
+			file.Size = size
+			createdFiles[name] = file
+			budget -= file.Size
+		}
+
+		// Tell the client which files it has to send, it may omit the ones that
+		// it already has access to
+		if len(pendingFiles) > 0 {
+			missing := []string{}
+			for name := range pendingFiles {
+				missing = append(missing, name)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string][]string{"missing": missing})
+			return
 		}
 
 		tx, err := s.db.BeginTx(r.Context(), nil)
@@ -593,13 +802,20 @@ func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
 		}
 		defer tx.Rollback()
 
+		if err := s.lockStorageUsage(tx, projectIdInt, user.ID); err != nil {
+			log.Printf("failed to lock storage usage: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		for name, file := range createdFiles {
 			query := `
-				INSERT INTO project_assets (name, hash, object, project)
-				VALUES ($1, $2, $3, $4)
-				ON CONFLICT (name, project) DO UPDATE SET hash = $2, object = $3
+				INSERT INTO project_assets (name, hash, object, project, content_type, size, uploaded_by)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				ON CONFLICT (name, project) DO UPDATE SET
+					hash = $2, object = $3, content_type = $5, size = $6, uploaded_by = $7
 			`
-			_, err := tx.Exec(query, name, file.Hash, file.Object, projectIdInt)
+			_, err := tx.Exec(query, name, file.Hash, file.Object, projectIdInt, file.ContentType, file.Size, user.ID)
 			if err != nil {
 				log.Printf("failed to insert file: %v", err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -607,22 +823,41 @@ func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		toDelete := []string{}
+		released := []string{}
 		for name, existingFile := range existingFiles {
 			newAsset, ok := newFiles[name]
 			if ok && newAsset == existingFile.Hash {
 				continue
 			}
 
-			query := "DELETE FROM project_assets WHERE name = $1 AND project = $2 AND hash = $3"
-			_, err := tx.Exec(query, name, projectIdInt, existingFile.Hash)
-			if err != nil && err != sql.ErrNoRows {
-				log.Printf("failed to delete file: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			if !ok {
+				query := "DELETE FROM project_assets WHERE name = $1 AND project = $2"
+				if _, err := tx.Exec(query, name, projectIdInt); err != nil {
+					log.Printf("failed to delete file: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			released = append(released, existingFile.Object)
+		}
+
+		if err := dropObjectRefs(tx, released); err != nil {
+			log.Printf("failed to release objects: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Uploads to other projects may have used up the quota in the meantime
+		if err := s.checkStorageQuotas(tx, projectIdInt, user.ID); err != nil {
+			if errors.Is(err, ErrQuotaExceeded) {
+				http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
 				return
 			}
 
-			toDelete = append(toDelete, existingFile.Object)
+			log.Printf("failed to check storage quota: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
 
 		if err := tx.Commit(); err != nil {
@@ -632,11 +867,7 @@ func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
 		}
 
 		complete = true
-		s.s3Client.ParallelDelete(toDelete)
-
-	case "OPTIONS":
-		w.WriteHeader(http.StatusNoContent)
-		return
+		s.deleteUnreferencedObjects(released)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -645,7 +876,7 @@ func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleMachineProject(w http.ResponseWriter, r *http.Request) {
-	s.setCORSHeaders(w)
+	user := PrincipalFromContext(r.Context())
 
 	machineId := r.PathValue("id")
 	machineIdInt, err := strconv.Atoi(machineId)
@@ -656,12 +887,6 @@ func (s *Server) handleMachineProject(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "POST":
-		user, err := s.authorize(r)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
 		var request struct {
 			ProjectId string `json:"project_id"`
 		}
@@ -671,28 +896,47 @@ func (s *Server) handleMachineProject(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		query := `
-			UPDATE machines SET project = $1
-			WHERE id = $2 AND EXISTS (
-				SELECT 1 FROM machines
-				JOIN locations ON machines.location = locations.id
-				WHERE locations.owner = $3 AND machines.id = $2
-			) AND EXISTS (
-				SELECT 1 FROM projects WHERE projects.id = $1 AND projects.owner = $3
-			)
-		`
+		canManage, err := s.CanManageMachine(machineIdInt, user.ID)
+		if err != nil {
+			log.Printf("failed to check machine access: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !canManage {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
 
-		if _, err = s.db.Exec(query, request.ProjectId, machineIdInt, user.ID); err != nil {
+		project, ok := s.checkProjectRole(w, request.ProjectId, user.ID, ProjectRole.CanEdit)
+		if !ok {
+			return
+		}
+
+		query := "UPDATE machines SET project = $1 WHERE id = $2"
+		if _, err = s.db.Exec(query, project.ID, machineIdInt); err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-	case "OPTIONS":
-		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 }
 
+// CanManageMachine reports whether a user may change what a machine runs.
+func (s *Server) CanManageMachine(machineID int, userID string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM machine_managers WHERE machine = $1 AND "user" = $2)`
+
+	var canManage bool
+	if err := s.db.QueryRow(query, machineID, userID).Scan(&canManage); err != nil {
+		return false, err
+	}
+
+	return canManage, nil
+}
+
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -701,40 +945,36 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	ws := NewWebSocketHandler(s, s.supabaseCli, s.s3Client, conn)
-	ws.Handle()
+	ws := NewWebSocketHandler(s, s.store, conn)
+	ws.Handle(r.Context())
 }
 
-func (s *Server) authorize(r *http.Request) (*supabase.User, error) {
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		return nil, fmt.Errorf("no authorization header")
-	}
-
-	user, err := s.supabaseCli.Auth.User(context.Background(), auth)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
+// checkAssetName validates a file name and returns the type its contents must
+// have.
+func checkAssetName(name string) (assetType, error) {
+	if len(name) == 0 || len(name) > 255 {
+		return assetType{}, errors.New("file name has invalid length")
 	}
 
-	return user, nil
+	return assetTypeOf(name)
 }
 
 type Asset struct {
-	Hash   string `json:"hash"`
-	Object string `json:"object"`
+	Hash        string `json:"hash"`
+	Object      string `json:"object"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	UploadedBy  string `json:"uploaded_by"`
 }
 
-func (s *Server) getExistingAssets(projectId int64, userId string) (map[string]Asset, error) {
+func (s *Server) getExistingAssets(projectId int64) (map[string]Asset, error) {
 	query := `
-		SELECT name, hash, object
+		SELECT name, hash, object, content_type, size, COALESCE(uploaded_by::text, '')
 		FROM project_assets
-		WHERE project = $1 AND EXISTS (
-			SELECT 1 FROM projects WHERE projects.id = project_assets.project
-				AND projects.owner = $2
-		)
+		WHERE project = $1
 	`
 
-	rows, err := s.db.Query(query, projectId, userId)
+	rows, err := s.db.Query(query, projectId)
 	if err != nil {
 		return nil, err
 	}
@@ -742,12 +982,13 @@ func (s *Server) getExistingAssets(projectId int64, userId string) (map[string]A
 
 	existingFiles := map[string]Asset{}
 	for rows.Next() {
-		var name, hash, object string
-		if err := rows.Scan(&name, &hash, &object); err != nil {
+		var asset Asset
+		var name string
+		if err := rows.Scan(&name, &asset.Hash, &asset.Object, &asset.ContentType, &asset.Size, &asset.UploadedBy); err != nil {
 			return nil, err
 		}
 
-		existingFiles[name] = Asset{Hash: hash, Object: object}
+		existingFiles[name] = asset
 	}
 
 	return existingFiles, nil
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newTestServer returns a server backed by a mock database and an in-memory
+// object store.
+func newTestServer(t *testing.T) (*Server, sqlmock.Sqlmock, *MemoryStore) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	store := NewMemoryStore()
+	return &Server{db: db, store: store}, mock, store
+}
+
+// withTestProject authenticates a request as userID with a role on a project,
+// as withProject would.
+func withTestProject(r *http.Request, userID string, projectID int64, role ProjectRole) *http.Request {
+	ctx := context.WithValue(r.Context(), principalKey, &Principal{ID: userID})
+	ctx = context.WithValue(ctx, projectAccessKey, ProjectAccess{ID: projectID, Role: role})
+	return r.WithContext(ctx)
+}
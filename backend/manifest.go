@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"simulo.tech/backend/m/v2/protocol"
+)
+
+// ManifestSigner signs the asset manifests sent to machines, which verify them
+// with the corresponding public key.
+type ManifestSigner struct {
+	key ed25519.PrivateKey
+}
+
+// NewManifestSigner reads MANIFEST_SIGNING_KEY, a PEM-encoded PKCS #8 Ed25519
+// private key. Without one, manifests are signed with a key generated at
+// startup, which machines can't verify across restarts.
+func NewManifestSigner(getenv func(string) string) (*ManifestSigner, error) {
+	keyPem := getenv("MANIFEST_SIGNING_KEY")
+	if keyPem == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+
+		log.Println("MANIFEST_SIGNING_KEY not set, signing manifests with a temporary key")
+		return &ManifestSigner{key: key}, nil
+	}
+
+	block, _ := pem.Decode([]byte(keyPem))
+	if block == nil {
+		return nil, errors.New("MANIFEST_SIGNING_KEY is not PEM encoded")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MANIFEST_SIGNING_KEY: %w", err)
+	}
+
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("MANIFEST_SIGNING_KEY is not an Ed25519 key")
+	}
+
+	return &ManifestSigner{key: ed25519Key}, nil
+}
+
+func (m *ManifestSigner) Sign(manifest []byte) []byte {
+	return ed25519.Sign(m.key, manifest)
+}
+
+// AssetURLLifetime decides how long presigned asset URLs stay valid. Larger
+// files take longer to download, so their URLs last longer.
+type AssetURLLifetime struct {
+	Base   time.Duration
+	PerMiB time.Duration
+	Max    time.Duration
+}
+
+// NewAssetURLLifetime reads ASSET_URL_LIFETIME, ASSET_URL_LIFETIME_PER_MIB and
+// ASSET_URL_LIFETIME_MAX. S3 doesn't accept lifetimes over 7 days.
+func NewAssetURLLifetime(getenv func(string) string) (AssetURLLifetime, error) {
+	var lifetime AssetURLLifetime
+	durations := []struct {
+		key      string
+		fallback string
+		value    *time.Duration
+	}{
+		{"ASSET_URL_LIFETIME", "5m", &lifetime.Base},
+		{"ASSET_URL_LIFETIME_PER_MIB", "5s", &lifetime.PerMiB},
+		{"ASSET_URL_LIFETIME_MAX", "6h", &lifetime.Max},
+	}
+
+	for _, duration := range durations {
+		value := getenv(duration.key)
+		if value == "" {
+			value = duration.fallback
+		}
+
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return AssetURLLifetime{}, fmt.Errorf("invalid %s: %q", duration.key, value)
+		}
+		*duration.value = parsed
+	}
+
+	if lifetime.Max > 7*24*time.Hour {
+		return AssetURLLifetime{}, errors.New("ASSET_URL_LIFETIME_MAX must not exceed 7 days")
+	}
+
+	return lifetime, nil
+}
+
+func (l AssetURLLifetime) For(size int64) time.Duration {
+	mib := size / (1024 * 1024)
+	if l.PerMiB > 0 && mib > int64((l.Max-l.Base)/l.PerMiB) {
+		return l.Max
+	}
+
+	return min(l.Base+time.Duration(mib)*l.PerMiB, l.Max)
+}
+
+// machineAsset is a manifest entry along with the object it's downloaded from.
+type machineAsset struct {
+	protocol.ManifestEntry
+	object string
+}
+
+// machineAssets lists the assets a machine should have along with the
+// deployment they belong to. They are the assets of the latest deployment to
+// the machine's location, or of the project it runs with deployment 0 if
+// nothing was deployed there. Image assets are replaced by their textures.
+// Hashes and sizes come from the database, so this doesn't touch the object
+// store.
+func (s *Server) machineAssets(machineID int) (int64, []machineAsset, error) {
+	var deploymentID sql.NullInt64
+	query := `
+		SELECT locations.latest_deployment
+		FROM machines
+		LEFT JOIN locations ON machines.location = locations.id
+		WHERE machines.id = $1
+	`
+	if err := s.db.QueryRow(query, machineID).Scan(&deploymentID); err != nil {
+		return 0, nil, fmt.Errorf("failed to get machine deployment: %w", err)
+	}
+
+	var rows *sql.Rows
+	var err error
+	if deploymentID.Valid {
+		query = `
+			SELECT
+				a.name,
+				COALESCE(v.variant_object, a.object),
+				COALESCE(v.hash, a.hash),
+				COALESCE(v.size, o.size, 0),
+				a.content_type
+			FROM deployment_assets a
+			LEFT JOIN objects o ON o.name = a.object
+			LEFT JOIN image_variants v ON v.object = a.object AND v.variant = $2
+			WHERE a.deployment = $1
+			ORDER BY a.name
+		`
+		rows, err = s.db.Query(query, deploymentID.Int64, textureVariant)
+	} else {
+		query = `
+			SELECT
+				a.name,
+				COALESCE(v.variant_object, a.object),
+				COALESCE(v.hash, a.hash),
+				COALESCE(v.size, a.size),
+				a.content_type
+			FROM project_assets a
+			LEFT JOIN image_variants v ON v.object = a.object AND v.variant = $2
+			WHERE a.project = (
+				SELECT project
+				FROM machines
+				WHERE id = $1
+			)
+			ORDER BY a.name
+		`
+		rows, err = s.db.Query(query, machineID, textureVariant)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get machine assets: %w", err)
+	}
+	defer rows.Close()
+
+	assets := []machineAsset{}
+	for rows.Next() {
+		var asset machineAsset
+		var hash string
+		if err := rows.Scan(&asset.Name, &asset.object, &hash, &asset.Size, &asset.ContentType); err != nil {
+			return 0, nil, err
+		}
+
+		asset.Hash, err = hex.DecodeString(hash)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid hash for %s: %w", asset.Name, err)
+		}
+
+		// Assets uploaded before sizes were recorded are measured once
+		if asset.Size == 0 {
+			asset.Size, err = s.backfillAssetSize(asset.object)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+
+		assets = append(assets, asset)
+	}
+
+	return deploymentID.Int64, assets, rows.Err()
+}
+
+func (s *Server) presignAsset(asset machineAsset) (string, error) {
+	url, err := s.store.PresignURL(asset.object, s.assetURLLifetime.For(asset.Size))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign URL for %s: %w", asset.object, err)
+	}
+
+	return url, nil
+}
+
+// assetURLs presigns fresh URLs for the named assets of a machine, returning
+// the names it found along with their URLs. Names that aren't among the
+// machine's assets are left out, so machines can't fetch other projects' files.
+func (s *Server) assetURLs(machineID int, names []string) ([]string, []string, error) {
+	_, assets, err := s.machineAssets(machineID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+	}
+
+	found := []string{}
+	urls := []string{}
+	for _, asset := range assets {
+		if !requested[asset.Name] {
+			continue
+		}
+
+		url, err := s.presignAsset(asset)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		found = append(found, asset.Name)
+		urls = append(urls, url)
+	}
+
+	return found, urls, nil
+}
+
+// machineManifest lists the assets a machine should have, along with the
+// deployment they belong to or 0 if there is none.
+func (s *Server) machineManifest(machineID int) (int64, []protocol.ManifestEntry, error) {
+	deploymentID, assets, err := s.machineAssets(machineID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	entries := make([]protocol.ManifestEntry, len(assets))
+	for i, asset := range assets {
+		asset.URL, err = s.presignAsset(asset)
+		if err != nil {
+			return 0, nil, err
+		}
+		entries[i] = asset.ManifestEntry
+	}
+
+	return deploymentID, entries, nil
+}
+
+func (s *Server) backfillAssetSize(object string) (int64, error) {
+	info, err := s.store.Stat(object)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of %s: %w", object, err)
+	}
+
+	if _, err := s.db.Exec("UPDATE project_assets SET size = $1 WHERE object = $2 AND size = 0", info.Size, object); err != nil {
+		return 0, fmt.Errorf("failed to record size of %s: %w", object, err)
+	}
+
+	if _, err := s.db.Exec("UPDATE objects SET size = $1 WHERE name = $2 AND size IS NULL", info.Size, object); err != nil {
+		return 0, fmt.Errorf("failed to record size of %s: %w", object, err)
+	}
+
+	return info.Size, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMachineManifest(t *testing.T) {
+	deployed := sha256.Sum256([]byte("deployed"))
+	live := sha256.Sum256([]byte("live"))
+	assetColumns := []string{"name", "object", "hash", "size", "content_type"}
+
+	tests := []struct {
+		name             string
+		deployment       any
+		expectAssets     func(mock sqlmock.Sqlmock)
+		wantDeploymentID int64
+		wantHash         []byte
+	}{
+		{
+			// The project may have changed since it was deployed, but the
+			// signed deployment must match the entries
+			name:       "deployed",
+			deployment: int64(7),
+			expectAssets: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM deployment_assets").WithArgs(int64(7), textureVariant).
+					WillReturnRows(sqlmock.NewRows(assetColumns).
+						AddRow("main.wasm", "sha256/deployed", hex.EncodeToString(deployed[:]), 8, "application/wasm"))
+			},
+			wantDeploymentID: 7,
+			wantHash:         deployed[:],
+		},
+		{
+			name:       "not deployed",
+			deployment: nil,
+			expectAssets: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM project_assets").WithArgs(3, textureVariant).
+					WillReturnRows(sqlmock.NewRows(assetColumns).
+						AddRow("main.wasm", "sha256/live", hex.EncodeToString(live[:]), 4, "application/wasm"))
+			},
+			wantDeploymentID: 0,
+			wantHash:         live[:],
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, store := newTestServer(t)
+			server.assetURLLifetime = AssetURLLifetime{Base: time.Minute, Max: time.Hour}
+			for _, name := range []string{"sha256/deployed", "sha256/live"} {
+				if err := UploadBuffer(store, name, []byte(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mock.ExpectQuery("SELECT locations.latest_deployment").WithArgs(3).
+				WillReturnRows(sqlmock.NewRows([]string{"latest_deployment"}).AddRow(test.deployment))
+			test.expectAssets(mock)
+
+			deploymentID, entries, err := server.machineManifest(3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if deploymentID != test.wantDeploymentID {
+				t.Errorf("got deployment %d", deploymentID)
+			}
+
+			if len(entries) != 1 || string(entries[0].Hash) != string(test.wantHash) || entries[0].URL == "" {
+				t.Errorf("got entries %+v", entries)
+			}
+		})
+	}
+}
+
+func TestAssetURLLifetimeFor(t *testing.T) {
+	const mib = 1024 * 1024
+	lifetime := AssetURLLifetime{Base: 5 * time.Minute, PerMiB: 5 * time.Second, Max: 6 * time.Hour}
+
+	tests := []struct {
+		name     string
+		lifetime AssetURLLifetime
+		size     int64
+		want     time.Duration
+	}{
+		{"empty", lifetime, 0, 5 * time.Minute},
+		{"partial MiB", lifetime, mib - 1, 5 * time.Minute},
+		{"one MiB", lifetime, mib, 5*time.Minute + 5*time.Second},
+		{"ten MiB", lifetime, 10 * mib, 5*time.Minute + 50*time.Second},
+		{"just below max", lifetime, 4259 * mib, 6*time.Hour - 5*time.Second},
+		{"reaches max", lifetime, 4260 * mib, 6 * time.Hour},
+		{"clamped", lifetime, 4261 * mib, 6 * time.Hour},
+		{"doesn't overflow", lifetime, math.MaxInt64, 6 * time.Hour},
+		{"no per MiB", AssetURLLifetime{Base: time.Minute, Max: time.Hour}, math.MaxInt64, time.Minute},
+		{"base over max", AssetURLLifetime{Base: 2 * time.Hour, PerMiB: time.Second, Max: time.Hour}, 0, time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.lifetime.For(test.size); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAssetURLs(t *testing.T) {
+	server, mock, store := newTestServer(t)
+	server.assetURLLifetime = AssetURLLifetime{Base: time.Minute, Max: time.Hour}
+	if err := UploadBuffer(store, "sha256/deployed", []byte("deployed")); err != nil {
+		t.Fatal(err)
+	}
+
+	deployed := sha256.Sum256([]byte("deployed"))
+	mock.ExpectQuery("SELECT locations.latest_deployment").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"latest_deployment"}).AddRow(int64(7)))
+	mock.ExpectQuery("FROM deployment_assets").WithArgs(int64(7), textureVariant).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "object", "hash", "size", "content_type"}).
+			AddRow("main.wasm", "sha256/deployed", hex.EncodeToString(deployed[:]), 8, "application/wasm"))
+
+	// Assets of other deployments and raw object names are refused even if
+	// the objects exist
+	names, urls, err := server.assetURLs(3, []string{"other.png", "main.wasm", "sha256/deployed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(names, []string{"main.wasm"}) || !slices.Equal(urls, []string{"memory:///sha256/deployed"}) {
+		t.Errorf("got names %v and URLs %v", names, urls)
+	}
+}
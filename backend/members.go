@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type ProjectRole string
+
+const (
+	RoleOwner  ProjectRole = "owner"
+	RoleEditor ProjectRole = "editor"
+	RoleViewer ProjectRole = "viewer"
+)
+
+func (r ProjectRole) Valid() bool {
+	return r == RoleOwner || r == RoleEditor || r == RoleViewer
+}
+
+func (r ProjectRole) CanEdit() bool {
+	return r == RoleOwner || r == RoleEditor
+}
+
+func (r ProjectRole) CanManage() bool {
+	return r == RoleOwner
+}
+
+type ProjectMember struct {
+	UserID string      `json:"user_id"`
+	Email  string      `json:"email"`
+	Role   ProjectRole `json:"role"`
+}
+
+var errLastOwner = errors.New("project must have at least one owner")
+
+// GetProjectRole returns the role a user has on a project, either directly or
+// through the organization owning it, or an empty role if they have no access.
+func (s *Server) GetProjectRole(projectID int64, userID string) (ProjectRole, error) {
+	query := `SELECT role FROM project_roles WHERE project = $1 AND "user" = $2`
+
+	var role ProjectRole
+	err := s.db.QueryRow(query, projectID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get project role: %w", err)
+	}
+
+	return role, nil
+}
+
+// hasGlobalRole reports whether a user has a role that isn't tied to any
+// project, such as developer.
+func (s *Server) hasGlobalRole(userID, role string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM roles WHERE "user" = $1 AND role = $2)`
+
+	var ok bool
+	if err := s.db.QueryRow(query, userID, role).Scan(&ok); err != nil {
+		return false, fmt.Errorf("failed to get global role: %w", err)
+	}
+
+	return ok, nil
+}
+
+// findUserByEmail returns the ID of the user with the given email, or an empty
+// string if there is none.
+func (s *Server) findUserByEmail(email string) (string, error) {
+	var userID string
+	err := s.db.QueryRow("SELECT id FROM auth.users WHERE email = $1", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
+
+func (s *Server) getProjectMembers(projectID int64) ([]ProjectMember, error) {
+	query := `
+		SELECT project_members."user", COALESCE(users.email, ''), project_members.role
+		FROM project_members
+		LEFT JOIN auth.users ON users.id = project_members."user"
+		WHERE project_members.project = $1
+		ORDER BY project_members.role, users.email
+	`
+
+	rows, err := s.db.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ProjectMember{}
+	for rows.Next() {
+		var member ProjectMember
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// setProjectMember adds a user to a project or changes their role. A project
+// can never be left without an owner.
+func (s *Server) setProjectMember(projectID int64, userID string, role ProjectRole) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO project_members (project, "user", role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (project, "user") DO UPDATE SET role = $3
+	`
+	if _, err := tx.Exec(query, projectID, userID, role); err != nil {
+		return fmt.Errorf("failed to set member: %w", err)
+	}
+
+	if err := ensureProjectOwner(tx, projectID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Server) removeProjectMember(projectID int64, userID string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM project_members WHERE project = $1 AND "user" = $2`
+	result, err := tx.Exec(query, projectID, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove member: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return false, nil
+	}
+
+	if err := ensureProjectOwner(tx, projectID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func ensureProjectOwner(tx *sql.Tx, projectID int64) error {
+	query := `SELECT EXISTS (SELECT 1 FROM project_roles WHERE project = $1 AND role = 'owner')`
+
+	var hasOwner bool
+	if err := tx.QueryRow(query, projectID).Scan(&hasOwner); err != nil {
+		return fmt.Errorf("failed to check project owner: %w", err)
+	}
+
+	if !hasOwner {
+		return errLastOwner
+	}
+
+	return nil
+}
+
+func (s *Server) handleMembers(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+	projectId, role := project.ID, project.Role
+
+	switch r.Method {
+	case "GET":
+		members, err := s.getProjectMembers(projectId)
+		if err != nil {
+			log.Printf("failed to get project members: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+
+	case "POST":
+		if !role.CanManage() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			Email string      `json:"email"`
+			Role  ProjectRole `json:"role"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		if !request.Role.Valid() {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+
+		invitedId, err := s.findUserByEmail(request.Email)
+		if err != nil {
+			log.Printf("failed to look up user: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if invitedId == "" {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		err = s.setProjectMember(projectId, invitedId, request.Role)
+		if err == errLastOwner {
+			http.Error(w, "Project must have an owner", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Printf("failed to set project member: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+
+	case "DELETE":
+		memberId := r.URL.Query().Get("user")
+		if memberId == "" {
+			http.Error(w, "User ID required", http.StatusBadRequest)
+			return
+		}
+
+		// Anyone can leave a project, only owners can remove others
+		if memberId != user.ID && !role.CanManage() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		removed, err := s.removeProjectMember(projectId, memberId)
+		if err == errLastOwner {
+			http.Error(w, "Project must have an owner", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Printf("failed to remove project member: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !removed {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectOwnerCheck expects ensureProjectOwner to find whether project 1 still
+// has an owner, and the transaction to end accordingly.
+func expectOwnerCheck(mock sqlmock.Sqlmock, hasOwner bool) {
+	mock.ExpectQuery("FROM project_roles WHERE project = \\$1 AND role = 'owner'").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(hasOwner))
+	if hasOwner {
+		mock.ExpectCommit()
+	} else {
+		mock.ExpectRollback()
+	}
+}
+
+func TestHandleMembers(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		role       ProjectRole
+		expect     func(mock sqlmock.Sqlmock)
+		wantStatus int
+	}{
+		{
+			name:   "invite",
+			method: "POST",
+			body:   `{"email": "friend@example.com", "role": "editor"}`,
+			role:   RoleOwner,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM auth.users WHERE email").WithArgs("friend@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-2"))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO project_members").WithArgs(int64(1), "user-2", RoleEditor).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectOwnerCheck(mock, true)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invite as editor",
+			method:     "POST",
+			body:       `{"email": "friend@example.com", "role": "editor"}`,
+			role:       RoleEditor,
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "invite with invalid role",
+			method:     "POST",
+			body:       `{"email": "friend@example.com", "role": "admin"}`,
+			role:       RoleOwner,
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "invite unknown user",
+			method: "POST",
+			body:   `{"email": "stranger@example.com", "role": "viewer"}`,
+			role:   RoleOwner,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM auth.users WHERE email").WithArgs("stranger@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:   "change role",
+			method: "POST",
+			body:   `{"email": "friend@example.com", "role": "viewer"}`,
+			role:   RoleOwner,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM auth.users WHERE email").WithArgs("friend@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-2"))
+				mock.ExpectBegin()
+				mock.ExpectExec("ON CONFLICT \\(project, \"user\"\\) DO UPDATE SET role").WithArgs(int64(1), "user-2", RoleViewer).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectOwnerCheck(mock, true)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "demote last owner",
+			method: "POST",
+			body:   `{"email": "me@example.com", "role": "editor"}`,
+			role:   RoleOwner,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("FROM auth.users WHERE email").WithArgs("me@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO project_members").WithArgs(int64(1), "user-1", RoleEditor).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectOwnerCheck(mock, false)
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "remove member",
+			method: "DELETE",
+			target: "?user=user-2",
+			role:   RoleOwner,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM project_members").WithArgs(int64(1), "user-2").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectOwnerCheck(mock, true)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "remove member as editor",
+			method:     "DELETE",
+			target:     "?user=user-2",
+			role:       RoleEditor,
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:   "leave as viewer",
+			method: "DELETE",
+			target: "?user=user-1",
+			role:   RoleViewer,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM project_members").WithArgs(int64(1), "user-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectOwnerCheck(mock, true)
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "last owner leaves",
+			method: "DELETE",
+			target: "?user=user-1",
+			role:   RoleOwner,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM project_members").WithArgs(int64(1), "user-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectOwnerCheck(mock, false)
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "remove non-member",
+			method: "DELETE",
+			target: "?user=user-3",
+			role:   RoleOwner,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM project_members").WithArgs(int64(1), "user-3").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, _ := newTestServer(t)
+			test.expect(mock)
+
+			request := httptest.NewRequest(test.method, "/projects/1/members"+test.target, strings.NewReader(test.body))
+			request = withTestProject(request, "user-1", 1, test.role)
+
+			recorder := httptest.NewRecorder()
+			server.handleMembers(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+// MemoryStore keeps objects in memory. Intended for tests.
+type MemoryStore struct {
+	objects map[string]memoryObject
+	uploads map[string]*memoryUpload
+	mutex   sync.RWMutex
+}
+
+type memoryUpload struct {
+	parts       map[int][]byte
+	contentType string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		objects: make(map[string]memoryObject),
+		uploads: make(map[string]*memoryUpload),
+	}
+}
+
+func (m *MemoryStore) Upload(name string, reader io.Reader, size int64, hash []byte, contentType string) error {
+	if size >= 0 {
+		reader = io.LimitReader(reader, size)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[name] = memoryObject{
+		data:         data,
+		contentType:  contentType,
+		lastModified: time.Now(),
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) Open(name string) (io.ReadSeekCloser, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	object, ok := m.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("object %q not found", name)
+	}
+
+	return memoryReader{bytes.NewReader(object.data)}, nil
+}
+
+func (m *MemoryStore) PresignURL(name string, expiresIn time.Duration) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if _, ok := m.objects[name]; !ok {
+		return "", fmt.Errorf("object %q not found", name)
+	}
+
+	return "memory:///" + name, nil
+}
+
+func (m *MemoryStore) GetHash(name string) ([]byte, error) {
+	info, err := m.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Hash, nil
+}
+
+func (m *MemoryStore) Stat(name string) (*ObjectInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	object, ok := m.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("object %q not found", name)
+	}
+
+	hash := sha256.Sum256(object.data)
+	return &ObjectInfo{
+		Name:         name,
+		Size:         int64(len(object.data)),
+		Hash:         hash[:],
+		ContentType:  object.contentType,
+		LastModified: object.lastModified,
+	}, nil
+}
+
+func (m *MemoryStore) List(fn func(info ObjectInfo) error) error {
+	m.mutex.RLock()
+	objects := make([]ObjectInfo, 0, len(m.objects))
+	for name, object := range m.objects {
+		objects = append(objects, ObjectInfo{
+			Name:         name,
+			Size:         int64(len(object.data)),
+			LastModified: object.lastModified,
+		})
+	}
+	m.mutex.RUnlock()
+
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) CreateMultipartUpload(name string, hash []byte, contentType string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	uploadID := generateRandomHex(16)
+	m.uploads[uploadID] = &memoryUpload{parts: make(map[int][]byte), contentType: contentType}
+	return uploadID, nil
+}
+
+func (m *MemoryStore) UploadPart(name, uploadID string, partNumber int, reader io.Reader, size int64) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, size))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part: %w", err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	upload, ok := m.uploads[uploadID]
+	if !ok {
+		return "", fmt.Errorf("upload %q not found", uploadID)
+	}
+
+	upload.parts[partNumber] = data
+	return strconv.Itoa(partNumber), nil
+}
+
+func (m *MemoryStore) CompleteMultipartUpload(name, uploadID string, etags []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	upload, ok := m.uploads[uploadID]
+	if !ok {
+		return fmt.Errorf("upload %q not found", uploadID)
+	}
+
+	var data []byte
+	for i := range etags {
+		part, ok := upload.parts[i+1]
+		if !ok {
+			return fmt.Errorf("part %d missing", i+1)
+		}
+		data = append(data, part...)
+	}
+
+	m.objects[name] = memoryObject{data: data, contentType: upload.contentType, lastModified: time.Now()}
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+func (m *MemoryStore) AbortMultipartUpload(name, uploadID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+// Get returns a copy of an object's contents.
+func (m *MemoryStore) Get(name string) ([]byte, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	object, ok := m.objects[name]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), object.data...), true
+}
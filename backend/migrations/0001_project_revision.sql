@@ -0,0 +1 @@
+ALTER TABLE projects ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+CREATE TABLE project_members (
+	project BIGINT NOT NULL REFERENCES projects (id) ON DELETE CASCADE,
+	"user" UUID NOT NULL REFERENCES auth.users (id) ON DELETE CASCADE,
+	role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+	PRIMARY KEY (project, "user")
+);
+
+INSERT INTO project_members (project, "user", role)
+SELECT id, owner, 'owner' FROM projects;
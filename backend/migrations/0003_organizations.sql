@@ -0,0 +1,57 @@
+CREATE TABLE organizations (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE organization_members (
+	organization BIGINT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+	"user" UUID NOT NULL REFERENCES auth.users (id) ON DELETE CASCADE,
+	role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'developer', 'member')),
+	PRIMARY KEY (organization, "user")
+);
+
+ALTER TABLE projects ALTER COLUMN owner DROP NOT NULL;
+ALTER TABLE projects ADD COLUMN organization BIGINT REFERENCES organizations (id) ON DELETE CASCADE;
+ALTER TABLE projects ADD CHECK (owner IS NOT NULL OR organization IS NOT NULL);
+
+ALTER TABLE locations ALTER COLUMN owner DROP NOT NULL;
+ALTER TABLE locations ADD COLUMN organization BIGINT REFERENCES organizations (id) ON DELETE CASCADE;
+ALTER TABLE locations ADD CHECK (owner IS NOT NULL OR organization IS NOT NULL);
+
+ALTER TABLE machines ADD COLUMN organization BIGINT REFERENCES organizations (id) ON DELETE SET NULL;
+
+-- Effective role of every user on every project they can access, either through
+-- direct membership or through the organization owning the project.
+CREATE VIEW project_roles AS
+SELECT DISTINCT ON (project, "user") project, "user", role
+FROM (
+	SELECT project, "user", role
+	FROM project_members
+	UNION ALL
+	SELECT projects.id, organization_members."user",
+		CASE organization_members.role
+			WHEN 'owner' THEN 'owner'
+			WHEN 'admin' THEN 'owner'
+			WHEN 'developer' THEN 'editor'
+			ELSE 'viewer'
+		END
+	FROM projects
+	JOIN organization_members ON organization_members.organization = projects.organization
+) roles
+ORDER BY project, "user", CASE role WHEN 'owner' THEN 0 WHEN 'editor' THEN 1 ELSE 2 END;
+
+-- Users allowed to manage a machine: the owner of its location, or developers
+-- of the organization owning the machine or its location.
+CREATE VIEW machine_managers AS
+SELECT machines.id AS machine, locations.owner AS "user"
+FROM machines
+JOIN locations ON machines.location = locations.id
+WHERE locations.owner IS NOT NULL
+UNION
+SELECT machines.id, organization_members."user"
+FROM machines
+JOIN locations ON machines.location = locations.id
+JOIN organization_members
+	ON organization_members.organization = COALESCE(machines.organization, locations.organization)
+WHERE organization_members.role IN ('owner', 'admin', 'developer');
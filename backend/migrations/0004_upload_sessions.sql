@@ -0,0 +1,17 @@
+CREATE TABLE upload_sessions (
+	id UUID PRIMARY KEY,
+	project BIGINT NOT NULL REFERENCES projects (id) ON DELETE CASCADE,
+	"user" UUID NOT NULL,
+	name TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	hash TEXT NOT NULL,
+	object TEXT NOT NULL,
+	upload_id TEXT NOT NULL,
+	received BIGINT NOT NULL DEFAULT 0,
+	hash_state BYTEA NOT NULL,
+	parts TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX upload_sessions_updated_at ON upload_sessions (updated_at);
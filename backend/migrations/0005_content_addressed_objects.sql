@@ -0,0 +1,19 @@
+-- Reference counts of stored objects. New assets are stored under a name
+-- derived from their SHA-256, so identical files share one object.
+CREATE TABLE objects (
+	name TEXT PRIMARY KEY,
+	refs INTEGER NOT NULL CHECK (refs >= 0),
+	stored BOOLEAN NOT NULL DEFAULT false,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE deployment_assets (
+	deployment BIGINT NOT NULL REFERENCES deployments (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	object TEXT NOT NULL,
+	PRIMARY KEY (deployment, name)
+);
+
+INSERT INTO objects (name, refs, stored)
+SELECT object, COUNT(*), true FROM project_assets GROUP BY object;
@@ -0,0 +1 @@
+ALTER TABLE objects ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,11 @@
+-- Content type detected when an object was uploaded. Objects stored before
+-- content sniffing have none.
+ALTER TABLE objects ADD COLUMN content_type TEXT;
+
+ALTER TABLE project_assets ADD COLUMN content_type TEXT NOT NULL DEFAULT 'application/octet-stream';
+ALTER TABLE deployment_assets ADD COLUMN content_type TEXT NOT NULL DEFAULT 'application/octet-stream';
+
+UPDATE project_assets SET content_type = 'application/wasm' WHERE name = 'main.wasm';
+UPDATE project_assets SET content_type = 'image/png' WHERE name LIKE '%.png';
+UPDATE deployment_assets SET content_type = 'application/wasm' WHERE name = 'main.wasm';
+UPDATE deployment_assets SET content_type = 'image/png' WHERE name LIKE '%.png';
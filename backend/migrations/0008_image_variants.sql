@@ -0,0 +1,12 @@
+-- Resized copies of images, such as editor thumbnails of prompt images and
+-- textures sent to machines in place of image assets.
+CREATE TABLE image_variants (
+	object TEXT NOT NULL,
+	variant TEXT NOT NULL,
+	variant_object TEXT NOT NULL UNIQUE,
+	width INTEGER NOT NULL,
+	height INTEGER NOT NULL,
+	size BIGINT NOT NULL,
+	hash TEXT NOT NULL,
+	PRIMARY KEY (object, variant)
+);
@@ -0,0 +1,17 @@
+-- Sizes of stored files, and who uploaded them, for storage quotas. Files
+-- uploaded before this migration are sized by backfillStorageSizes on startup.
+ALTER TABLE objects ADD COLUMN size BIGINT;
+
+ALTER TABLE project_assets ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE project_assets ADD COLUMN uploaded_by UUID REFERENCES auth.users (id) ON DELETE SET NULL;
+
+CREATE TABLE prompt_images (
+	object TEXT PRIMARY KEY,
+	project BIGINT NOT NULL REFERENCES projects (id) ON DELETE CASCADE,
+	uploaded_by UUID REFERENCES auth.users (id) ON DELETE SET NULL,
+	size BIGINT NOT NULL
+);
+
+CREATE INDEX project_assets_uploaded_by ON project_assets (uploaded_by);
+CREATE INDEX prompt_images_project ON prompt_images (project);
+CREATE INDEX prompt_images_uploaded_by ON prompt_images (uploaded_by);
@@ -0,0 +1,4 @@
+-- Projects flagged as templates can be instantiated by any developer.
+ALTER TABLE projects ADD COLUMN is_template BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX projects_is_template ON projects (id) WHERE is_template;
@@ -0,0 +1,16 @@
+-- Every C++ source compiled for a project, whether generated or written by
+-- hand, along with how it was produced and the result of compiling it.
+CREATE TABLE project_sources (
+	project BIGINT NOT NULL REFERENCES projects (id) ON DELETE CASCADE,
+	version INTEGER NOT NULL,
+	source TEXT NOT NULL,
+	origin TEXT NOT NULL CHECK (origin IN ('generated', 'edited', 'imported')),
+	prompt TEXT NOT NULL DEFAULT '',
+	model TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL CHECK (status IN ('success', 'compile_error', 'internal_error')),
+	compile_output TEXT NOT NULL DEFAULT '',
+	wasm_hash TEXT,
+	created_by UUID REFERENCES auth.users (id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (project, version)
+);
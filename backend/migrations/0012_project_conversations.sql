@@ -0,0 +1,11 @@
+-- The conversation with the model that produced a project's current source,
+-- so that follow-up prompts can refer to earlier ones.
+CREATE TABLE project_conversation_messages (
+	id BIGSERIAL PRIMARY KEY,
+	project BIGINT NOT NULL REFERENCES projects (id) ON DELETE CASCADE,
+	role TEXT NOT NULL CHECK (role IN ('user', 'assistant')),
+	content TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX project_conversation_messages_project ON project_conversation_messages (project, id);
@@ -0,0 +1,8 @@
+-- Imported source is stored without compiling it, so it must not claim to
+-- have built the project's main.wasm.
+ALTER TABLE project_sources DROP CONSTRAINT project_sources_status_check;
+ALTER TABLE project_sources ADD CONSTRAINT project_sources_status_check
+	CHECK (status IN ('success', 'compile_error', 'internal_error', 'uncompiled'));
+
+UPDATE project_sources SET status = 'uncompiled', wasm_hash = NULL
+WHERE origin = 'imported' AND status = 'success';
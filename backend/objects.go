@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// assetObjectName returns the content-addressed object name for a SHA-256.
+func assetObjectName(hash string) string {
+	return "sha256/" + hash
+}
+
+// ObjectState describes an object's contents as recorded when it was stored.
+// ContentType and Size are unknown for objects stored before they were
+// recorded, and such objects must be uploaded again to be checked.
+type ObjectState struct {
+	Stored      bool
+	ContentType string
+	Size        int64
+}
+
+// acquireObject adds a reference to an object and reports whether its contents
+// are already in the store. If they aren't, the caller must upload them and
+// call markObjectStored. Since names are derived from contents, concurrent
+// uploads of the same object are harmless.
+func (s *Server) acquireObject(name string) (ObjectState, error) {
+	query := `
+		INSERT INTO objects (name, refs) VALUES ($1, 1)
+		ON CONFLICT (name) DO UPDATE SET refs = objects.refs + 1, updated_at = now()
+		RETURNING stored, COALESCE(content_type, ''), COALESCE(size, 0)
+	`
+
+	var state ObjectState
+	if err := s.db.QueryRow(query, name).Scan(&state.Stored, &state.ContentType, &state.Size); err != nil {
+		return ObjectState{}, fmt.Errorf("failed to acquire object: %w", err)
+	}
+
+	return state, nil
+}
+
+// canReuseObject reports whether a user may add a stored object to a project
+// without uploading it, which is only the case if it is already an asset of a
+// project they have access to. Asset hashes are visible to every viewer, so
+// knowing one mustn't be enough to get a copy of the object.
+func (s *Server) canReuseObject(userID, name string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM project_assets
+			JOIN project_roles ON project_roles.project = project_assets.project
+			WHERE project_assets.object = $1 AND project_roles."user" = $2
+		)
+	`
+
+	var ok bool
+	if err := s.db.QueryRow(query, name, userID).Scan(&ok); err != nil {
+		return false, fmt.Errorf("failed to check object access: %w", err)
+	}
+
+	return ok, nil
+}
+
+func (s *Server) markObjectStored(name, contentType string, size int64) error {
+	query := "UPDATE objects SET stored = true, content_type = $2, size = $3 WHERE name = $1"
+	if _, err := s.db.Exec(query, name, contentType, size); err != nil {
+		return fmt.Errorf("failed to mark object stored: %w", err)
+	}
+
+	return nil
+}
+
+// dropObjectRefs removes references to objects as part of a larger
+// transaction. Once it commits, pass the names to deleteUnreferencedObjects.
+func dropObjectRefs(tx *sql.Tx, names []string) error {
+	for _, name := range names {
+		if _, err := tx.Exec("UPDATE objects SET refs = refs - 1 WHERE name = $1", name); err != nil {
+			return fmt.Errorf("failed to release object: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// releaseObjects removes references to objects and deletes those that are no
+// longer referenced.
+func (s *Server) releaseObjects(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("failed to begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := dropObjectRefs(tx, names); err != nil {
+		log.Printf("failed to release objects: %v", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("failed to commit transaction: %v", err)
+		return
+	}
+
+	s.deleteUnreferencedObjects(names)
+}
+
+// deleteUnreferencedObjects removes objects without references from the store.
+// The row lock is held until the object is gone, so a concurrent
+// acquireObject either keeps the object alive or starts over with an upload.
+func (s *Server) deleteUnreferencedObjects(names []string) {
+	for _, name := range names {
+		if err := s.deleteIfUnreferenced(name); err != nil {
+			log.Printf("failed to delete object %s: %v", name, err)
+		}
+	}
+}
+
+func (s *Server) deleteIfUnreferenced(name string) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var refs int
+	err = tx.QueryRow("SELECT refs FROM objects WHERE name = $1 FOR UPDATE", name).Scan(&refs)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	if err := s.deleteObject(name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM objects WHERE name = $1", name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
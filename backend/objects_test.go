@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReleaseObjects(t *testing.T) {
+	server, mock, store := newTestServer(t)
+
+	for _, name := range []string{"sha256/shared", "sha256/unused"} {
+		if err := UploadBuffer(store, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE objects SET refs = refs - 1").WithArgs("sha256/shared").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE objects SET refs = refs - 1").WithArgs("sha256/unused").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// An object that is still referenced elsewhere is kept
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT refs FROM objects").WithArgs("sha256/shared").
+		WillReturnRows(sqlmock.NewRows([]string{"refs"}).AddRow(1))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT refs FROM objects").WithArgs("sha256/unused").
+		WillReturnRows(sqlmock.NewRows([]string{"refs"}).AddRow(0))
+	mock.ExpectExec("DELETE FROM prompt_images").WithArgs("sha256/unused").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("DELETE FROM image_variants").WithArgs("sha256/unused").
+		WillReturnRows(sqlmock.NewRows([]string{"variant_object"}))
+	mock.ExpectExec("DELETE FROM objects").WithArgs("sha256/unused").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	server.releaseObjects([]string{"sha256/shared", "sha256/unused"})
+
+	if _, ok := store.Get("sha256/shared"); !ok {
+		t.Error("referenced object was deleted")
+	}
+
+	if _, ok := store.Get("sha256/unused"); ok {
+		t.Error("unreferenced object was kept")
+	}
+}
+
+func TestAcquireObject(t *testing.T) {
+	server, mock, _ := newTestServer(t)
+
+	mock.ExpectQuery("INSERT INTO objects").WithArgs("sha256/new").
+		WillReturnRows(sqlmock.NewRows([]string{"stored", "content_type", "size"}).AddRow(false, "", 0))
+	mock.ExpectQuery("INSERT INTO objects").WithArgs("sha256/stored").
+		WillReturnRows(sqlmock.NewRows([]string{"stored", "content_type", "size"}).AddRow(true, "image/png", 42))
+
+	state, err := server.acquireObject("sha256/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Stored {
+		t.Errorf("new object reported as stored: %+v", state)
+	}
+
+	state, err = server.acquireObject("sha256/stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state != (ObjectState{Stored: true, ContentType: "image/png", Size: 42}) {
+		t.Errorf("got %+v", state)
+	}
+}
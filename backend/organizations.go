@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type OrganizationRole string
+
+const (
+	OrgRoleOwner     OrganizationRole = "owner"
+	OrgRoleAdmin     OrganizationRole = "admin"
+	OrgRoleDeveloper OrganizationRole = "developer"
+	OrgRoleMember    OrganizationRole = "member"
+)
+
+func (r OrganizationRole) Valid() bool {
+	return r == OrgRoleOwner || r == OrgRoleAdmin || r == OrgRoleDeveloper || r == OrgRoleMember
+}
+
+func (r OrganizationRole) CanManage() bool {
+	return r == OrgRoleOwner || r == OrgRoleAdmin
+}
+
+type Organization struct {
+	ID   int64            `json:"id"`
+	Name string           `json:"name"`
+	Role OrganizationRole `json:"role"`
+}
+
+type OrganizationMember struct {
+	UserID string           `json:"user_id"`
+	Email  string           `json:"email"`
+	Role   OrganizationRole `json:"role"`
+}
+
+var errLastOrganizationOwner = errors.New("organization must have at least one owner")
+
+// GetOrganizationRole returns the role a user has in an organization, or an
+// empty role if they are not a member.
+func (s *Server) GetOrganizationRole(organizationID int64, userID string) (OrganizationRole, error) {
+	query := `SELECT role FROM organization_members WHERE organization = $1 AND "user" = $2`
+
+	var role OrganizationRole
+	err := s.db.QueryRow(query, organizationID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get organization role: %w", err)
+	}
+
+	return role, nil
+}
+
+func (s *Server) getOrganizationMembers(organizationID int64) ([]OrganizationMember, error) {
+	query := `
+		SELECT organization_members."user", COALESCE(users.email, ''), organization_members.role
+		FROM organization_members
+		LEFT JOIN auth.users ON users.id = organization_members."user"
+		WHERE organization_members.organization = $1
+		ORDER BY organization_members.role, users.email
+	`
+
+	rows, err := s.db.Query(query, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []OrganizationMember{}
+	for rows.Next() {
+		var member OrganizationMember
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// setOrganizationMember adds a user to an organization or changes their role.
+// An organization can never be left without an owner.
+func (s *Server) setOrganizationMember(organizationID int64, userID string, role OrganizationRole) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO organization_members (organization, "user", role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (organization, "user") DO UPDATE SET role = $3
+	`
+	if _, err := tx.Exec(query, organizationID, userID, role); err != nil {
+		return fmt.Errorf("failed to set member: %w", err)
+	}
+
+	if err := ensureOrganizationOwner(tx, organizationID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Server) removeOrganizationMember(organizationID int64, userID string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM organization_members WHERE organization = $1 AND "user" = $2`
+	result, err := tx.Exec(query, organizationID, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove member: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return false, nil
+	}
+
+	if err := ensureOrganizationOwner(tx, organizationID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func ensureOrganizationOwner(tx *sql.Tx, organizationID int64) error {
+	query := `SELECT EXISTS (SELECT 1 FROM organization_members WHERE organization = $1 AND role = 'owner')`
+
+	var hasOwner bool
+	if err := tx.QueryRow(query, organizationID).Scan(&hasOwner); err != nil {
+		return fmt.Errorf("failed to check organization owner: %w", err)
+	}
+
+	if !hasOwner {
+		return errLastOrganizationOwner
+	}
+
+	return nil
+}
+
+func (s *Server) handleOrganizations(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+
+	switch r.Method {
+	case "GET":
+		query := `
+			SELECT organizations.id, organizations.name, organization_members.role
+			FROM organizations
+			JOIN organization_members ON organization_members.organization = organizations.id
+			WHERE organization_members."user" = $1
+		`
+		rows, err := s.db.Query(query, user.ID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		organizations := []Organization{}
+		for rows.Next() {
+			var organization Organization
+			if err := rows.Scan(&organization.ID, &organization.Name, &organization.Role); err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			organizations = append(organizations, organization)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(organizations)
+
+	case "POST":
+		var request struct {
+			Name string `json:"name"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		if request.Name == "" {
+			http.Error(w, "Name required", http.StatusBadRequest)
+			return
+		}
+
+		if len(request.Name) > 255 {
+			http.Error(w, "Name too long", http.StatusBadRequest)
+			return
+		}
+
+		// Like projects, organizations may only be created by developers
+		query := `
+			WITH new_organization AS (
+				INSERT INTO organizations (name)
+				SELECT $1
+				WHERE EXISTS (SELECT 1 FROM roles WHERE "user" = $2 AND role = 'developer')
+				RETURNING id
+			)
+			INSERT INTO organization_members (organization, "user", role)
+			SELECT id, $2, 'owner' FROM new_organization
+			RETURNING organization
+		`
+
+		var organizationId int64
+		err := s.db.QueryRow(query, request.Name, user.ID).Scan(&organizationId)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to create organization: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"id": organizationId})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+func (s *Server) handleOrganizationMembers(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+
+	organizationId, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	role, err := s.GetOrganizationRole(organizationId, user.ID)
+	if err != nil {
+		log.Printf("failed to get organization role: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if role == "" {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		members, err := s.getOrganizationMembers(organizationId)
+		if err != nil {
+			log.Printf("failed to get organization members: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+
+	case "POST":
+		if !role.CanManage() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			Email string           `json:"email"`
+			Role  OrganizationRole `json:"role"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		if !request.Role.Valid() {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+
+		// Only owners may hand out or take away ownership
+		if role != OrgRoleOwner && request.Role == OrgRoleOwner {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		invitedId, err := s.findUserByEmail(request.Email)
+		if err != nil {
+			log.Printf("failed to look up user: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if invitedId == "" {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		if role != OrgRoleOwner {
+			invitedRole, err := s.GetOrganizationRole(organizationId, invitedId)
+			if err != nil {
+				log.Printf("failed to get organization role: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if invitedRole == OrgRoleOwner {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		err = s.setOrganizationMember(organizationId, invitedId, request.Role)
+		if err == errLastOrganizationOwner {
+			http.Error(w, "Organization must have an owner", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Printf("failed to set organization member: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+
+	case "DELETE":
+		memberId := r.URL.Query().Get("user")
+		if memberId == "" {
+			http.Error(w, "User ID required", http.StatusBadRequest)
+			return
+		}
+
+		// Anyone can leave an organization, only admins can remove others
+		if memberId != user.ID {
+			if !role.CanManage() {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			memberRole, err := s.GetOrganizationRole(organizationId, memberId)
+			if err != nil {
+				log.Printf("failed to get organization role: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if memberRole == OrgRoleOwner && role != OrgRoleOwner {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		removed, err := s.removeOrganizationMember(organizationId, memberId)
+		if err == errLastOrganizationOwner {
+			http.Error(w, "Organization must have an owner", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Printf("failed to remove organization member: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !removed {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
@@ -0,0 +1,26 @@
+package protocol
+
+// M2SRequestAssetUrls asks for fresh URLs to assets in the manifest, for
+// example after a download outlived its URL.
+type M2SRequestAssetUrls struct {
+	Names []string
+}
+
+const M2SRequestAssetUrlsId = 0
+
+func (packet *M2SRequestAssetUrls) Unmarshal(reader *PacketReader) error {
+	count, err := reader.U16()
+	if err != nil {
+		return err
+	}
+
+	packet.Names = make([]string, count)
+	for i := 0; i < int(count); i++ {
+		packet.Names[i], err = reader.String()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestM2SRequestAssetUrlsUnmarshal(t *testing.T) {
+	packet := NewPacket()
+	packet.U16(2)
+	packet.String("main.wasm")
+	packet.String("textures/wall.png")
+	data := packet.ToBuffer()
+
+	var request M2SRequestAssetUrls
+	if err := request.Unmarshal(NewPacketReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(request.Names, []string{"main.wasm", "textures/wall.png"}) {
+		t.Errorf("got names %q", request.Names)
+	}
+
+	// Packets that end before all names are read are rejected
+	for length := range len(data) {
+		if err := new(M2SRequestAssetUrls).Unmarshal(NewPacketReader(data[:length])); err == nil {
+			t.Errorf("accepted a packet truncated to %d bytes", length)
+		}
+	}
+}
@@ -20,6 +20,14 @@ func (p *Packet) U8(value uint8) {
 	p.buffer.WriteByte(value)
 }
 
+func (p *Packet) U16(value uint16) {
+	binary.Write(p.buffer, binary.BigEndian, value)
+}
+
+func (p *Packet) U64(value uint64) {
+	binary.Write(p.buffer, binary.BigEndian, value)
+}
+
 func (p *Packet) String(value string) {
 	data := []byte(value)
 	binary.Write(p.buffer, binary.BigEndian, uint16(len(data)))
@@ -80,3 +88,27 @@ func (pr *PacketReader) DynBytes(limit uint32) ([]byte, error) {
 	pr.offset += int(length)
 	return value, nil
 }
+
+func (pr *PacketReader) U16() (uint16, error) {
+	if pr.offset+2 > len(pr.data) {
+		return 0, fmt.Errorf("not enough data for uint16")
+	}
+	value := binary.BigEndian.Uint16(pr.data[pr.offset : pr.offset+2])
+	pr.offset += 2
+	return value, nil
+}
+
+func (pr *PacketReader) String() (string, error) {
+	length, err := pr.U16()
+	if err != nil {
+		return "", err
+	}
+
+	if pr.offset+int(length) > len(pr.data) {
+		return "", fmt.Errorf("not enough data for string")
+	}
+
+	value := string(pr.data[pr.offset : pr.offset+int(length)])
+	pr.offset += int(length)
+	return value, nil
+}
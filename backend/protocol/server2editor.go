@@ -8,6 +8,18 @@ func S2EInitScene(scene string) []byte {
 	return []byte("scene|" + scene)
 }
 
+func S2EProjectRole(role string) []byte {
+	return []byte("role|" + role)
+}
+
+func S2ESceneRevision(revision int64) []byte {
+	return []byte(fmt.Sprintf("revision|%d", revision))
+}
+
+func S2EError(message string) []byte {
+	return []byte("error|" + message)
+}
+
 func S2EMachineOnline(machineID int, online bool) []byte {
 	return []byte(fmt.Sprintf("machineonline|%d|%t", machineID, online))
 }
@@ -1,15 +1,52 @@
 package protocol
 
-func S2MInitAssets(programUrl string, programHash []byte, imageNames []string, imageUrls []string, imageHashes [][]byte) []byte {
+type ManifestEntry struct {
+	Name        string
+	Size        int64
+	Hash        []byte
+	ContentType string
+	// URL is not part of the signed manifest since it expires
+	URL string
+}
+
+// EncodeManifest encodes the list of files a machine should have. Machines
+// verify its signature, then check each download against its size and hash
+// and skip files they already have.
+func EncodeManifest(deploymentID int64, entries []ManifestEntry) []byte {
+	packet := NewPacket()
+	packet.U64(uint64(deploymentID))
+	packet.U16(uint16(len(entries)))
+	for _, entry := range entries {
+		packet.String(entry.Name)
+		packet.U64(uint64(entry.Size))
+		packet.FixedBytes(entry.Hash)
+		packet.String(entry.ContentType)
+	}
+
+	return packet.ToBuffer()
+}
+
+func S2MInitAssets(manifest []byte, signature []byte, entries []ManifestEntry) []byte {
 	packet := NewPacket()
 	packet.U8(0)
-	packet.String(programUrl)
-	packet.FixedBytes(programHash)
-	packet.U8(uint8(len(imageNames)))
-	for i := 0; i < len(imageNames); i++ {
-		packet.String(imageNames[i])
-		packet.String(imageUrls[i])
-		packet.FixedBytes(imageHashes[i])
+	packet.Bytes(manifest)
+	packet.FixedBytes(signature)
+	for _, entry := range entries {
+		packet.String(entry.URL)
+	}
+
+	return packet.ToBuffer()
+}
+
+// S2MAssetUrls answers M2SRequestAssetUrls. Names that aren't in the manifest
+// are left out.
+func S2MAssetUrls(names []string, urls []string) []byte {
+	packet := NewPacket()
+	packet.U8(1)
+	packet.U16(uint16(len(names)))
+	for i := 0; i < len(names); i++ {
+		packet.String(names[i])
+		packet.String(urls[i])
 	}
 
 	return packet.ToBuffer()
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// StorageQuotas limits the bytes of project assets, their image variants and
+// prompt images stored per project and per uploading user. A quota of 0 is
+// unlimited.
+type StorageQuotas struct {
+	Project int64
+	User    int64
+}
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// NewStorageQuotas reads PROJECT_STORAGE_QUOTA and USER_STORAGE_QUOTA in
+// bytes, defaulting to 1 GiB per project and 5 GiB per user.
+func NewStorageQuotas(getenv func(string) string) (StorageQuotas, error) {
+	project, err := parseQuota(getenv("PROJECT_STORAGE_QUOTA"), 1024*1024*1024)
+	if err != nil {
+		return StorageQuotas{}, fmt.Errorf("invalid PROJECT_STORAGE_QUOTA: %w", err)
+	}
+
+	user, err := parseQuota(getenv("USER_STORAGE_QUOTA"), 5*1024*1024*1024)
+	if err != nil {
+		return StorageQuotas{}, fmt.Errorf("invalid USER_STORAGE_QUOTA: %w", err)
+	}
+
+	return StorageQuotas{Project: project, User: user}, nil
+}
+
+func parseQuota(value string, fallback int64) (int64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	quota, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if quota < 0 {
+		return 0, errors.New("quota must not be negative")
+	}
+
+	return quota, nil
+}
+
+// rowQuerier is implemented by *sql.DB and *sql.Tx, so usage can be read both
+// outside and inside the transaction that changes it.
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func projectStorageUsage(db rowQuerier, projectID int64) (int64, error) {
+	query := `
+		SELECT
+			(SELECT COALESCE(SUM(size), 0) FROM project_assets WHERE project = $1) +
+			(SELECT COALESCE(SUM(v.size), 0) FROM project_assets a
+				JOIN image_variants v ON v.object = a.object WHERE a.project = $1) +
+			(SELECT COALESCE(SUM(size), 0) FROM prompt_images WHERE project = $1)
+	`
+
+	var usage int64
+	if err := db.QueryRow(query, projectID).Scan(&usage); err != nil {
+		return 0, fmt.Errorf("failed to get project storage usage: %w", err)
+	}
+
+	return usage, nil
+}
+
+func userStorageUsage(db rowQuerier, userID string) (int64, error) {
+	query := `
+		SELECT
+			(SELECT COALESCE(SUM(size), 0) FROM project_assets WHERE uploaded_by = $1) +
+			(SELECT COALESCE(SUM(v.size), 0) FROM project_assets a
+				JOIN image_variants v ON v.object = a.object WHERE a.uploaded_by = $1) +
+			(SELECT COALESCE(SUM(size), 0) FROM prompt_images WHERE uploaded_by = $1)
+	`
+
+	var usage int64
+	if err := db.QueryRow(query, userID).Scan(&usage); err != nil {
+		return 0, fmt.Errorf("failed to get user storage usage: %w", err)
+	}
+
+	return usage, nil
+}
+
+// storageBudget returns how many more bytes a user may store in a project
+// after usage changes by projectDelta and userDelta bytes respectively. The
+// result is negative if the change alone exceeds a quota. It is only an
+// estimate for rejecting uploads early, since usage may change before they
+// are recorded; the rows are checked again by checkStorageQuotas.
+func (s *Server) storageBudget(projectID int64, userID string, projectDelta, userDelta int64) (int64, error) {
+	budget := int64(math.MaxInt64)
+
+	if s.quotas.Project > 0 {
+		usage, err := projectStorageUsage(s.db, projectID)
+		if err != nil {
+			return 0, err
+		}
+		budget = min(budget, s.quotas.Project-usage-projectDelta)
+	}
+
+	if s.quotas.User > 0 {
+		usage, err := userStorageUsage(s.db, userID)
+		if err != nil {
+			return 0, err
+		}
+		budget = min(budget, s.quotas.User-usage-userDelta)
+	}
+
+	return budget, nil
+}
+
+// lockStorageUsage serializes changes to the storage used by a project and by
+// a user until tx ends, so that each change is checked against the usage left
+// behind by the ones before it. It must be called before tx writes any rows
+// that count towards the quotas, and always locks the project first.
+func (s *Server) lockStorageUsage(tx *sql.Tx, projectID int64, userID string) error {
+	if s.quotas.Project > 0 {
+		if _, err := tx.Exec("SELECT id FROM projects WHERE id = $1 FOR UPDATE", projectID); err != nil {
+			return fmt.Errorf("failed to lock project storage: %w", err)
+		}
+	}
+
+	// Users have no row of their own to lock
+	if s.quotas.User > 0 {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('storage:' || $1))", userID); err != nil {
+			return fmt.Errorf("failed to lock user storage: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// checkStorageQuotas returns ErrQuotaExceeded if the rows written by tx, which
+// holds lockStorageUsage, take the project or the user over their quota.
+func (s *Server) checkStorageQuotas(tx *sql.Tx, projectID int64, userID string) error {
+	if s.quotas.Project > 0 {
+		usage, err := projectStorageUsage(tx, projectID)
+		if err != nil {
+			return err
+		}
+
+		if usage > s.quotas.Project {
+			return ErrQuotaExceeded
+		}
+	}
+
+	if s.quotas.User > 0 {
+		usage, err := userStorageUsage(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		if usage > s.quotas.User {
+			return ErrQuotaExceeded
+		}
+	}
+
+	return nil
+}
+
+// backfillStorageSizes records the sizes of files stored before quotas were
+// introduced, which would otherwise count as empty. Prompt images of that time
+// have no prompt_images row, so one is added with an unknown uploader.
+func (s *Server) backfillStorageSizes() {
+	rows, err := s.db.Query("SELECT name FROM objects WHERE stored AND size IS NULL")
+	if err != nil {
+		log.Printf("failed to get objects without sizes: %v", err)
+		return
+	}
+
+	unsized := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Printf("failed to get objects without sizes: %v", err)
+			rows.Close()
+			return
+		}
+		unsized = append(unsized, name)
+	}
+	rows.Close()
+
+	for _, name := range unsized {
+		info, err := s.store.Stat(name)
+		if err != nil {
+			log.Printf("failed to get size of %s: %v", name, err)
+			continue
+		}
+
+		if _, err := s.db.Exec("UPDATE objects SET size = $2 WHERE name = $1 AND size IS NULL", name, info.Size); err != nil {
+			log.Printf("failed to record size of %s: %v", name, err)
+		}
+	}
+
+	query := `
+		UPDATE project_assets SET size = objects.size
+		FROM objects
+		WHERE objects.name = project_assets.object AND project_assets.size = 0 AND objects.size > 0
+	`
+	if _, err := s.db.Exec(query); err != nil {
+		log.Printf("failed to backfill asset sizes: %v", err)
+	}
+
+	sceneRows, err := s.db.Query(`
+		SELECT id, scene FROM projects
+		WHERE scene LIKE '%promptImages%'
+	`)
+	if err != nil {
+		log.Printf("failed to get scenes: %v", err)
+		return
+	}
+
+	images := map[string]int64{}
+	for sceneRows.Next() {
+		var projectID int64
+		var scene string
+		if err := sceneRows.Scan(&projectID, &scene); err != nil {
+			log.Printf("failed to get scenes: %v", err)
+			sceneRows.Close()
+			return
+		}
+
+		for _, image := range promptImagesOf(scene) {
+			images[image] = projectID
+		}
+	}
+	sceneRows.Close()
+
+	for image, projectID := range images {
+		var recorded bool
+		if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM prompt_images WHERE object = $1)", image).Scan(&recorded); err != nil {
+			log.Printf("failed to check prompt image %s: %v", image, err)
+			continue
+		}
+
+		if recorded {
+			continue
+		}
+
+		size, err := s.promptImageSize(image)
+		if err != nil {
+			log.Printf("failed to get size of prompt image %s: %v", image, err)
+			continue
+		}
+
+		query := "INSERT INTO prompt_images (object, project, size) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+		if _, err := s.db.Exec(query, image, projectID, size); err != nil {
+			log.Printf("failed to record prompt image %s: %v", image, err)
+		}
+	}
+}
+
+// promptImageSize returns the stored size of a prompt image and its thumbnail.
+func (s *Server) promptImageSize(image string) (int64, error) {
+	info, err := s.store.Stat(image)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size
+
+	thumbnail, err := s.imageVariantObject(image, thumbnailVariant)
+	if err != nil {
+		return 0, err
+	}
+
+	if thumbnail != image {
+		info, err := s.store.Stat(thumbnail)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size
+	}
+
+	return size, nil
+}
+
+type storageUsage struct {
+	Used int64 `json:"used"`
+	// Quota is 0 if unlimited
+	Quota int64 `json:"quota"`
+}
+
+// handleStorageUsage reports the storage used by a project and by the caller
+// across all projects.
+func (s *Server) handleStorageUsage(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	projectUsage, err := projectStorageUsage(s.db, project.ID)
+	if err != nil {
+		log.Printf("failed to get storage usage: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	userUsage, err := userStorageUsage(s.db, user.ID)
+	if err != nil {
+		log.Printf("failed to get storage usage: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]storageUsage{
+		"project": {Used: projectUsage, Quota: s.quotas.Project},
+		"user":    {Used: userUsage, Quota: s.quotas.User},
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPutAssetReservesQuota(t *testing.T) {
+	tests := []struct {
+		name        string
+		projectUsed int64
+		userUsed    int64
+		wantErr     error
+	}{
+		{"within quotas", 900, 900, nil},
+		{"project full", 1001, 900, ErrQuotaExceeded},
+		{"user full", 900, 2001, ErrQuotaExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, _ := newTestServer(t)
+			server.quotas = StorageQuotas{Project: 1000, User: 2000}
+
+			// Usage is locked before the asset is written and checked after, in
+			// the same transaction
+			mock.ExpectBegin()
+			mock.ExpectExec("SELECT id FROM projects WHERE id = \\$1 FOR UPDATE").WithArgs(int64(1)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("pg_advisory_xact_lock").WithArgs("user-1").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery("SELECT object FROM project_assets").WillReturnError(sql.ErrNoRows)
+			mock.ExpectExec("INSERT INTO project_assets").WillReturnResult(sqlmock.NewResult(0, 1))
+			// Image variants of assets count toward both quotas
+			mock.ExpectQuery("JOIN image_variants v ON v.object = a.object WHERE a.project = \\$1").WithArgs(int64(1)).
+				WillReturnRows(sqlmock.NewRows([]string{"usage"}).AddRow(test.projectUsed))
+			if test.projectUsed <= 1000 {
+				mock.ExpectQuery("JOIN image_variants v ON v.object = a.object WHERE a.uploaded_by = \\$1").WithArgs("user-1").
+					WillReturnRows(sqlmock.NewRows([]string{"usage"}).AddRow(test.userUsed))
+			}
+
+			if test.wantErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			asset := Asset{Hash: "hash", Object: "sha256/hash", ContentType: "image/png", Size: 100}
+			err := server.putAsset(context.Background(), 1, "user-1", "image.png", asset)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
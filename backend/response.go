@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrMalformedResponse is returned when a model's reply doesn't contain a
+// usable program.
+var ErrMalformedResponse = errors.New("malformed response")
+
+// formatError is an ErrMalformedResponse with a complaint addressed to the
+// model, telling it how to fix its reply.
+type formatError struct {
+	complaint string
+}
+
+func (e *formatError) Error() string {
+	return ErrMalformedResponse.Error() + ": " + e.complaint
+}
+
+func (e *formatError) Unwrap() error {
+	return ErrMalformedResponse
+}
+
+// codeBlock is a fenced block in a model's reply.
+type codeBlock struct {
+	language string
+	code     string
+	// closed is false if the reply ended inside the block
+	closed bool
+}
+
+// cppLanguages are the info strings a C++ block may be tagged with. Untagged
+// blocks are assumed to be C++ too.
+var cppLanguages = map[string]bool{
+	"":          true,
+	"c":         true,
+	"c++":       true,
+	"cc":        true,
+	"cpp":       true,
+	"cplusplus": true,
+	"cxx":       true,
+	"h":         true,
+	"hpp":       true,
+}
+
+var fencePattern = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)")
+
+// fencedBlocks returns the fenced code blocks in Markdown text. A block is
+// closed by a fence of the same character at least as long as the one that
+// opened it, so blocks may contain shorter fences.
+func fencedBlocks(text string) []codeBlock {
+	var blocks []codeBlock
+	var current *codeBlock
+	var fence string
+	var lines []string
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		match := fencePattern.FindStringSubmatch(line)
+
+		if current == nil {
+			if match != nil {
+				current = &codeBlock{language: strings.ToLower(match[2])}
+				fence = match[1]
+				lines = nil
+			}
+			continue
+		}
+
+		closing := strings.TrimSpace(line)
+		if match != nil && match[2] == "" && closing[0] == fence[0] && len(closing) >= len(fence) && strings.Trim(closing, closing[:1]) == "" {
+			current.code = strings.Join(lines, "\n")
+			current.closed = true
+			blocks = append(blocks, *current)
+			current = nil
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	if current != nil {
+		current.code = strings.Join(lines, "\n")
+		blocks = append(blocks, *current)
+	}
+
+	return blocks
+}
+
+var (
+	gameClassPattern  = regexp.MustCompile(`\b(?:class|struct)\s+Game\b[^;{]*\{`)
+	templateIncludes  = regexp.MustCompile(`(?m)^\s*#\s*include\s*"simulo__(?:pre|post)\.h"\s*$`)
+	templateClassDefs = regexp.MustCompile(`(?m)^class\s+(\w+)\b[^;{]*\{`)
+	templateFuncDefs  = regexp.MustCompile(`(?m)^[\w:<>]+\s+(\w+)\([^;{]*\)\s*\{`)
+	templateVarDefs   = regexp.MustCompile(`(?m)^static\s+[\w:]+\s+(\w+)\s*;`)
+)
+
+// templateSymbol is a name defined by simulo__pre.h along with a pattern
+// matching a redefinition of it.
+type templateSymbol struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// templateSymbols are the classes, functions and variables defined by the
+// template header, which generated code must use rather than redefine.
+var templateSymbols = templateSymbolsOf(templateHeader)
+
+func templateSymbolsOf(header string) []templateSymbol {
+	symbols := []templateSymbol{}
+	for _, match := range templateClassDefs.FindAllStringSubmatch(header, -1) {
+		pattern := fmt.Sprintf(`\b(?:class|struct)\s+%s\b[^;{]*\{`, match[1])
+		symbols = append(symbols, templateSymbol{match[1], regexp.MustCompile(pattern)})
+	}
+
+	for _, match := range templateFuncDefs.FindAllStringSubmatch(header, -1) {
+		pattern := fmt.Sprintf(`(?m)^[\w:<>]+\s+%s\s*\([^;{]*\)\s*\{`, match[1])
+		symbols = append(symbols, templateSymbol{match[1], regexp.MustCompile(pattern)})
+	}
+
+	for _, match := range templateVarDefs.FindAllStringSubmatch(header, -1) {
+		pattern := fmt.Sprintf(`(?m)^\s*(?:static\s+)?[\w:]+\s+%s\s*[;=]`, match[1])
+		symbols = append(symbols, templateSymbol{match[1], regexp.MustCompile(pattern)})
+	}
+
+	// The runtime imports are declared by the header as well
+	return append(symbols, templateSymbol{
+		"simulo_* imports",
+		regexp.MustCompile(`__import_name__|\bextern\b[^;]*\bsimulo_\w+\s*\(`),
+	})
+}
+
+// redefinedSymbols returns the template symbols that code redefines.
+func redefinedSymbols(code string) []string {
+	var names []string
+	for _, symbol := range templateSymbols {
+		if symbol.pattern.MatchString(code) {
+			names = append(names, symbol.name)
+		}
+	}
+	return names
+}
+
+// parseResponse extracts the program from a model's reply. The program is the
+// last C++ block defining class Game, along with earlier blocks it depends on
+// if the model split it up. If there isn't one, the error explains to the model
+// what was wrong with its reply.
+func parseResponse(text string) (string, error) {
+	blocks := fencedBlocks(text)
+	if len(blocks) == 0 {
+		return "", &formatError{"Your reply didn't contain a code block. Reply with the complete program in a single ```cpp code block."}
+	}
+
+	candidates := []string{}
+	var redefined []string
+	for _, block := range blocks {
+		if !cppLanguages[block.language] {
+			continue
+		}
+
+		if !block.closed {
+			return "", &formatError{"Your reply ended before the code block was closed with ```. Reply with the complete program again, keeping it short enough to finish."}
+		}
+
+		code := templateIncludes.ReplaceAllString(block.code, "")
+		if names := redefinedSymbols(code); len(names) > 0 {
+			redefined = append(redefined, names...)
+			continue
+		}
+
+		candidates = append(candidates, code)
+	}
+
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if gameClassPattern.MatchString(candidates[i]) {
+			return withSupportingBlocks(candidates[:i], candidates[i]), nil
+		}
+	}
+
+	if len(redefined) > 0 {
+		return "", &formatError{fmt.Sprintf("Your code redefines %s, which the Simulo headers already provide and include automatically. Use them without declaring or defining them, and reply with the complete program in a single ```cpp code block.", strings.Join(redefined, ", "))}
+	}
+
+	if len(candidates) == 0 {
+		return "", &formatError{"Your reply had no C++ code block. Reply with the complete program in a single ```cpp code block."}
+	}
+
+	return "", &formatError{"Your code doesn't define the root class Game. Reply with the complete program, including class Game with its static create() function and on_pose method, in a single ```cpp code block."}
+}
+
+var typeDefinitionPattern = regexp.MustCompile(`\b(?:class|struct)\s+(\w+)\b[^;{]*\{`)
+
+// withSupportingBlocks prepends the blocks before the one defining Game that
+// define classes it uses but doesn't define itself. Other blocks, such as
+// snippets in explanations or earlier drafts of the program, are left out.
+func withSupportingBlocks(previous []string, game string) string {
+	defined := map[string]bool{}
+	for _, match := range typeDefinitionPattern.FindAllStringSubmatch(game, -1) {
+		defined[match[1]] = true
+	}
+
+	blocks := []string{game}
+	for i := len(previous) - 1; i >= 0; i-- {
+		if gameClassPattern.MatchString(previous[i]) {
+			break
+		}
+
+		needed := false
+		for _, match := range typeDefinitionPattern.FindAllStringSubmatch(previous[i], -1) {
+			name := match[1]
+			if !defined[name] && regexp.MustCompile(`\b`+name+`\b`).MatchString(game) {
+				needed = true
+			}
+			defined[name] = true
+		}
+
+		if needed {
+			blocks = append([]string{previous[i]}, blocks...)
+		}
+	}
+
+	return strings.Join(blocks, "\n\n")
+}
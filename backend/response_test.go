@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseResponse(t *testing.T) {
+	helper := "struct Ball {\n    float radius;\n};"
+	game := "class Game {\n    Ball ball;\n};"
+
+	tests := []struct {
+		name     string
+		reply    string
+		wantCode string
+		// wantComplaint is part of the complaint to the model, if the reply is
+		// malformed
+		wantComplaint string
+	}{
+		{"cpp", "```cpp\n" + game + "\n```", game, ""},
+		{"untagged", "Sure!\n```\n" + game + "\n```\nEnjoy.", game, ""},
+		{"tag case and spacing", "``` C++\n" + game + "\n```", game, ""},
+		{"tildes", "~~~cxx\n" + game + "\n~~~", game, ""},
+		{"indented fences", "   ```cpp\n" + game + "\n   ```", game, ""},
+		{"CRLF", strings.ReplaceAll("```cpp\n"+game+"\n```\n", "\n", "\r\n"), game, ""},
+		{"longer fence", "````cpp\n// ```\n" + game + "\n````", "// ```\n" + game, ""},
+		{"unclosed by another fence", "~~~cpp\n" + game + "\n```\n~~~", game + "\n```", ""},
+		{"template includes", "```cpp\n#include \"simulo__pre.h\"\n" + game + "\n```", "\n" + game, ""},
+		{"supporting block", "```cpp\n" + helper + "\n```\n\n```cpp\n" + game + "\n```", helper + "\n\n" + game, ""},
+		{"earlier draft", "```cpp\nclass Game {};\n```\n\n```cpp\n" + game + "\n```", game, ""},
+		{"other language", "```json\n{}\n```\n```cpp\n" + game + "\n```", game, ""},
+
+		{"no block", "class Game {};", "", "didn't contain a code block"},
+		{"only other languages", "```python\nprint()\n```", "", "no C++ code block"},
+		{"unclosed", "```cpp\n" + game, "", "ended before the code block was closed"},
+		{"no Game", "```cpp\n" + helper + "\n```", "", "doesn't define the root class Game"},
+		{"redefined header class", "```cpp\nclass Object {};\n" + game + "\n```", "", "redefines Object"},
+		{"redefined import", "```cpp\nextern \"C\" void simulo_set_root(int, void*);\n" + game + "\n```", "", "simulo_* imports"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, err := parseResponse(test.reply)
+			if test.wantComplaint == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if code != test.wantCode {
+					t.Errorf("got code %q, want %q", code, test.wantCode)
+				}
+				return
+			}
+
+			var formatErr *formatError
+			if !errors.As(err, &formatErr) || !errors.Is(err, ErrMalformedResponse) {
+				t.Fatalf("got code %q and error %v", code, err)
+			}
+
+			if !strings.Contains(formatErr.complaint, test.wantComplaint) {
+				t.Errorf("got complaint %q", formatErr.complaint)
+			}
+		})
+	}
+}
+
+func TestTemplateSymbols(t *testing.T) {
+	names := map[string]bool{}
+	for _, symbol := range templateSymbols {
+		names[symbol.name] = true
+	}
+
+	for _, name := range []string{"Pose", "Material", "Object", "RenderedObject", "window_size", "random_float", "kSolidTexture"} {
+		if !names[name] {
+			t.Errorf("%s isn't a template symbol", name)
+		}
+	}
+}
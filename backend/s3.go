@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"log"
-	"os"
-	"sync"
+	"io"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -19,10 +17,10 @@ type S3Client struct {
 	bucket string
 }
 
-func NewS3Client(endpoint, accessKeyID, secretAccessKey, bucket string) (*S3Client, error) {
+func NewS3Client(endpoint, accessKeyID, secretAccessKey, bucket string, secure bool) (*S3Client, error) {
 	minioClient, err := minio.New(endpoint, &minio.Options{
 		Creds:           credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure:          true,
+		Secure:          secure,
 		TrailingHeaders: true,
 	})
 	if err != nil {
@@ -35,23 +33,90 @@ func NewS3Client(endpoint, accessKeyID, secretAccessKey, bucket string) (*S3Clie
 	}, nil
 }
 
-func (s *S3Client) UploadFile(name, filePath string) error {
-	data, err := os.ReadFile(filePath)
+// Parts are buffered in memory when the object size is unknown, so keep them
+// small rather than letting minio size them for a 5 TiB object.
+const s3PartSize = 16 * 1024 * 1024
+
+func (s *S3Client) Upload(name string, reader io.Reader, size int64, hash []byte, contentType string) error {
+	// Multipart uploads only carry a checksum of part checksums, so the
+	// full-object hash is kept in metadata
+	_, err := s.client.PutObject(context.Background(), s.bucket, name, reader, size, minio.PutObjectOptions{
+		ContentType:  contentType,
+		Checksum:     minio.ChecksumSHA256,
+		PartSize:     s3PartSize,
+		UserMetadata: map[string]string{"Sha256": hex.EncodeToString(hash)},
+	})
+
 	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+		return fmt.Errorf("failed to upload file: %w", err)
 	}
 
-	return s.UploadBuffer(name, data)
+	return nil
+}
+
+func (s *S3Client) List(fn func(info ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list objects: %w", object.Err)
+		}
+
+		err := fn(ObjectInfo{
+			Name:         object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (s *S3Client) UploadBuffer(name string, data []byte) error {
-	_, err := s.client.PutObject(context.Background(), s.bucket, name, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
-		ContentType: "application/octet-stream",
-		Checksum:    minio.ChecksumSHA256,
+func (s *S3Client) CreateMultipartUpload(name string, hash []byte, contentType string) (string, error) {
+	core := minio.Core{Client: s.client}
+	uploadID, err := core.NewMultipartUpload(context.Background(), s.bucket, name, minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: map[string]string{"Sha256": hex.EncodeToString(hash)},
 	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
 
+	return uploadID, nil
+}
+
+func (s *S3Client) UploadPart(name, uploadID string, partNumber int, reader io.Reader, size int64) (string, error) {
+	core := minio.Core{Client: s.client}
+	part, err := core.PutObjectPart(context.Background(), s.bucket, name, uploadID, partNumber, reader, size, minio.PutObjectPartOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %w", err)
+		return "", fmt.Errorf("failed to upload part: %w", err)
+	}
+
+	return part.ETag, nil
+}
+
+func (s *S3Client) CompleteMultipartUpload(name, uploadID string, etags []string) error {
+	parts := make([]minio.CompletePart, len(etags))
+	for i, etag := range etags {
+		parts[i] = minio.CompletePart{PartNumber: i + 1, ETag: etag}
+	}
+
+	core := minio.Core{Client: s.client}
+	if _, err := core.CompleteMultipartUpload(context.Background(), s.bucket, name, uploadID, parts, minio.PutObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	return nil
+}
+
+func (s *S3Client) AbortMultipartUpload(name, uploadID string) error {
+	core := minio.Core{Client: s.client}
+	if err := core.AbortMultipartUpload(context.Background(), s.bucket, name, uploadID); err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
 	}
 
 	return nil
@@ -66,19 +131,19 @@ func (s *S3Client) Delete(name string) error {
 	return nil
 }
 
-func (s *S3Client) ParallelDelete(names []string) {
-	wg := sync.WaitGroup{}
-	for _, name := range names {
-		wg.Add(1)
-		go func(name string) {
-			defer wg.Done()
-			if err := s.Delete(name); err != nil {
-				log.Printf("failed to delete object: %v", err)
-			}
-		}(name)
+func (s *S3Client) Open(name string) (io.ReadSeekCloser, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object: %w", err)
 	}
 
-	wg.Wait()
+	// GetObject doesn't make a request until the first read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, fmt.Errorf("failed to open object: %w", err)
+	}
+
+	return object, nil
 }
 
 func (s *S3Client) PresignURL(name string, expiresIn time.Duration) (string, error) {
@@ -91,6 +156,15 @@ func (s *S3Client) PresignURL(name string, expiresIn time.Duration) (string, err
 }
 
 func (s *S3Client) GetHash(name string) ([]byte, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Hash, nil
+}
+
+func (s *S3Client) Stat(name string) (*ObjectInfo, error) {
 	info, err := s.client.StatObject(context.Background(), s.bucket, name, minio.StatObjectOptions{
 		Checksum: true,
 	})
@@ -98,7 +172,12 @@ func (s *S3Client) GetHash(name string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to get object metadata: %w", err)
 	}
 
-	hash, err := base64.StdEncoding.DecodeString(info.ChecksumSHA256)
+	var hash []byte
+	if metadataHash, ok := info.UserMetadata["Sha256"]; ok {
+		hash, err = hex.DecodeString(metadataHash)
+	} else {
+		hash, err = base64.StdEncoding.DecodeString(info.ChecksumSHA256)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode checksum: %w", err)
 	}
@@ -107,5 +186,10 @@ func (s *S3Client) GetHash(name string) ([]byte, error) {
 		return nil, fmt.Errorf("invalid checksum length: %d", len(hash))
 	}
 
-	return hash, nil
+	return &ObjectInfo{
+		Size:         info.Size,
+		Hash:         hash,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}, nil
 }
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Origins of a source version.
+const (
+	SourceGenerated = "generated"
+	SourceEdited    = "edited"
+	SourceImported  = "imported"
+)
+
+// Statuses of a source version, matching the results of a compile job.
+// Imported source is stored without compiling it, so it's uncompiled until it
+// is saved again.
+const (
+	SourceSuccess       = "success"
+	SourceCompileError  = "compile_error"
+	SourceInternalError = "internal_error"
+	SourceUncompiled    = "uncompiled"
+)
+
+// maxSourceSize limits the C++ source stored for a project.
+const maxSourceSize = 256 * 1024
+
+// SourceVersion is one compiled version of a project's C++ source.
+type SourceVersion struct {
+	Version int    `json:"version"`
+	Origin  string `json:"origin"`
+	// Prompt and Model are set for generated source
+	Prompt        string    `json:"prompt,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	Status        string    `json:"status"`
+	CompileOutput string    `json:"compile_output,omitempty"`
+	WasmHash      string    `json:"wasm_hash,omitempty"`
+	CreatedBy     string    `json:"created_by,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	Source        string    `json:"source,omitempty"`
+}
+
+// setResult records the outcome of compiling the source, including the hash of
+// the wasm it compiled to.
+func (v *SourceVersion) setResult(result *JobResult) error {
+	switch result.Status {
+	case StatusSuccess:
+		success := result.Result.(JobSuccess)
+		file, err := os.Open(success.WasmPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, file); err != nil {
+			return fmt.Errorf("failed to hash wasm: %w", err)
+		}
+
+		v.Status = SourceSuccess
+		v.CompileOutput = success.Output
+		v.WasmHash = hex.EncodeToString(hasher.Sum(nil))
+
+	case StatusCompileError:
+		v.Status = SourceCompileError
+		v.CompileOutput = result.Result.(string)
+
+	default:
+		v.Status = SourceInternalError
+		v.CompileOutput = result.Result.(error).Error()
+	}
+
+	return nil
+}
+
+// recordSource stores the next version of a project's source, filling in its
+// version number and creation time.
+func (s *Server) recordSource(projectID int64, userID string, version *SourceVersion) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Versions are numbered per project, so concurrent saves are serialized
+	if _, err := tx.Exec("SELECT 1 FROM projects WHERE id = $1 FOR UPDATE", projectID); err != nil {
+		return fmt.Errorf("failed to lock project: %w", err)
+	}
+
+	query := `
+		INSERT INTO project_sources (project, version, source, origin, prompt, model, status, compile_output, wasm_hash, created_by)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6, $7, $8, $9
+		FROM project_sources
+		WHERE project = $1
+		RETURNING version, created_at
+	`
+	err = tx.QueryRow(query,
+		projectID,
+		version.Source,
+		version.Origin,
+		version.Prompt,
+		version.Model,
+		version.Status,
+		version.CompileOutput,
+		sql.NullString{String: version.WasmHash, Valid: version.WasmHash != ""},
+		sql.NullString{String: userID, Valid: userID != ""},
+	).Scan(&version.Version, &version.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save source: %w", err)
+	}
+
+	version.CreatedBy = userID
+	return tx.Commit()
+}
+
+const sourceVersionColumns = `
+	version, origin, prompt, model, status, COALESCE(wasm_hash, ''), COALESCE(created_by::text, ''), created_at
+`
+
+func scanSourceVersion(row interface{ Scan(...any) error }, extra ...any) (*SourceVersion, error) {
+	var version SourceVersion
+	dest := append([]any{
+		&version.Version,
+		&version.Origin,
+		&version.Prompt,
+		&version.Model,
+		&version.Status,
+		&version.WasmHash,
+		&version.CreatedBy,
+		&version.CreatedAt,
+	}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	return &version, nil
+}
+
+// getSourceVersion returns a version of a project's source along with its
+// compile output, or nil if it doesn't exist.
+func (s *Server) getSourceVersion(projectID int64, number int) (*SourceVersion, error) {
+	query := "SELECT " + sourceVersionColumns + ", source, compile_output FROM project_sources WHERE project = $1 AND version = $2"
+
+	var source, output string
+	version, err := scanSourceVersion(s.db.QueryRow(query, projectID, number), &source, &output)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source: %w", err)
+	}
+
+	version.Source = source
+	version.CompileOutput = output
+	return version, nil
+}
+
+// currentSource returns the latest version of a project's source that compiled,
+// which is what its main.wasm was built from, or nil if there is none.
+func (s *Server) currentSource(projectID int64) (*SourceVersion, error) {
+	query := `
+		SELECT version FROM project_sources
+		WHERE project = $1 AND status = $2
+		ORDER BY version DESC
+		LIMIT 1
+	`
+
+	var number int
+	err := s.db.QueryRow(query, projectID, SourceSuccess).Scan(&number)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current source: %w", err)
+	}
+
+	return s.getSourceVersion(projectID, number)
+}
+
+// copySources copies the source history of one project to another.
+func (s *Server) copySources(sourceID, projectID int64) error {
+	query := `
+		INSERT INTO project_sources (project, version, source, origin, prompt, model, status, compile_output, wasm_hash, created_by, created_at)
+		SELECT $2, version, source, origin, prompt, model, status, compile_output, wasm_hash, created_by, created_at
+		FROM project_sources
+		WHERE project = $1
+	`
+	if _, err := s.db.Exec(query, sourceID, projectID); err != nil {
+		return fmt.Errorf("failed to copy sources: %w", err)
+	}
+
+	return nil
+}
+
+// handleSources lists the versions of a project's source on GET, newest first,
+// and compiles a hand-edited source on POST.
+func (s *Server) handleSources(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.listSources(w, r)
+	case "POST":
+		s.submitSource(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listSources writes the versions of a project's source without the sources
+// themselves, which are fetched one version at a time.
+func (s *Server) listSources(w http.ResponseWriter, r *http.Request) {
+	project := ProjectAccessFromContext(r.Context())
+
+	query := "SELECT " + sourceVersionColumns + " FROM project_sources WHERE project = $1 ORDER BY version DESC"
+	rows, err := s.db.Query(query, project.ID)
+	if err != nil {
+		log.Printf("failed to get sources: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	versions := []*SourceVersion{}
+	for rows.Next() {
+		version, err := scanSourceVersion(rows)
+		if err != nil {
+			log.Printf("failed to scan source: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		versions = append(versions, version)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// handleSource returns one version of a project's source.
+func (s *Server) handleSource(w http.ResponseWriter, r *http.Request) {
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	version, ok := s.sourceVersionFromPath(w, project.ID, r.PathValue("version"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+// handleSourceDiff returns a unified diff of a version of a project's source
+// against the version given by ?from=, which defaults to the one before it.
+func (s *Server) handleSourceDiff(w http.ResponseWriter, r *http.Request) {
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	to, ok := s.sourceVersionFromPath(w, project.ID, r.PathValue("version"))
+	if !ok {
+		return
+	}
+
+	fromValue := r.URL.Query().Get("from")
+	if fromValue == "" {
+		fromValue = strconv.Itoa(to.Version - 1)
+	}
+
+	// Version 0 is the empty source before the first version
+	from := &SourceVersion{}
+	if fromValue != "0" {
+		from, ok = s.sourceVersionFromPath(w, project.ID, fromValue)
+		if !ok {
+			return
+		}
+	}
+
+	diff := unifiedDiff(
+		fmt.Sprintf("version %d", from.Version),
+		fmt.Sprintf("version %d", to.Version),
+		from.Source,
+		to.Source,
+	)
+
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.Write([]byte(diff))
+}
+
+// sourceVersionFromPath looks up a version of a project's source, writing an
+// error response and returning false if that fails.
+func (s *Server) sourceVersionFromPath(w http.ResponseWriter, projectID int64, value string) (*SourceVersion, bool) {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return nil, false
+	}
+
+	version, err := s.getSourceVersion(projectID, number)
+	if err != nil {
+		log.Printf("failed to get source: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if version == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return version, true
+}
+
+// submitSource compiles C++ source written by hand with the template headers.
+// If it compiles, the result replaces the project's main.wasm. Otherwise the
+// compiler's diagnostics are returned with status 422. Either way, the source
+// is stored as a new version. Mistakes checkSource finds are reported like
+// compile errors, without compiling.
+func (s *Server) submitSource(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+
+	if !project.Role.CanEdit() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Source string `json:"source"`
+	}
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxSourceSize)).Decode(&request); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(request.Source) == "" {
+		http.Error(w, "Source required", http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Source) > maxSourceSize || strings.ContainsRune(request.Source, 0) {
+		http.Error(w, "Invalid source", http.StatusBadRequest)
+		return
+	}
+
+	// Mistakes the analyzer catches are reported without using a compile slot
+	var result *JobResult
+	if problems := checkSource(request.Source); len(problems) > 0 {
+		result = &JobResult{Status: StatusCompileError, Result: formatSourceProblems(problems)}
+	} else {
+		result = s.compileQueue.Enqueue(request.Source)
+	}
+
+	version := &SourceVersion{Source: request.Source, Origin: SourceEdited}
+	err := s.saveCompiledSource(r.Context(), project.ID, user.ID, version, result)
+	if errors.Is(err, ErrQuotaExceeded) {
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		log.Printf("failed to save source: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch result.Status {
+	case StatusSuccess:
+		json.NewEncoder(w).Encode(map[string]any{
+			"version":     version.Version,
+			"wasm_hash":   version.WasmHash,
+			"diagnostics": parseDiagnostics(version.CompileOutput),
+		})
+
+	case StatusCompileError:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{
+			"version":     version.Version,
+			"diagnostics": parseDiagnostics(version.CompileOutput),
+		})
+
+	default:
+		log.Printf("failed to compile source: %s", version.CompileOutput)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// saveCompiledSource stores a version of a project's source along with the
+// result of compiling it. If it compiled, its wasm becomes the project's
+// main.wasm.
+func (s *Server) saveCompiledSource(ctx context.Context, projectID int64, userID string, version *SourceVersion, result *JobResult) error {
+	if result.Status == StatusSuccess {
+		success := result.Result.(JobSuccess)
+		defer success.Cleanup()
+	}
+
+	if err := version.setResult(result); err != nil {
+		return err
+	}
+
+	if result.Status == StatusSuccess {
+		success := result.Result.(JobSuccess)
+		if err := s.storeCompiledWasm(ctx, projectID, userID, success.WasmPath, version.WasmHash); err != nil {
+			return err
+		}
+	}
+
+	return s.recordSource(projectID, userID, version)
+}
+
+// storeCompiledWasm stores a compiled program as the project's main.wasm asset.
+func (s *Server) storeCompiledWasm(ctx context.Context, projectID int64, userID, wasmPath, hash string) error {
+	info, err := os.Stat(wasmPath)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.getExistingAssets(projectID)
+	if err != nil {
+		return err
+	}
+
+	projectDelta, userDelta := info.Size(), info.Size()
+	if old, ok := existing["main.wasm"]; ok {
+		if old.Hash == hash {
+			return nil
+		}
+
+		projectDelta -= old.Size
+		if old.UploadedBy == userID {
+			userDelta -= old.Size
+		}
+	}
+
+	budget, err := s.storageBudget(projectID, userID, projectDelta, userDelta)
+	if err != nil {
+		return err
+	}
+
+	if budget < 0 {
+		return ErrQuotaExceeded
+	}
+
+	object := assetObjectName(hash)
+	state, err := s.acquireObject(object)
+	if err != nil {
+		return err
+	}
+
+	if !state.Stored {
+		if err := UploadFile(s.store, object, wasmPath); err != nil {
+			s.releaseObjects([]string{object})
+			return err
+		}
+
+		if err := s.markObjectStored(object, wasmType.contentType, info.Size()); err != nil {
+			s.releaseObjects([]string{object})
+			return err
+		}
+	}
+
+	asset := Asset{Hash: hash, Object: object, ContentType: wasmType.contentType, Size: info.Size()}
+	if err := s.putAsset(ctx, projectID, userID, "main.wasm", asset); err != nil {
+		s.releaseObjects([]string{object})
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSubmitSourceChecksBeforeCompiling(t *testing.T) {
+	server, mock, _ := newTestServer(t)
+	compiler := &fakeCompiler{t: t}
+	server.compileQueue = compiler
+
+	source := strings.Replace(testProgram, "on_pose", "on_move", 1)
+	mock.ExpectBegin()
+	mock.ExpectExec("FOR UPDATE").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO project_sources").
+		WithArgs(int64(1), source, SourceEdited, "", "", SourceCompileError, formatSourceProblems(checkSource(source)), nil, "user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	body, err := json.Marshal(map[string]string{"source": source})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/projects/1/sources", strings.NewReader(string(body)))
+	request = withTestProject(request, "user-1", 1, RoleOwner)
+	recorder := httptest.NewRecorder()
+	server.submitSource(recorder, request)
+
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "on_pose") {
+		t.Errorf("got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if len(compiler.programs) != 0 {
+		t.Errorf("compiled %q", compiler.programs)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// ObjectStore holds the files referenced by projects, such as assets and
+// prompt images.
+type ObjectStore interface {
+	// Upload streams an object from reader, which yields size bytes or, if size
+	// is -1, runs until EOF. hash is the SHA-256 of the contents and
+	// contentType is served with the object. If reader fails, the upload is
+	// aborted and no object is created.
+	Upload(name string, reader io.Reader, size int64, hash []byte, contentType string) error
+	Delete(name string) error
+	// Open returns a reader over an object's contents.
+	Open(name string) (io.ReadSeekCloser, error)
+	PresignURL(name string, expiresIn time.Duration) (string, error)
+	// GetHash returns the SHA-256 of an object's contents.
+	GetHash(name string) ([]byte, error)
+	Stat(name string) (*ObjectInfo, error)
+	// List calls fn for every object in the store. Hash is not populated.
+	List(fn func(info ObjectInfo) error) error
+
+	// Multipart uploads assemble an object from parts numbered from 1 that are
+	// uploaded separately, possibly over several requests. hash is the SHA-256
+	// of the complete object.
+	CreateMultipartUpload(name string, hash []byte, contentType string) (string, error)
+	UploadPart(name, uploadID string, partNumber int, reader io.Reader, size int64) (string, error)
+	CompleteMultipartUpload(name, uploadID string, etags []string) error
+	AbortMultipartUpload(name, uploadID string) error
+}
+
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	Hash         []byte
+	ContentType  string
+	LastModified time.Time
+}
+
+func UploadBuffer(store ObjectStore, name string, data []byte) error {
+	hash := sha256.Sum256(data)
+	return store.Upload(name, bytes.NewReader(data), int64(len(data)), hash[:], detectContentType(data))
+}
+
+func UploadFile(store ObjectStore, name, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	hasher := sha256.New()
+	hasher.Write(header[:n])
+	rest, err := io.Copy(hasher, file)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return store.Upload(name, file, int64(n)+rest, hasher.Sum(nil), detectContentType(header[:n]))
+}
+
+var (
+	ErrHashMismatch   = errors.New("hash mismatch")
+	ErrObjectTooLarge = errors.New("object too large")
+)
+
+// VerifyingReader hashes everything read through it. Reaching EOF with
+// contents that don't match the expected SHA-256, or reading more than the
+// size limit, fails the read so that the store aborts the upload.
+type VerifyingReader struct {
+	reader   io.Reader
+	hasher   hash.Hash
+	expected []byte
+	limit    int64
+	read     int64
+	err      error
+}
+
+func NewVerifyingReader(reader io.Reader, expected []byte, limit int64) *VerifyingReader {
+	return &VerifyingReader{
+		reader:   reader,
+		hasher:   sha256.New(),
+		expected: expected,
+		limit:    limit,
+	}
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.reader.Read(p)
+	v.hasher.Write(p[:n])
+	v.read += int64(n)
+
+	if v.read > v.limit {
+		v.err = ErrObjectTooLarge
+		return n, v.err
+	}
+
+	if err == io.EOF && !bytes.Equal(v.hasher.Sum(nil), v.expected) {
+		v.err = ErrHashMismatch
+		return n, v.err
+	}
+
+	return n, err
+}
+
+// Err returns ErrHashMismatch or ErrObjectTooLarge if verification failed.
+func (v *VerifyingReader) Err() error {
+	return v.err
+}
+
+// Size returns the number of bytes read so far.
+func (v *VerifyingReader) Size() int64 {
+	return v.read
+}
+
+// NewObjectStore creates the object store selected by STORAGE_BACKEND,
+// defaulting to S3.
+func NewObjectStore(getenv func(string) string) (ObjectStore, error) {
+	switch getenv("STORAGE_BACKEND") {
+	case "", "s3":
+		return NewS3Client(
+			getenv("S3_ENDPOINT"),
+			getenv("S3_ACCESS_KEY_ID"),
+			getenv("S3_SECRET_ACCESS_KEY"),
+			getenv("S3_BUCKET"),
+			getenv("S3_INSECURE") != "true",
+		)
+
+	case "filesystem":
+		key := getenv("STORAGE_SIGNING_KEY")
+		if key == "" {
+			return nil, fmt.Errorf("STORAGE_SIGNING_KEY is required for the filesystem storage backend")
+		}
+		return NewFileStore(getenv("STORAGE_DIR"), getenv("PUBLIC_URL"), []byte(key))
+
+	case "memory":
+		return NewMemoryStore(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", getenv("STORAGE_BACKEND"))
+	}
+}
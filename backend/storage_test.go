@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testObjectStores(t *testing.T) map[string]ObjectStore {
+	fileStore, err := NewFileStore(t.TempDir(), "http://backend.test", []byte("signing key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]ObjectStore{
+		"memory":     NewMemoryStore(),
+		"filesystem": fileStore,
+	}
+}
+
+func readStoredObject(t *testing.T, store ObjectStore, name string) []byte {
+	t.Helper()
+
+	reader, err := store.Open(name)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", name, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	return data
+}
+
+func TestObjectStore(t *testing.T) {
+	for backend, store := range testObjectStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			data := []byte("hello, world")
+			hash := sha256.Sum256(data)
+
+			// The size limits the upload, -1 reads until EOF
+			if err := store.Upload("sha256/a", bytes.NewReader(append(data, "trailing"...)), int64(len(data)), hash[:], "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.Upload("b", bytes.NewReader(data), -1, hash[:], "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range []string{"sha256/a", "b"} {
+				if got := readStoredObject(t, store, name); !bytes.Equal(got, data) {
+					t.Errorf("%s contains %q", name, got)
+				}
+
+				info, err := store.Stat(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if info.Size != int64(len(data)) || !bytes.Equal(info.Hash, hash[:]) {
+					t.Errorf("%s has size %d and hash %x", name, info.Size, info.Hash)
+				}
+
+				if _, err := store.PresignURL(name, time.Minute); err != nil {
+					t.Errorf("failed to presign %s: %v", name, err)
+				}
+			}
+
+			names := []string{}
+			err := store.List(func(info ObjectInfo) error {
+				names = append(names, info.Name)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(names)
+			if strings.Join(names, ",") != "b,sha256/a" {
+				t.Errorf("listed %v", names)
+			}
+
+			if err := store.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.Open("b"); err == nil {
+				t.Error("deleted object can still be opened")
+			}
+
+			// Deleting a missing object isn't an error
+			if err := store.Delete("b"); err != nil {
+				t.Errorf("failed to delete missing object: %v", err)
+			}
+		})
+	}
+}
+
+func TestObjectStoreMultipart(t *testing.T) {
+	for backend, store := range testObjectStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			parts := [][]byte{[]byte("first part, "), []byte("second part, "), []byte("last")}
+			hash := sha256.Sum256(bytes.Join(parts, nil))
+
+			uploadID, err := store.CreateMultipartUpload("sha256/multipart", hash[:], "text/plain")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Parts may arrive out of order, they're assembled by number
+			etags := make([]string, len(parts))
+			for _, i := range []int{2, 0, 1} {
+				etags[i], err = store.UploadPart("sha256/multipart", uploadID, i+1, bytes.NewReader(parts[i]), int64(len(parts[i])))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := store.CompleteMultipartUpload("sha256/multipart", uploadID, etags); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readStoredObject(t, store, "sha256/multipart"); !bytes.Equal(got, bytes.Join(parts, nil)) {
+				t.Errorf("assembled %q", got)
+			}
+
+			aborted, err := store.CreateMultipartUpload("sha256/aborted", hash[:], "text/plain")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.UploadPart("sha256/aborted", aborted, 1, bytes.NewReader(parts[0]), int64(len(parts[0]))); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.AbortMultipartUpload("sha256/aborted", aborted); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.Open("sha256/aborted"); err == nil {
+				t.Error("aborted upload created an object")
+			}
+
+			// Parts in progress aren't objects
+			err = store.List(func(info ObjectInfo) error {
+				if info.Name != "sha256/multipart" {
+					t.Errorf("listed %s", info.Name)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFileStoreRejectsEscapingNames(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), "http://backend.test", []byte("signing key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../outside", "/etc/passwd", "a/../../outside"} {
+		if err := store.Upload(name, strings.NewReader("data"), -1, nil, ""); err == nil {
+			t.Errorf("uploaded %q", name)
+		}
+
+		if _, err := store.Open(name); err == nil {
+			t.Errorf("opened %q", name)
+		}
+	}
+}
+
+func TestFileStoreDownload(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), "", []byte("signing key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UploadBuffer(store, "sha256/object", []byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/objects/{name...}", store.HandleDownload)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	signed, err := store.PresignURL("sha256/object", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := get(signed)
+	if response.Code != http.StatusOK || response.Body.String() != "contents" {
+		t.Fatalf("got %d %q", response.Code, response.Body.String())
+	}
+
+	// A signature is only valid for the object it was made for
+	if err := UploadBuffer(store, "sha256/other", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := get(strings.Replace(signed, "sha256/object", "sha256/other", 1)); response.Code != http.StatusForbidden {
+		t.Errorf("other object: got %d", response.Code)
+	}
+
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := parsed.Query()
+	query.Set("expires", "1")
+	query.Set("signature", store.sign("sha256/object", "1"))
+	parsed.RawQuery = query.Encode()
+	if response := get(parsed.String()); response.Code != http.StatusForbidden {
+		t.Errorf("expired URL: got %d", response.Code)
+	}
+}
+
+// oneByteReader returns a byte per read, to exercise verification across many
+// small reads.
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestVerifyingReader(t *testing.T) {
+	data := []byte("the contents of an asset")
+	hash := sha256.Sum256(data)
+	otherHash := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name     string
+		reader   io.Reader
+		expected []byte
+		limit    int64
+		wantErr  error
+	}{
+		{"matching", bytes.NewReader(data), hash[:], int64(len(data)), nil},
+		{"small reads", &oneByteReader{data}, hash[:], int64(len(data)), nil},
+		{"mismatch", bytes.NewReader(data), otherHash[:], int64(len(data)), ErrHashMismatch},
+		{"truncated", bytes.NewReader(data[:10]), hash[:], int64(len(data)), ErrHashMismatch},
+		{"too large", bytes.NewReader(data), hash[:], int64(len(data)) - 1, ErrObjectTooLarge},
+		{"too large in small reads", &oneByteReader{data}, hash[:], 5, ErrObjectTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := NewVerifyingReader(test.reader, test.expected, test.limit)
+			read, err := io.ReadAll(verifier)
+
+			if err != test.wantErr || verifier.Err() != test.wantErr {
+				t.Fatalf("got errors %v and %v, want %v", err, verifier.Err(), test.wantErr)
+			}
+
+			if verifier.Size() != int64(len(read)) {
+				t.Errorf("size is %d after reading %d bytes", verifier.Size(), len(read))
+			}
+
+			// Once verification fails, it keeps failing
+			if test.wantErr != nil {
+				if _, err := verifier.Read(make([]byte, 1)); err != test.wantErr {
+					t.Errorf("read after failure returned %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyingReaderAbortsUpload(t *testing.T) {
+	store := NewMemoryStore()
+	data := []byte("uploaded contents")
+	wrongHash := sha256.Sum256([]byte("other contents"))
+
+	verifier := NewVerifyingReader(bytes.NewReader(data), wrongHash[:], maxAssetSize)
+	if err := store.Upload("sha256/wrong", verifier, -1, wrongHash[:], "text/plain"); err == nil {
+		t.Fatal("upload with a mismatched hash succeeded")
+	}
+
+	if _, ok := store.Get("sha256/wrong"); ok {
+		t.Error("mismatched upload created an object")
+	}
+}
@@ -11,6 +11,9 @@
 #include "glm/ext/vector_float3.hpp"
 #include "glm/gtc/type_ptr.hpp"
 
+// Declarations with a /// comment make up the API documented to the model in the system prompt,
+// along with the public members of documented classes. The rest is internal to the runtime.
+
 __attribute__((__import_name__("simulo_set_buffers")))
 extern void simulo_set_buffers(float *pose, float *transform);
 
@@ -70,6 +73,8 @@ extern void simulo_delete_material(uint32_t id);
 
 extern "C" void simulo__pose(int id, bool alive);
 
+/// A detected pose complete with (x, y) screen coordinates for various body points. Use the
+/// relevant getter functions to access the coordinates.
 class Pose {
 public:
    glm::vec2 nose() const {
@@ -153,6 +158,9 @@ private:
 class Material;
 class Object;
 
+/// A material changes the appearance of an object. Materials are expensive to create and are in
+/// limited supply, so unless with good reason not to, create them once at the beginning of the
+/// program and reuse them.
 class Material {
 public:
    Material(uint32_t image, float r, float g, float b) : simulo__id(simulo_create_material(image, r, g, b)) {}
@@ -163,10 +171,15 @@ private:
    uint32_t simulo__id;
 };
 
+/// Utility for creating solid-colored objects. The image id of a 1x1 pixel image that, when
+/// tinted, will appear exactly as the material color.
 static uint32_t kSolidTexture;
 
 extern "C" void simulo__start();
 
+/// The base class of all objects. An empty, extensible container that comes with a position,
+/// rotation, scale.
+/// Objects are NOT copyable or movable.
 class Object {
 public:
    Object() : simulo__id(simulo_create_object()) {}
@@ -180,6 +193,7 @@ public:
       simulo_drop_object(simulo__id);
    }
 
+   /// `delta` is in seconds
    virtual void update(float delta) {}
 
    virtual glm::mat4 recalculate_transform() {
@@ -206,8 +220,11 @@ public:
       simulo_remove_object_from_parent(simulo__id);
    }
 
+   /// You must call `transform_outdated()` after modifying any of these fields.
    glm::vec2 position;
+   /// In radians
    float rotation;
+   /// In pixels
    glm::vec2 scale{1.0f, 1.0f};
 
 private:
@@ -215,6 +232,9 @@ private:
    uint32_t simulo__id;
 };
 
+/// An object that displays a rectangular mesh. The mesh is colored/textured based on the `material`
+/// constructor parameter.
+/// The mesh displayed is anchored at the top-left corner.
 class RenderedObject : public Object {
 public:
    RenderedObject(const Material &material) : Object(), simulo__render_id(simulo_create_rendered_object(material.simulo__id)) {
@@ -235,10 +255,12 @@ private:
    uint32_t simulo__render_id;
 };
 
+/// Gets the size of the window in pixels.
 glm::ivec2 window_size() {
    return glm::ivec2(simulo_window_width(), simulo_window_height());
 }
 
+/// Returns a evenly distributed random float in range [0, 1).
 float random_float() {
    return simulo_random();
 }
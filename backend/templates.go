@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// duplicateProject creates a project from the contents of another, including
+// its source history. Assets share the source's objects, while prompt images
+// are copied since they belong to a single scene. The new project is owned
+// like one made by createProject, and sql.ErrNoRows is returned if the user
+// may not create it.
+func (s *Server) duplicateProject(sourceID int64, userID, name string, organization *int64) (int64, error) {
+	var scene string
+	if err := s.db.QueryRow("SELECT scene FROM projects WHERE id = $1", sourceID).Scan(&scene); err != nil {
+		return 0, fmt.Errorf("failed to get project: %w", err)
+	}
+
+	projectID, err := s.createProject(userID, name, organization)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.copyProjectContents(sourceID, projectID, userID, scene); err != nil {
+		if err := s.deleteProject(projectID); err != nil {
+			log.Printf("failed to delete partially duplicated project: %v", err)
+		}
+		return 0, err
+	}
+
+	return projectID, nil
+}
+
+func (s *Server) copyProjectContents(sourceID, projectID int64, userID, scene string) error {
+	size, err := projectStorageUsage(s.db, sourceID)
+	if err != nil {
+		return err
+	}
+
+	budget, err := s.storageBudget(projectID, userID, size, size)
+	if err != nil {
+		return err
+	}
+
+	if budget < 0 {
+		return ErrQuotaExceeded
+	}
+
+	if err := s.copyProjectAssets(sourceID, projectID, userID); err != nil {
+		return err
+	}
+
+	if err := s.copySources(sourceID, projectID); err != nil {
+		return err
+	}
+
+	// Scenes that don't parse can't reference prompt images, so they are
+	// copied as they are
+	updatedScene := scene
+	if scene == "" {
+		updatedScene = "[]"
+	}
+
+	var sceneData []map[string]interface{}
+	if err := json.Unmarshal([]byte(scene), &sceneData); err == nil && len(sceneData) > 0 {
+		promptImages := []interface{}{}
+		for _, image := range promptImagesOf(scene) {
+			imageID, err := s.copyPromptImage(image, projectID, userID)
+			if err != nil {
+				return err
+			}
+			promptImages = append(promptImages, imageID)
+		}
+		sceneData[0]["promptImages"] = promptImages
+
+		data, _ := json.Marshal(sceneData)
+		updatedScene = string(data)
+	}
+
+	if _, err := s.db.Exec("UPDATE projects SET scene = $1 WHERE id = $2", updatedScene, projectID); err != nil {
+		return fmt.Errorf("failed to save scene: %w", err)
+	}
+
+	return nil
+}
+
+// copyProjectAssets points the new project's assets at the source's objects,
+// adding a reference to each.
+func (s *Server) copyProjectAssets(sourceID, projectID int64, userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.lockStorageUsage(tx, projectID, userID); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO project_assets (name, hash, object, project, content_type, size, uploaded_by)
+		SELECT name, hash, object, $2, content_type, size, $3 FROM project_assets WHERE project = $1
+	`
+	if _, err := tx.Exec(query, sourceID, projectID, userID); err != nil {
+		return fmt.Errorf("failed to copy assets: %w", err)
+	}
+
+	query = `
+		UPDATE objects SET refs = refs + counts.refs, updated_at = now()
+		FROM (
+			SELECT object, COUNT(*) AS refs FROM project_assets WHERE project = $1 GROUP BY object
+		) counts
+		WHERE objects.name = counts.object
+	`
+	if _, err := tx.Exec(query, projectID); err != nil {
+		return fmt.Errorf("failed to reference assets: %w", err)
+	}
+
+	if err := s.checkStorageQuotas(tx, projectID, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// copyPromptImage copies a prompt image and its thumbnail to a new ID.
+func (s *Server) copyPromptImage(image string, projectID int64, userID string) (string, error) {
+	imageID := generateRandomHex(16)
+
+	data, err := s.readObject(image, maxPromptImageSize)
+	if err != nil {
+		return "", err
+	}
+
+	if err := UploadBuffer(s.store, imageID, data); err != nil {
+		return "", err
+	}
+
+	size := int64(len(data))
+	thumbnail, err := s.imageVariantObject(image, thumbnailVariant)
+	if err != nil {
+		return "", err
+	}
+
+	if thumbnail != image {
+		thumbnailData, err := s.readObject(thumbnail, maxPromptImageSize)
+		if err != nil {
+			return "", err
+		}
+
+		img, _, err := decodeImage(thumbnailData)
+		if err != nil {
+			return "", err
+		}
+
+		bounds := img.Bounds()
+		variant := &encodedImage{data: thumbnailData, width: bounds.Dx(), height: bounds.Dy()}
+		if err := s.storeImageVariant(imageID, thumbnailVariant, variant); err != nil {
+			return "", err
+		}
+		size += int64(len(thumbnailData))
+	}
+
+	if err := s.recordPromptImage(imageID, projectID, userID, size); err != nil {
+		return "", err
+	}
+
+	return imageID, nil
+}
+
+func (s *Server) readObject(name string, limit int64) ([]byte, error) {
+	reader, err := s.store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %w", err)
+	}
+
+	if int64(len(data)) > limit {
+		return nil, ErrObjectTooLarge
+	}
+
+	return data, nil
+}
+
+// handleDuplicateProject copies a project the caller is a member of. The copy is
+// personal unless an organization is given.
+func (s *Server) handleDuplicateProject(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Name         string `json:"name"`
+		Organization *int64 `json:"organization"`
+	}
+
+	// The body is optional
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if request.Name == "" {
+		if err := s.db.QueryRow("SELECT name FROM projects WHERE id = $1", project.ID).Scan(&request.Name); err != nil {
+			log.Printf("failed to get project: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		request.Name = "Copy of " + request.Name
+	}
+
+	if len(request.Name) > 255 {
+		http.Error(w, "Name too long", http.StatusBadRequest)
+		return
+	}
+
+	projectID, err := s.duplicateProject(project.ID, user.ID, request.Name, request.Organization)
+	if !writeDuplicateError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": projectID})
+}
+
+// writeDuplicateError responds to a failed duplicateProject and reports whether
+// it succeeded instead.
+func writeDuplicateError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case err == sql.ErrNoRows:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, ErrQuotaExceeded):
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Failed to duplicate project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+
+	return false
+}
+
+type Template struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// handleTemplates lists the template gallery. Templates are instantiated by
+// passing their ID to POST /projects.
+func (s *Server) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := s.db.Query("SELECT id, name FROM projects WHERE is_template ORDER BY name")
+	if err != nil {
+		log.Printf("failed to get templates: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		var template Template
+		if err := rows.Scan(&template.ID, &template.Name); err != nil {
+			log.Printf("failed to scan template: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		templates = append(templates, template)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// handleProjectTemplate publishes a project to or withdraws it from the
+// template gallery. Publishing requires the global developer role.
+func (s *Server) handleProjectTemplate(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !project.Role.CanManage() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Template bool `json:"template"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Every user sees the gallery, so only developers may add to it, while
+	// project managers may still take their projects out of it
+	if request.Template {
+		developer, err := s.hasGlobalRole(user.ID, "developer")
+		if err != nil {
+			log.Printf("failed to get global role: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !developer {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	if _, err := s.db.Exec("UPDATE projects SET is_template = $1 WHERE id = $2", request.Template, project.ID); err != nil {
+		log.Printf("failed to update template: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// isTemplate reports whether a project is in the template gallery.
+func (s *Server) isTemplate(projectID int64) (bool, error) {
+	var isTemplate bool
+	err := s.db.QueryRow("SELECT is_template FROM projects WHERE id = $1", projectID).Scan(&isTemplate)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return isTemplate, err
+}
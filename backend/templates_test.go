@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHandleProjectTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		developer  any
+		wantStatus int
+	}{
+		{"publish as developer", `{"template": true}`, true, http.StatusOK},
+		{"publish as owner", `{"template": true}`, false, http.StatusForbidden},
+		{"withdraw", `{"template": false}`, nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, _ := newTestServer(t)
+
+			if test.developer != nil {
+				mock.ExpectQuery("FROM roles").WithArgs("user-1", "developer").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(test.developer))
+			}
+
+			if test.wantStatus == http.StatusOK {
+				mock.ExpectExec("UPDATE projects SET is_template").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			request := httptest.NewRequest("PUT", "/projects/1/template", strings.NewReader(test.body))
+			request = withTestProject(request, "user-1", 1, RoleOwner)
+
+			recorder := httptest.NewRecorder()
+			server.handleProjectTemplate(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", recorder.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCopyProjectContentsScene(t *testing.T) {
+	tests := []struct {
+		name      string
+		scene     string
+		wantScene string
+	}{
+		{"empty", "", "[]"},
+		{"no objects", "[]", "[]"},
+		{"not an array", `{"objects": []}`, `{"objects": []}`},
+		{"invalid", "[{", "[{"},
+		{"without prompt images", `[{"type": "scene"}]`, `[{"promptImages":[],"type":"scene"}]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, _ := newTestServer(t)
+
+			mock.ExpectQuery("FROM project_assets WHERE project = \\$1").WithArgs(int64(1)).
+				WillReturnRows(sqlmock.NewRows([]string{"usage"}).AddRow(0))
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT INTO project_assets").WithArgs(int64(1), int64(2), "user-1").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("UPDATE objects SET refs").WithArgs(int64(2)).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			mock.ExpectExec("INSERT INTO project_sources").WithArgs(int64(1), int64(2)).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("UPDATE projects SET scene").WithArgs(test.wantScene, int64(2)).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			if err := server.copyProjectContents(1, 2, "user-1", test.scene); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Every chunk except the last must be exactly this large. S3 requires parts of
+// at least 5 MiB.
+const uploadChunkSize = 8 * 1024 * 1024
+
+// Sessions that haven't received a chunk for this long are aborted.
+const uploadSessionExpiry = 24 * time.Hour
+
+type UploadSession struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Received  int64  `json:"received"`
+	ChunkSize int64  `json:"chunk_size"`
+	// Complete is set when the user already had access to the file, so no
+	// session was needed
+	Complete bool `json:"complete"`
+
+	hash        string
+	object      string
+	contentType string
+	uploadID    string
+	hashState   []byte
+	parts       []string
+}
+
+func (s *Server) getUploadSession(projectID int64, sessionID string) (*UploadSession, error) {
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return nil, nil
+	}
+
+	query := `
+		SELECT id, name, size, received, hash, object, upload_id, hash_state, parts
+		FROM upload_sessions
+		WHERE id = $1 AND project = $2
+	`
+
+	session := UploadSession{ChunkSize: uploadChunkSize}
+	err := s.db.QueryRow(query, sessionID, projectID).Scan(
+		&session.ID,
+		&session.Name,
+		&session.Size,
+		&session.Received,
+		&session.hash,
+		&session.object,
+		&session.uploadID,
+		&session.hashState,
+		pq.Array(&session.parts),
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload session: %w", err)
+	}
+
+	// The name was validated when the session was created
+	fileType, _ := assetTypeOf(session.Name)
+	session.contentType = fileType.contentType
+
+	return &session, nil
+}
+
+// handleUploadSessions starts a resumable upload of a single project asset.
+func (s *Server) handleUploadSessions(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !project.Role.CanEdit() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Sha256 string `json:"sha256"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	fileType, err := checkAssetName(request.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Size <= 0 {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+
+	if request.Size > maxAssetSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	fileHash, err := hex.DecodeString(request.Sha256)
+	if err != nil || len(fileHash) != sha256.Size {
+		http.Error(w, "Invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	hashState, err := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		log.Printf("failed to marshal hash state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	existingFiles, err := s.getExistingAssets(project.ID)
+	if err != nil {
+		log.Printf("failed to get existing assets: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The file replaces any existing asset of the same name
+	projectDelta, userDelta := request.Size, request.Size
+	if existingFile, ok := existingFiles[request.Name]; ok {
+		projectDelta -= existingFile.Size
+		if existingFile.UploadedBy == user.ID {
+			userDelta -= existingFile.Size
+		}
+	}
+
+	budget, err := s.storageBudget(project.ID, user.ID, projectDelta, userDelta)
+	if err != nil {
+		log.Printf("failed to check storage quota: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if budget < 0 {
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	hashString := hex.EncodeToString(fileHash)
+	object := assetObjectName(hashString)
+	state, err := s.acquireObject(object)
+	if err != nil {
+		log.Printf("failed to acquire object: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	reused := state.Stored && state.ContentType != ""
+	if reused {
+		reused, err = s.canReuseObject(user.ID, object)
+		if err != nil {
+			log.Printf("failed to check object access: %v", err)
+			s.releaseObjects([]string{object})
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if reused && state.ContentType != fileType.contentType {
+		s.releaseObjects([]string{object})
+		http.Error(w, request.Name+" is not a valid "+fileType.contentType+" file", http.StatusBadRequest)
+		return
+	}
+
+	session := UploadSession{
+		Name:      request.Name,
+		Size:      request.Size,
+		ChunkSize: uploadChunkSize,
+	}
+
+	if reused {
+		asset := Asset{Hash: hashString, Object: object, ContentType: fileType.contentType, Size: state.Size}
+		if err := s.putAsset(r.Context(), project.ID, user.ID, request.Name, asset); err != nil {
+			s.releaseObjects([]string{object})
+			if errors.Is(err, ErrQuotaExceeded) {
+				http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			log.Printf("failed to save asset: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		session.Received = session.Size
+		session.Complete = true
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+		return
+	}
+
+	uploadID, err := s.store.CreateMultipartUpload(object, fileHash, fileType.contentType)
+	if err != nil {
+		log.Printf("failed to create multipart upload: %v", err)
+		s.releaseObjects([]string{object})
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	session.ID = uuid.New().String()
+
+	query := `
+		INSERT INTO upload_sessions (id, project, "user", name, size, hash, object, upload_id, hash_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	_, err = s.db.Exec(query, session.ID, project.ID, user.ID, session.Name, session.Size, hashString, object, uploadID, hashState)
+	if err != nil {
+		log.Printf("failed to create upload session: %v", err)
+		if err := s.store.AbortMultipartUpload(object, uploadID); err != nil {
+			log.Printf("failed to abort multipart upload: %v", err)
+		}
+		s.releaseObjects([]string{object})
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// handleUploadSession reports progress of, appends a chunk to, or cancels an
+// upload session. Chunks must be sent in order, so after a failure the client
+// resumes from the received offset.
+func (s *Server) handleUploadSession(w http.ResponseWriter, r *http.Request) {
+	project := ProjectAccessFromContext(r.Context())
+
+	if !project.Role.CanEdit() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	session, err := s.getUploadSession(project.ID, r.PathValue("upload"))
+	if err != nil {
+		log.Printf("failed to get upload session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if session == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+
+	case "PUT":
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+
+		if offset != session.Received {
+			http.Error(w, fmt.Sprintf("Expected offset %d", session.Received), http.StatusConflict)
+			return
+		}
+
+		length := min(uploadChunkSize, session.Size-offset)
+		if length <= 0 {
+			http.Error(w, "Upload already complete", http.StatusConflict)
+			return
+		}
+
+		if r.ContentLength != length {
+			http.Error(w, fmt.Sprintf("Chunk must be %d bytes", length), http.StatusBadRequest)
+			return
+		}
+
+		hasher := sha256.New()
+		if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(session.hashState); err != nil {
+			log.Printf("failed to unmarshal hash state: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// The type is checked on the first chunk so that a mismatched file is
+		// rejected before the rest of it is sent
+		chunk := io.LimitReader(r.Body, length)
+		if offset == 0 {
+			header := make([]byte, min(sniffLength, length))
+			if _, err := io.ReadFull(chunk, header); err != nil {
+				http.Error(w, "Incomplete chunk", http.StatusBadRequest)
+				return
+			}
+
+			if _, err := sniffAsset(session.Name, header); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			chunk = io.MultiReader(bytes.NewReader(header), chunk)
+		}
+
+		counter := &countingWriter{}
+		body := io.TeeReader(chunk, io.MultiWriter(hasher, counter))
+
+		partNumber := int(offset/uploadChunkSize) + 1
+		etag, err := s.store.UploadPart(session.object, session.uploadID, partNumber, body, length)
+		if err != nil {
+			log.Printf("failed to upload part: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if counter.n != length {
+			http.Error(w, "Incomplete chunk", http.StatusBadRequest)
+			return
+		}
+
+		hashState, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			log.Printf("failed to marshal hash state: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		query := `
+			UPDATE upload_sessions
+			SET received = $1, hash_state = $2, parts = array_append(parts, $3), updated_at = now()
+			WHERE id = $4 AND received = $5
+		`
+		result, err := s.db.Exec(query, offset+length, hashState, etag, session.ID, offset)
+		if err != nil {
+			log.Printf("failed to update upload session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			log.Printf("failed to get rows affected: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if rowsAffected == 0 {
+			http.Error(w, "Chunk was uploaded concurrently", http.StatusConflict)
+			return
+		}
+
+		session.Received = offset + length
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+
+	case "DELETE":
+		if err := s.deleteUploadSession(session); err != nil {
+			log.Printf("failed to delete upload session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+// handleCompleteUpload assembles the uploaded chunks, verifies their SHA-256
+// and makes the result the project's asset of that name.
+func (s *Server) handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	user := PrincipalFromContext(r.Context())
+	project := ProjectAccessFromContext(r.Context())
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !project.Role.CanEdit() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	session, err := s.getUploadSession(project.ID, r.PathValue("upload"))
+	if err != nil {
+		log.Printf("failed to get upload session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if session == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if session.Received != session.Size {
+		http.Error(w, fmt.Sprintf("Upload incomplete, %d of %d bytes received", session.Received, session.Size), http.StatusConflict)
+		return
+	}
+
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(session.hashState); err != nil {
+		log.Printf("failed to unmarshal hash state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != session.hash {
+		if err := s.deleteUploadSession(session); err != nil {
+			log.Printf("failed to delete upload session: %v", err)
+		}
+		http.Error(w, "Hash mismatch", http.StatusBadRequest)
+		return
+	}
+
+	// Claim the session first so a concurrent completion can't commit it twice
+	result, err := s.db.Exec("DELETE FROM upload_sessions WHERE id = $1", session.ID)
+	if err != nil {
+		log.Printf("failed to delete upload session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.store.CompleteMultipartUpload(session.object, session.uploadID, session.parts); err != nil {
+		log.Printf("failed to complete multipart upload: %v", err)
+		if err := s.store.AbortMultipartUpload(session.object, session.uploadID); err != nil {
+			log.Printf("failed to abort multipart upload: %v", err)
+		}
+		s.releaseObjects([]string{session.object})
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	size, err := s.processImageAsset(session.object, session.contentType, session.Size)
+	if err != nil {
+		s.releaseObjects([]string{session.object})
+		if isImageError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("failed to process image: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.markObjectStored(session.object, session.contentType, size); err != nil {
+		log.Printf("failed to mark object stored: %v", err)
+	}
+
+	asset := Asset{Hash: session.hash, Object: session.object, ContentType: session.contentType, Size: size}
+	if err := s.putAsset(r.Context(), project.ID, user.ID, session.Name, asset); err != nil {
+		s.releaseObjects([]string{session.object})
+		if errors.Is(err, ErrQuotaExceeded) {
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		log.Printf("failed to save asset: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func (s *Server) deleteUploadSession(session *UploadSession) error {
+	if _, err := s.db.Exec("DELETE FROM upload_sessions WHERE id = $1", session.ID); err != nil {
+		return err
+	}
+
+	defer s.releaseObjects([]string{session.object})
+	return s.store.AbortMultipartUpload(session.object, session.uploadID)
+}
+
+// putAsset creates or replaces a project asset, returning ErrQuotaExceeded if
+// there is no room for it. The caller's reference to object is handed over to
+// the asset, and the reference held by the object it previously pointed to is
+// released.
+func (s *Server) putAsset(ctx context.Context, projectID int64, userID, name string, asset Asset) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.lockStorageUsage(tx, projectID, userID); err != nil {
+		return err
+	}
+
+	var oldObject string
+	err = tx.QueryRow("SELECT object FROM project_assets WHERE name = $1 AND project = $2 FOR UPDATE", name, projectID).Scan(&oldObject)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to get asset: %w", err)
+	}
+
+	query := `
+		INSERT INTO project_assets (name, hash, object, project, content_type, size, uploaded_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (name, project) DO UPDATE SET
+			hash = $2, object = $3, content_type = $5, size = $6, uploaded_by = $7
+	`
+	if _, err := tx.Exec(query, name, asset.Hash, asset.Object, projectID, asset.ContentType, asset.Size, userID); err != nil {
+		return fmt.Errorf("failed to insert file: %w", err)
+	}
+
+	released := []string{}
+	if oldObject != "" {
+		released = append(released, oldObject)
+	}
+
+	if err := dropObjectRefs(tx, released); err != nil {
+		return err
+	}
+
+	if err := s.checkStorageQuotas(tx, projectID, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.deleteUnreferencedObjects(released)
+	return nil
+}
+
+// cleanupUploadSessions periodically aborts upload sessions that were
+// abandoned by their clients.
+func (s *Server) cleanupUploadSessions() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		query := `
+			DELETE FROM upload_sessions
+			WHERE updated_at < $1
+			RETURNING object, upload_id
+		`
+
+		rows, err := s.db.Query(query, time.Now().Add(-uploadSessionExpiry))
+		if err != nil {
+			log.Printf("failed to clean up upload sessions: %v", err)
+			continue
+		}
+
+		var expired []UploadSession
+		for rows.Next() {
+			var session UploadSession
+			if err := rows.Scan(&session.object, &session.uploadID); err != nil {
+				log.Printf("failed to scan upload session: %v", err)
+				break
+			}
+			expired = append(expired, session)
+		}
+		rows.Close()
+
+		for _, session := range expired {
+			if err := s.store.AbortMultipartUpload(session.object, session.uploadID); err != nil {
+				log.Printf("failed to abort multipart upload: %v", err)
+			}
+			s.releaseObjects([]string{session.object})
+		}
+
+		if len(expired) > 0 {
+			log.Printf("Aborted %d abandoned upload sessions", len(expired))
+		}
+	}
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testSessionID = "7d3f1c7e-1f8a-4b7a-9d8e-0b4d6c3a2e11"
+
+// expectUploadSession expects an upload session to be loaded, with received
+// bytes of data already hashed.
+func expectUploadSession(t *testing.T, mock sqlmock.Sqlmock, name string, data []byte, received int64, uploadID string) {
+	t.Helper()
+
+	hasher := sha256.New()
+	hasher.Write(data[:received])
+	hashState, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha256.Sum256(data)
+	rows := sqlmock.NewRows([]string{"id", "name", "size", "received", "hash", "object", "upload_id", "hash_state", "parts"}).
+		AddRow(testSessionID, name, len(data), received, hex.EncodeToString(hash[:]), assetObjectName(hex.EncodeToString(hash[:])), uploadID, hashState, "{}")
+	mock.ExpectQuery("FROM upload_sessions").WithArgs(testSessionID, int64(1)).WillReturnRows(rows)
+}
+
+func putChunk(server *Server, offset int64, chunk []byte) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("PUT", "/projects/1/uploads/"+testSessionID+"?offset="+strconv.FormatInt(offset, 10), bytes.NewReader(chunk))
+	request.SetPathValue("upload", testSessionID)
+	request = withTestProject(request, "user-1", 1, RoleEditor)
+
+	recorder := httptest.NewRecorder()
+	server.handleUploadSession(recorder, request)
+	return recorder
+}
+
+func TestUploadChunk(t *testing.T) {
+	data := []byte(`{"level": 1, "enemies": ["slime", "bat"]}`)
+
+	tests := []struct {
+		name         string
+		offset       int64
+		chunk        []byte
+		rowsAffected int64
+		wantStatus   int
+		wantBody     string
+	}{
+		{"appends", 0, data, 1, http.StatusOK, `"received":41`},
+		{"lost race", 0, data, 0, http.StatusConflict, "uploaded concurrently"},
+		{"wrong offset", 10, data[10:], -1, http.StatusConflict, "Expected offset 0"},
+		{"wrong length", 0, data[:20], -1, http.StatusBadRequest, "Chunk must be 41 bytes"},
+		{"wrong type", 0, bytes.Repeat([]byte("x"), len(data)), -1, http.StatusBadRequest, "not a valid application/json file"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, store := newTestServer(t)
+			uploadID, err := store.CreateMultipartUpload("sha256/data", nil, "application/json")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectUploadSession(t, mock, "level.json", data, 0, uploadID)
+			if test.rowsAffected >= 0 {
+				// The session only advances if no other chunk was stored for this
+				// offset in the meantime
+				mock.ExpectExec("UPDATE upload_sessions").
+					WithArgs(int64(len(data)), sqlmock.AnyArg(), "1", testSessionID, test.offset).
+					WillReturnResult(sqlmock.NewResult(0, test.rowsAffected))
+			}
+
+			response := putChunk(server, test.offset, test.chunk)
+			if response.Code != test.wantStatus {
+				t.Fatalf("got status %d: %s", response.Code, response.Body.String())
+			}
+
+			if !strings.Contains(response.Body.String(), test.wantBody) {
+				t.Errorf("got body %q, want it to contain %q", response.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
+
+func TestUploadChunkResumesHash(t *testing.T) {
+	server, mock, store := newTestServer(t)
+
+	// A two chunk file, resumed after the first chunk
+	data := append([]byte("{"), bytes.Repeat([]byte(" "), uploadChunkSize)...)
+	data = append(data, "}"...)
+
+	uploadID, err := store.CreateMultipartUpload("sha256/data", nil, "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectUploadSession(t, mock, "level.json", data, uploadChunkSize, uploadID)
+
+	// The stored hash state must be the hash of the whole file once the last
+	// chunk is added
+	final := sha256.New()
+	final.Write(data)
+	finalState, err := final.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectExec("UPDATE upload_sessions").
+		WithArgs(int64(len(data)), finalState, "2", testSessionID, int64(uploadChunkSize)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	response := putChunk(server, uploadChunkSize, data[uploadChunkSize:])
+	if response.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", response.Code, response.Body.String())
+	}
+}
+
+func TestUploadChunkForbiddenForViewers(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	request := httptest.NewRequest("PUT", "/projects/1/uploads/"+testSessionID+"?offset=0", strings.NewReader("{}"))
+	request.SetPathValue("upload", testSessionID)
+	request = withTestProject(request, "user-1", 1, RoleViewer)
+
+	recorder := httptest.NewRecorder()
+	server.handleUploadSession(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("got status %d", recorder.Code)
+	}
+}
+
+func TestStartUploadOfStoredObject(t *testing.T) {
+	data := []byte(`{"level": 2}`)
+	hash := sha256.Sum256(data)
+	hashString := hex.EncodeToString(hash[:])
+	object := assetObjectName(hashString)
+
+	tests := []struct {
+		name        string
+		contentType string
+		accessible  bool
+		reused      bool
+	}{
+		{"accessible", "application/json", true, true},
+		{"inaccessible", "application/json", false, false},
+		// Objects stored before their types were recorded are checked again
+		{"unknown type", "", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, mock, _ := newTestServer(t)
+
+			mock.ExpectQuery("FROM project_assets").WithArgs(int64(1)).
+				WillReturnRows(sqlmock.NewRows([]string{"name", "hash", "object", "content_type", "size", "uploaded_by"}))
+			mock.ExpectQuery("INSERT INTO objects").WithArgs(object).
+				WillReturnRows(sqlmock.NewRows([]string{"stored", "content_type", "size"}).AddRow(true, test.contentType, len(data)))
+			if test.contentType != "" {
+				mock.ExpectQuery("JOIN project_roles").WithArgs(object, "user-1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(test.accessible))
+			}
+
+			if test.reused {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT object FROM project_assets").WillReturnError(sql.ErrNoRows)
+				mock.ExpectExec("INSERT INTO project_assets").
+					WithArgs("level.json", hashString, object, int64(1), "application/json", int64(len(data)), "user-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			} else {
+				// The contents have to be sent and verified
+				mock.ExpectExec("INSERT INTO upload_sessions").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			body := `{"name": "level.json", "size": 12, "sha256": "` + hashString + `"}`
+			request := httptest.NewRequest("POST", "/projects/1/uploads", strings.NewReader(body))
+			request = withTestProject(request, "user-1", 1, RoleEditor)
+
+			recorder := httptest.NewRecorder()
+			server.handleUploadSessions(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			var session UploadSession
+			if err := json.NewDecoder(recorder.Body).Decode(&session); err != nil {
+				t.Fatal(err)
+			}
+
+			if session.Complete != test.reused || (session.ID == "") != test.reused {
+				t.Errorf("got session %+v", session)
+			}
+		})
+	}
+}
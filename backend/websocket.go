@@ -7,6 +7,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"log"
 	"strconv"
 	"strings"
@@ -14,7 +15,6 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/nedpals/supabase-go"
 
 	"simulo.tech/backend/m/v2/protocol"
 )
@@ -34,6 +34,7 @@ func (m *MachineData) GetType() string {
 type UserData struct {
 	UserID    string
 	ProjectID string
+	Role      ProjectRole
 }
 
 func (u *UserData) GetType() string {
@@ -42,8 +43,7 @@ func (u *UserData) GetType() string {
 
 type WebSocketHandler struct {
 	server         *Server
-	supabaseCli    *supabase.Client
-	s3Client       *S3Client
+	store          ObjectStore
 	conn           *websocket.Conn
 	onlineMachines *OnlineMachines
 }
@@ -77,20 +77,19 @@ func (om *OnlineMachines) Has(machineID int) bool {
 	return om.machines[machineID]
 }
 
-func NewWebSocketHandler(server *Server, supabaseCli *supabase.Client, s3Client *S3Client, conn *websocket.Conn) *WebSocketHandler {
+func NewWebSocketHandler(server *Server, store ObjectStore, conn *websocket.Conn) *WebSocketHandler {
 	return &WebSocketHandler{
 		server:         server,
-		supabaseCli:    supabaseCli,
-		s3Client:       s3Client,
+		store:          store,
 		conn:           conn,
 		onlineMachines: NewOnlineMachines(),
 	}
 }
 
-func (ws *WebSocketHandler) Handle() {
+func (ws *WebSocketHandler) Handle(ctx context.Context) {
 	var data WebSocketData
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	go ws.pingRoutine(ctx)
 
@@ -104,7 +103,7 @@ func (ws *WebSocketHandler) Handle() {
 		if data == nil {
 			// Authentication phase
 			if messageType == websocket.TextMessage {
-				data = ws.tryUserAuth(string(message))
+				data = ws.tryUserAuth(ctx, string(message))
 			} else if messageType == websocket.BinaryMessage {
 				data = ws.tryMachineAuth(message)
 			}
@@ -117,7 +116,11 @@ func (ws *WebSocketHandler) Handle() {
 			// Handle authenticated messages
 			switch d := data.(type) {
 			case *MachineData:
-				log.Printf("[machine %d] %v", d.MachineID, string(message))
+				if messageType == websocket.TextMessage {
+					log.Printf("[machine %d] %v", d.MachineID, string(message))
+				} else {
+					ws.handleMachineMessage(d, message)
+				}
 			case *UserData:
 				ws.handleUserMessage(d, message)
 			}
@@ -165,7 +168,7 @@ func (ws *WebSocketHandler) tryMachineAuth(message []byte) WebSocketData {
 		return nil
 	}
 
-	if !ws.verifySignature(idString, publicKey, signature) {
+	if !verifyMachineSignature(publicKey, idBuffer, signature) {
 		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4005, "not authorized"))
 		return nil
 	}
@@ -178,34 +181,50 @@ func (ws *WebSocketHandler) tryMachineAuth(message []byte) WebSocketData {
 	return &MachineData{MachineID: machineID}
 }
 
-func (ws *WebSocketHandler) tryUserAuth(message string) WebSocketData {
+func (ws *WebSocketHandler) tryUserAuth(ctx context.Context, message string) WebSocketData {
 	parts := strings.Split(message, "|")
 	if len(parts) != 2 {
 		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4007, "invalid auth format"))
 		return nil
 	}
 
-	user, err := ws.supabaseCli.Auth.User(context.Background(), parts[0])
+	user, err := ws.server.authenticate(ctx, parts[0])
 	if err != nil {
 		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "unauthorized"))
 		return nil
 	}
 
+	projectID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4009, "project not found"))
+		return nil
+	}
+
 	projectData, err := ws.server.GetProject(parts[1])
 	if err != nil {
 		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4009, "project not found"))
 		return nil
 	}
 
-	if projectData.Owner != user.ID {
-		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4008, "not project owner"))
+	role, err := ws.server.GetProjectRole(projectID, user.ID)
+	if err != nil {
+		log.Printf("Failed to get project role: %v", err)
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1011, "internal error"))
+		return nil
+	}
+
+	if role == "" {
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4008, "not project member"))
 		return nil
 	}
 
-	log.Printf("User %s authenticated", user.ID)
+	log.Printf("User %s authenticated as %s", user.ID, role)
+
+	ws.conn.WriteMessage(websocket.TextMessage, protocol.S2EProjectRole(string(role)))
 
 	// Send scene data
 	ws.conn.WriteMessage(websocket.TextMessage, protocol.S2EInitScene(projectData.Scene))
+	ws.conn.WriteMessage(websocket.TextMessage, protocol.S2ESceneRevision(projectData.Revision))
 
 	// Send machine online status
 	var sceneData []map[string]interface{}
@@ -224,16 +243,43 @@ func (ws *WebSocketHandler) tryUserAuth(message string) WebSocketData {
 		if promptImages, ok := sceneData[0]["promptImages"].([]interface{}); ok {
 			for _, imageID := range promptImages {
 				if idStr, ok := imageID.(string); ok {
-					url, err := ws.s3Client.PresignURL(idStr, 5*time.Minute)
-					if err == nil {
-						ws.conn.WriteMessage(websocket.BinaryMessage, protocol.S2EAddPromptImage(url))
-					}
+					ws.sendPromptImage(idStr)
 				}
 			}
 		}
 	}
 
-	return &UserData{UserID: user.ID, ProjectID: parts[1]}
+	return &UserData{UserID: user.ID, ProjectID: parts[1], Role: role}
+}
+
+func (ws *WebSocketHandler) handleMachineMessage(machineData *MachineData, message []byte) {
+	reader := protocol.NewPacketReader(message)
+	id, err := reader.U8()
+	if err != nil {
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4012, "invalid packet"))
+		return
+	}
+
+	switch id {
+	case protocol.M2SRequestAssetUrlsId:
+		var packet protocol.M2SRequestAssetUrls
+		if err := packet.Unmarshal(reader); err != nil {
+			ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4014, "protocol error"))
+			return
+		}
+
+		names, urls, err := ws.server.assetURLs(machineData.MachineID, packet.Names)
+		if err != nil {
+			log.Printf("Failed to get asset URLs: %v", err)
+			ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1011, "internal error"))
+			return
+		}
+
+		ws.conn.WriteMessage(websocket.BinaryMessage, protocol.S2MAssetUrls(names, urls))
+
+	default:
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4013, "unknown message type"))
+	}
 }
 
 func (ws *WebSocketHandler) handleUserMessage(userData *UserData, message []byte) {
@@ -249,6 +295,28 @@ func (ws *WebSocketHandler) handleUserMessage(userData *UserData, message []byte
 		return
 	}
 
+	// Every editor packet modifies the project, which viewers may not do. The
+	// role is looked up again since members may be removed or demoted while
+	// they are connected.
+	projectID, _ := strconv.ParseInt(userData.ProjectID, 10, 64)
+	role, err := ws.server.GetProjectRole(projectID, userData.UserID)
+	if err != nil {
+		log.Printf("Failed to get project role: %v", err)
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1011, "internal error"))
+		return
+	}
+
+	if role == "" {
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4008, "not project member"))
+		return
+	}
+
+	userData.Role = role
+	if !role.CanEdit() {
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4018, "read only"))
+		return
+	}
+
 	switch id {
 	case protocol.E2SAddImagesId:
 		var packet protocol.E2SAddImages
@@ -258,45 +326,50 @@ func (ws *WebSocketHandler) handleUserMessage(userData *UserData, message []byte
 		}
 
 		for _, data := range packet.Uploads {
-			projectData, err := ws.server.GetProject(userData.ProjectID)
-			if err != nil {
-				ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4016, "project not found"))
-				return
-			}
-
 			// Generate new UUID for the file
 			fileID := generateRandomHex(16)
 
-			// Parse and update scene
-			var scene []map[string]interface{}
-			json.Unmarshal([]byte(projectData.Scene), &scene)
+			// Upload to the object store
+			if err := ws.server.storePromptImage(projectID, userData.UserID, fileID, data); err != nil {
+				// The quota is checked again once the image is stored
+				if err := ws.server.deleteObject(fileID); err != nil {
+					log.Printf("failed to rollback prompt image: %v", err)
+				}
 
-			if len(scene) > 0 {
-				if promptImages, ok := scene[0]["promptImages"].([]interface{}); ok {
-					scene[0]["promptImages"] = append(promptImages, fileID)
-				} else {
-					scene[0]["promptImages"] = []interface{}{fileID}
+				if errors.Is(err, ErrQuotaExceeded) {
+					ws.conn.WriteMessage(websocket.TextMessage, protocol.S2EError("Storage quota exceeded"))
+					return
 				}
-			}
 
-			// Upload to S3
-			if err := ws.s3Client.UploadBuffer(fileID, data); err != nil {
-				log.Printf("S3 upload failed: %v", err)
+				// The other images are still added
+				if isImageError(err) {
+					ws.conn.WriteMessage(websocket.TextMessage, protocol.S2EError("Could not add image: "+err.Error()))
+				} else {
+					log.Printf("prompt image upload failed: %v", err)
+				}
 				continue
 			}
 
-			// Update database
-			updatedScene, _ := json.Marshal(scene)
-			ws.server.UpdateProjectScene(userData.ProjectID, string(updatedScene))
-
-			// Send presigned URL back
-			url, err := ws.s3Client.PresignURL(fileID, 5*time.Minute)
-			if err == nil {
-				packet := protocol.NewPacket()
-				packet.U8(1)
-				packet.String(url)
-				ws.conn.WriteMessage(websocket.BinaryMessage, packet.ToBuffer())
+			revision, err := ws.server.EditProjectScene(userData.ProjectID, func(scene []map[string]interface{}) {
+				if len(scene) > 0 {
+					if promptImages, ok := scene[0]["promptImages"].([]interface{}); ok {
+						scene[0]["promptImages"] = append(promptImages, fileID)
+					} else {
+						scene[0]["promptImages"] = []interface{}{fileID}
+					}
+				}
+			})
+			if err != nil {
+				if err := ws.server.deleteObject(fileID); err != nil {
+					log.Printf("failed to rollback prompt image: %v", err)
+				}
+				ws.closeSceneWriteError(err)
+				return
 			}
+
+			ws.conn.WriteMessage(websocket.TextMessage, protocol.S2ESceneRevision(revision))
+
+			ws.sendPromptImage(fileID)
 		}
 
 	case protocol.E2SDeleteImageId:
@@ -306,29 +379,31 @@ func (ws *WebSocketHandler) handleUserMessage(userData *UserData, message []byte
 			return
 		}
 
-		projectData, err := ws.server.GetProject(userData.ProjectID)
+		var deletedImage string
+		revision, err := ws.server.EditProjectScene(userData.ProjectID, func(scene []map[string]interface{}) {
+			deletedImage = ""
+			if len(scene) > 0 {
+				promptImages, ok := scene[0]["promptImages"].([]interface{})
+				if ok {
+					index := int(packet.Index)
+					if index < len(promptImages) {
+						deletedImage, _ = promptImages[index].(string)
+						scene[0]["promptImages"] = append(promptImages[:index], promptImages[index+1:]...)
+					}
+				}
+			}
+		})
 		if err != nil {
-			ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4016, "project not found"))
+			ws.closeSceneWriteError(err)
 			return
 		}
 
-		scene := []map[string]interface{}{}
-		json.Unmarshal([]byte(projectData.Scene), &scene)
-
-		if len(scene) > 0 {
-			promptImages, ok := scene[0]["promptImages"].([]interface{})
-			if ok {
-				index := int(packet.Index)
-				if index < len(promptImages) {
-					_ = ws.s3Client.Delete(promptImages[index].(string))
-					scene[0]["promptImages"] = append(promptImages[:index], promptImages[index+1:]...)
-				}
-			}
+		// Only remove the object once the scene no longer references it
+		if deletedImage != "" {
+			_ = ws.server.deleteObject(deletedImage)
 		}
 
-		updatedScene, _ := json.Marshal(scene)
-		ws.server.UpdateProjectScene(userData.ProjectID, string(updatedScene))
-
+		ws.conn.WriteMessage(websocket.TextMessage, protocol.S2ESceneRevision(revision))
 		ws.conn.WriteMessage(websocket.BinaryMessage, protocol.S2EDeletePromptImage(packet.Index))
 
 	default:
@@ -336,60 +411,43 @@ func (ws *WebSocketHandler) handleUserMessage(userData *UserData, message []byte
 	}
 }
 
-func (ws *WebSocketHandler) sendMachineProject(machineID int) {
-	query := `
-		SELECT object, name
-		FROM project_assets
-		WHERE project = (
-			SELECT project
-			FROM machines
-			WHERE id = $1
-		)
-	`
-
-	rows, err := ws.server.db.Query(query, machineID)
+// sendPromptImage sends the editor a URL to the thumbnail of a prompt image.
+func (ws *WebSocketHandler) sendPromptImage(imageID string) {
+	object, err := ws.server.imageVariantObject(imageID, thumbnailVariant)
 	if err != nil {
-		log.Printf("Failed to get project data: %v", err)
-		return
+		log.Printf("failed to get prompt image thumbnail: %v", err)
+		object = imageID
 	}
-	defer rows.Close()
-
-	var programUrl string
-	var programHash []byte
-	urls := []string{}
-	names := []string{}
-	hashes := [][]byte{}
 
-	for rows.Next() {
-		var object, name string
-		if err := rows.Scan(&object, &name); err != nil {
-			log.Printf("Failed to scan row: %v", err)
-			return
-		}
+	url, err := ws.store.PresignURL(object, 5*time.Minute)
+	if err == nil {
+		ws.conn.WriteMessage(websocket.BinaryMessage, protocol.S2EAddPromptImage(url))
+	}
+}
 
-		url, err := ws.s3Client.PresignURL(object, 5*time.Minute)
-		if err != nil {
-			log.Printf("Failed to presign URL for %s: %v", object, err)
-			return
-		}
+// closeSceneWriteError closes the connection after a failed scene write. If
+// the scene kept changing while an edit was retried, the editor reconnects and
+// receives the current scene.
+func (ws *WebSocketHandler) closeSceneWriteError(err error) {
+	if errors.Is(err, ErrSceneConflict) {
+		ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4017, "scene revision conflict"))
+		return
+	}
 
-		s3Hash, err := ws.s3Client.GetHash(object)
-		if err != nil {
-			log.Printf("Failed to get hash for %s: %v", object, err)
-			return
-		}
+	log.Printf("failed to update scene: %v", err)
+	ws.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1011, "internal error"))
+}
 
-		if name == "main.wasm" {
-			programUrl = url
-			programHash = s3Hash
-		} else {
-			urls = append(urls, url)
-			names = append(names, name)
-			hashes = append(hashes, s3Hash)
-		}
+func (ws *WebSocketHandler) sendMachineProject(machineID int) {
+	deploymentID, entries, err := ws.server.machineManifest(machineID)
+	if err != nil {
+		log.Printf("Failed to get asset manifest: %v", err)
+		return
 	}
 
-	ws.conn.WriteMessage(websocket.BinaryMessage, protocol.S2MInitAssets(programUrl, programHash, names, urls, hashes))
+	manifest := protocol.EncodeManifest(deploymentID, entries)
+	signature := ws.server.manifestSigner.Sign(manifest)
+	ws.conn.WriteMessage(websocket.BinaryMessage, protocol.S2MInitAssets(manifest, signature, entries))
 }
 
 func (ws *WebSocketHandler) pingRoutine(ctx context.Context) {
@@ -409,7 +467,9 @@ func (ws *WebSocketHandler) pingRoutine(ctx context.Context) {
 	}
 }
 
-func (ws *WebSocketHandler) verifySignature(id, publicKeyPem string, signature []byte) bool {
+// verifyMachineSignature checks a signature by a machine's Ed25519 key, stored
+// as a PEM-encoded public key.
+func verifyMachineSignature(publicKeyPem string, message, signature []byte) bool {
 	block, _ := pem.Decode([]byte(publicKeyPem))
 	if block == nil {
 		return false
@@ -425,6 +485,5 @@ func (ws *WebSocketHandler) verifySignature(id, publicKeyPem string, signature [
 		return false
 	}
 
-	message := []byte(id)
 	return ed25519.Verify(ed25519PubKey, message, signature)
 }
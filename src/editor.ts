@@ -17,6 +17,9 @@ const uploadedImages = new Array<File>();
 
 let projectId: string;
 let websocket: RetryWebsocket | undefined;
+let readOnly = false;
+// The revision of the scene as last seen by this editor
+let sceneRevision: number | undefined;
 
 export function init(project: string) {
   projectId = project;
@@ -36,6 +39,7 @@ export function init(project: string) {
 
         websocket!.send(data.session!.access_token! + "|" + projectId);
         promptImages.innerHTML = "";
+        sceneRevision = undefined;
       },
       (event) => {
         if (event.data instanceof ArrayBuffer) {
@@ -48,6 +52,10 @@ export function init(project: string) {
               const index = promptImages.children.length;
               element.innerHTML = `<img src="${url}" alt="uploaded image"><button class="delete-button">X</button>`;
               element.addEventListener("click", () => {
+                if (readOnly) {
+                  return;
+                }
+
                 const packet = new Packet();
                 packet.u8(1);
                 packet.u8(index);
@@ -73,8 +81,24 @@ export function init(project: string) {
             const sceneData = JSON.parse(parts[1]);
             promptInput.value = sceneData[0].prompt;
             scene.initSceneData(sceneData);
+          } else if (parts[0] === "revision") {
+            const revision = parseInt(parts[1], 10);
+            // A skipped revision means another editor changed the scene, so
+            // reconnect to receive the current one
+            if (sceneRevision !== undefined && revision !== sceneRevision + 1) {
+              sceneRevision = undefined;
+              websocket!.reconnect();
+            } else {
+              sceneRevision = revision;
+            }
+          } else if (parts[0] === "role") {
+            readOnly = parts[1] === "viewer";
+            promptInput.disabled = readOnly;
+            promptSubmitBtn.disabled = readOnly;
           } else if (parts[0] === "machineonline") {
             scene.setMachineOnline(parseInt(parts[1], 10), parts[2] === "true");
+          } else if (parts[0] === "error") {
+            ui.showMessage(promptMessage, `ERROR: ${parts[1]}`, "error");
           }
         } else {
           console.error("Invalid message type", event.data);
@@ -152,7 +176,7 @@ function updateDragIndicator() {
 }
 
 document.addEventListener("dragenter", (event) => {
-  if (typeof websocket === "undefined") {
+  if (typeof websocket === "undefined" || readOnly) {
     return;
   }
 
@@ -167,7 +191,7 @@ document.addEventListener("dragover", (event) => {
 });
 
 document.addEventListener("dragleave", (event) => {
-  if (typeof websocket === "undefined") {
+  if (typeof websocket === "undefined" || readOnly) {
     return;
   }
 
@@ -178,7 +202,7 @@ document.addEventListener("dragleave", (event) => {
 });
 
 document.addEventListener("drop", async (event) => {
-  if (typeof websocket === "undefined") {
+  if (typeof websocket === "undefined" || readOnly) {
     return;
   }
 
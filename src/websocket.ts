@@ -54,6 +54,11 @@ export class RetryWebsocket {
     };
   }
 
+  // Closes the connection so that it's reopened, starting a new session
+  reconnect() {
+    this.websocket?.close();
+  }
+
   send(message: string | Buffer | ArrayBuffer) {
     if (!this.websocket) {
       return;